@@ -0,0 +1,489 @@
+// Copyright 2014-2015 The DevMine authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/DevMine/srcanlzr/src"
+
+	"github.com/DevMine/srctool/log"
+)
+
+// blameLine is a line of a file, as annotated by git blame.
+type blameLine struct {
+	commit  string
+	author  string
+	email   string
+	time    int64 // committer time, as a Unix timestamp
+	content string
+}
+
+// AuthorShare is the number of lines of an entity written by an author.
+type AuthorShare struct {
+	Name  string `json:"name"`
+	Email string `json:"email"`
+	Lines int    `json:"lines"`
+}
+
+// CommitInfo identifies a commit.
+type CommitInfo struct {
+	Commit string `json:"commit"`
+	Author string `json:"author"`
+	Date   string `json:"date"`
+}
+
+// Attribution is the authorship of an entity (file, function, method or
+// type): who wrote its lines and which commit modified it last.
+type Attribution struct {
+	Kind       string        `json:"kind"`
+	Name       string        `json:"name"`
+	StartLine  int           `json:"start_line"`
+	EndLine    int           `json:"end_line"`
+	Authors    []AuthorShare `json:"authors"`
+	LastCommit *CommitInfo   `json:"last_commit,omitempty"`
+}
+
+// FileAuthorship is the authorship of a source file and of its entities.
+type FileAuthorship struct {
+	Path     string        `json:"path"`
+	File     Attribution   `json:"file"`
+	Entities []Attribution `json:"entities,omitempty"`
+}
+
+// projectAuthorship runs git blame on every source file of a project and
+// attributes its lines, functions, methods and types to their authors.
+// The project must be a git repository. Files that cannot be blamed, such
+// as untracked files, are skipped.
+func projectAuthorship(projectPath string, prj *src.Project) ([]FileAuthorship, error) {
+	if _, err := git(projectPath, "rev-parse", "--show-toplevel"); err != nil {
+		log.Debug(err)
+		return nil, errors.New(projectPath + " is not a git repository")
+	}
+
+	absPrj, err := filepath.Abs(projectPath)
+	if err != nil {
+		return nil, err
+	}
+
+	var fas []FileAuthorship
+	for _, pkg := range prj.Packages {
+		if pkg == nil {
+			continue
+		}
+		for _, sf := range pkg.SourceFiles {
+			if sf == nil {
+				continue
+			}
+
+			path := sf.Path
+			if filepath.IsAbs(path) {
+				if path, err = filepath.Rel(absPrj, path); err != nil {
+					log.Debug(err)
+					continue
+				}
+			}
+
+			lines, err := blame(projectPath, path)
+			if err != nil {
+				log.Debug("skipping authorship of ", sf.Path, ": ", err)
+				continue
+			}
+
+			fa, err := fileAuthorship(sf, lines)
+			if err != nil {
+				return nil, err
+			}
+			fas = append(fas, fa)
+		}
+	}
+
+	return fas, nil
+}
+
+// blame runs git blame on a file of the repository dir.
+func blame(dir, path string) ([]blameLine, error) {
+	out, err := git(dir, "blame", "--line-porcelain", "--", path)
+	if err != nil {
+		return nil, err
+	}
+
+	// In the porcelain format, each line is introduced by a header
+	// "<commit> <orig line> <final line> [<group size>]", followed by
+	// "<key> <value>" lines and finally by the content prefixed by a tab.
+	var lines []blameLine
+	var cur blameLine
+	for _, l := range strings.Split(out, "\n") {
+		switch {
+		case strings.HasPrefix(l, "\t"):
+			cur.content = l[1:]
+			lines = append(lines, cur)
+			cur = blameLine{}
+		case strings.HasPrefix(l, "author "):
+			cur.author = strings.TrimPrefix(l, "author ")
+		case strings.HasPrefix(l, "author-mail "):
+			cur.email = strings.Trim(strings.TrimPrefix(l, "author-mail "), "<>")
+		case strings.HasPrefix(l, "committer-time "):
+			cur.time, _ = strconv.ParseInt(strings.TrimPrefix(l, "committer-time "), 10, 64)
+		case len(cur.commit) == 0 && len(l) >= 40:
+			cur.commit = strings.Fields(l)[0]
+		}
+	}
+
+	return lines, nil
+}
+
+// fileAuthorship attributes a source file and its entities to their authors.
+func fileAuthorship(sf *src.SourceFile, lines []blameLine) (FileAuthorship, error) {
+	fa := FileAuthorship{
+		Path: sf.Path,
+		File: attribute("file", sf.Path, lines, 1, len(lines)),
+	}
+
+	funcs, types, err := fileDecls(sf)
+	if err != nil {
+		return fa, fmt.Errorf("unable to read the declarations of %s: %v", sf.Path, err)
+	}
+
+	var lang string
+	if sf.Language != nil {
+		lang = sf.Language.Lang
+	}
+
+	// lines already claimed by a declaration, so that overloads are
+	// matched with successive declarations
+	claimed := make(map[int]bool)
+
+	for _, f := range funcs {
+		if start, end := locateDecl(f, lang, lines, 0, claimed); start > 0 {
+			fa.Entities = append(fa.Entities, attribute(f.kind, f.name, lines, start, end))
+		}
+	}
+
+	for _, t := range types {
+		start, end := locateDecl(t, lang, lines, 0, claimed)
+		if start == 0 {
+			continue
+		}
+		fa.Entities = append(fa.Entities, attribute(t.kind, t.name, lines, start, end))
+
+		for _, m := range t.methods {
+			if mstart, mend := locateDecl(m, lang, lines, start-1, claimed); mstart > 0 {
+				fa.Entities = append(fa.Entities, attribute(m.kind, t.name+"."+m.name, lines, mstart, mend))
+			}
+		}
+	}
+
+	return fa, nil
+}
+
+// funcDecls are the patterns of the function declarations of the languages
+// declaring them with a keyword, NAME standing for the name of the function.
+// The other languages, such as C or Java, are matched by cFuncDecl.
+var funcDecls = map[string]string{
+	"go":         `^\s*func\s+(\([^)]*\)\s*)?NAME\s*[\[(]`,
+	"haskell":    `^NAME\b[^=]*(=|::)`,
+	"javascript": `\bfunction\s*\*?\s*NAME\s*\(|\bNAME\s*[:=]\s*(async\s+)?(function\b|\([^)]*\)\s*=>|[\w$]+\s*=>)|^\s*(static\s+|async\s+|get\s+|set\s+)*NAME\s*\([^)]*\)\s*\{`,
+	"objc":       `^\s*[-+]\s*\([^)]*\)\s*NAME\b`,
+	"perl":       `^\s*sub\s+NAME\b`,
+	"php":        `\bfunction\s+&?NAME\s*\(`,
+	"python":     `^\s*(async\s+)?def\s+NAME\s*\(`,
+	"ruby":       `^\s*def\s+(self\.)?NAME\b`,
+	"rust":       `\bfn\s+NAME\b`,
+	"scala":      `\bdef\s+NAME\b`,
+	"swift":      `\bfunc\s+NAME\b`,
+}
+
+// cFuncDecl is the pattern of the function declarations starting with their
+// return type or their modifiers, as in C, C++, C# or Java, NAME standing for
+// the name of the function.
+const cFuncDecl = `^\s*([\w<>\[\],*&~:.]+\s+)+[*&]*(\w+::)*NAME\s*\(`
+
+// typeDecl is the pattern of the type declarations, NAME standing for the
+// name of the type.
+const typeDecl = `\b(type|struct|class|interface|enum|trait|record|module|protocol|object|data|newtype)\s+NAME\b`
+
+// notDeclarations are the keywords starting a statement that cFuncDecl
+// mistakes for a declaration.
+var notDeclarations = map[string]bool{
+	"return": true, "new": true, "throw": true, "else": true, "case": true,
+	"await": true, "yield": true, "delete": true, "goto": true, "print": true,
+}
+
+// declRegexp returns the regular expression matching the first line of a
+// declaration of the given language.
+func declRegexp(d decl, lang string) *regexp.Regexp {
+	pattern := typeDecl
+	if d.kind == "function" || d.kind == "method" {
+		var ok bool
+		if pattern, ok = funcDecls[lang]; !ok {
+			pattern = cFuncDecl
+		}
+	}
+	return regexp.MustCompile(strings.Replace(pattern, "NAME", regexp.QuoteMeta(d.name), -1))
+}
+
+// locateDecl returns the first and last lines (1-based) of a declaration of
+// the given language.
+//
+// Declarations do not carry their position, hence the first line is the
+// first one, after line from, that is not already claimed and declares the
+// name: with the keyword introducing the functions or the types of the
+// language or, for the languages without such keyword, preceded by a type,
+// the definitions being preferred to the prototypes. The first line is then
+// claimed. The last line
+// is the end of the body of the declaration, found by matching braces,
+// following the indentation or, in Ruby, looking for the closing "end". It
+// returns 0, 0 if the declaration cannot be found.
+func locateDecl(d decl, lang string, lines []blameLine, from int, claimed map[int]bool) (int, int) {
+	if len(d.name) == 0 {
+		return 0, 0
+	}
+
+	re := declRegexp(d, lang)
+	_, keyword := funcDecls[lang]
+	cLike := (d.kind == "function" || d.kind == "method") && !keyword
+
+	// the definitions are preferred to the prototypes, ending with a
+	// semicolon
+	for _, prototypes := range []bool{false, true} {
+		for i := from; i < len(lines); i++ {
+			if claimed[i] || !re.MatchString(lines[i].content) {
+				continue
+			}
+
+			if cLike {
+				content := strings.TrimSpace(lines[i].content)
+				if notDeclarations[strings.Fields(content)[0]] || strings.HasSuffix(content, ";") != prototypes {
+					continue
+				}
+			} else if prototypes {
+				break
+			}
+
+			claimed[i] = true
+			return i + 1, declEnd(lang, lines, i, d.loc) + 1
+		}
+	}
+
+	return 0, 0
+}
+
+// declEnd returns the index of the last line of the declaration starting at
+// the line of index start. When the structure of the declaration cannot be
+// followed, the last line is deduced from its number of lines of code.
+func declEnd(lang string, lines []blameLine, start int, loc int64) int {
+	var end int
+	switch lang {
+	case "python", "haskell":
+		end = indentedBlockEnd(lines, start)
+	case "ruby":
+		end = rubyBlockEnd(lines, start)
+	default:
+		end = braceBlockEnd(lines, start)
+	}
+	if end >= start {
+		return end
+	}
+
+	end = start + int(loc) - 1
+	if end < start {
+		end = start
+	}
+	if end >= len(lines) {
+		end = len(lines) - 1
+	}
+	return end
+}
+
+// braceBlockEnd returns the index of the line closing the body, delimited by
+// braces, of the declaration starting at the line of index start. A
+// declaration without body ends with its signature, when the line following
+// it does not open a body. It returns -1 if the body is not closed.
+func braceBlockEnd(lines []blameLine, start int) int {
+	depth, parens := 0, 0
+	opened := false
+	for i := start; i < len(lines); i++ {
+		code := stripLiterals(lines[i].content)
+		for _, r := range code {
+			switch r {
+			case '(':
+				parens++
+			case ')':
+				parens--
+			case '{':
+				depth++
+				opened = true
+			case '}':
+				depth--
+			}
+			if opened && depth == 0 {
+				return i
+			}
+		}
+
+		if opened || parens > 0 {
+			continue
+		}
+
+		// the signature is complete: the body may only start on the
+		// next non-blank line
+		trimmed := strings.TrimSpace(code)
+		if strings.HasSuffix(trimmed, ";") {
+			return i
+		}
+		next := i + 1
+		for next < len(lines) && len(strings.TrimSpace(lines[next].content)) == 0 {
+			next++
+		}
+		if next == len(lines) || !strings.HasPrefix(strings.TrimSpace(lines[next].content), "{") {
+			if strings.HasSuffix(trimmed, ",") || strings.HasSuffix(trimmed, "=") {
+				return -1
+			}
+			return i
+		}
+	}
+	return -1
+}
+
+// indentedBlockEnd returns the index of the last line indented deeper than
+// the line of index start, or start itself.
+func indentedBlockEnd(lines []blameLine, start int) int {
+	indent := indentation(lines[start].content)
+	end := start
+	for i := start + 1; i < len(lines); i++ {
+		if len(strings.TrimSpace(lines[i].content)) == 0 {
+			continue
+		}
+		if indentation(lines[i].content) <= indent {
+			break
+		}
+		end = i
+	}
+	return end
+}
+
+// rubyBlockEnd returns the index of the "end" line closing the declaration
+// starting at the line of index start, indented as the declaration. It
+// returns -1 if there is none.
+func rubyBlockEnd(lines []blameLine, start int) int {
+	if strings.HasSuffix(strings.TrimSpace(stripLiterals(lines[start].content)), "end") {
+		return start
+	}
+
+	indent := indentation(lines[start].content)
+	for i := start + 1; i < len(lines); i++ {
+		if strings.TrimSpace(lines[i].content) == "end" && indentation(lines[i].content) == indent {
+			return i
+		}
+	}
+	return -1
+}
+
+// indentation returns the width of the indentation of a line, tabs counting
+// as 8 columns.
+func indentation(line string) int {
+	n := 0
+	for _, r := range line {
+		switch r {
+		case ' ':
+			n++
+		case '\t':
+			n += 8 - n%8
+		default:
+			return n
+		}
+	}
+	return n
+}
+
+// stripLiterals removes the string and character literals and the trailing
+// comment of a line of code, so that the braces they hold are not counted.
+func stripLiterals(line string) string {
+	var b []byte
+	var quote byte
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case quote != 0:
+			if c == '\\' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+		case c == '\'':
+			// only character literals, not the lifetimes of Rust
+			if j := strings.IndexByte(line[i+1:], '\''); j >= 0 && j <= 2 {
+				i += j + 1
+			} else {
+				b = append(b, c)
+			}
+		case c == '"' || c == '`':
+			quote = c
+		case c == '/' && i+1 < len(line) && line[i+1] == '/', c == '#':
+			return string(b)
+		default:
+			b = append(b, c)
+		}
+	}
+	return string(b)
+}
+
+// attribute attributes the lines start to end (1-based, inclusive) to their
+// authors.
+func attribute(kind, name string, lines []blameLine, start, end int) Attribution {
+	a := Attribution{Kind: kind, Name: name, StartLine: start, EndLine: end}
+
+	shares := make(map[string]*AuthorShare)
+	var last *blameLine
+	for i := start - 1; i < end && i < len(lines); i++ {
+		l := &lines[i]
+
+		key := l.author + " <" + l.email + ">"
+		s, ok := shares[key]
+		if !ok {
+			s = &AuthorShare{Name: l.author, Email: l.email}
+			shares[key] = s
+		}
+		s.Lines++
+
+		if last == nil || l.time > last.time {
+			last = l
+		}
+	}
+
+	for _, s := range shares {
+		a.Authors = append(a.Authors, *s)
+	}
+	sort.Sort(byLines(a.Authors))
+
+	if last != nil {
+		a.LastCommit = &CommitInfo{
+			Commit: last.commit,
+			Author: last.author,
+			Date:   time.Unix(last.time, 0).UTC().Format(time.RFC3339),
+		}
+	}
+
+	return a
+}
+
+type byLines []AuthorShare
+
+func (as byLines) Len() int      { return len(as) }
+func (as byLines) Swap(i, j int) { as[i], as[j] = as[j], as[i] }
+func (as byLines) Less(i, j int) bool {
+	if as[i].Lines != as[j].Lines {
+		return as[i].Lines > as[j].Lines
+	}
+	return as[i].Name < as[j].Name
+}
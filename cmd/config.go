@@ -6,6 +6,7 @@ package cmd
 
 import (
 	"fmt"
+	"os"
 
 	"github.com/codegangsta/cli"
 
@@ -14,31 +15,210 @@ import (
 )
 
 // Config command provides options for creating a default config file, getting
-// values and setting configuration values.
+// values and setting configuration values. Its first argument, if any, is an
+// action:
+//
+//	get <key>           print the value of a key
+//	set <key> <value>   check the value and save it into the user config file
+//	unset <key>         remove a key from the user config file
+//	list                print all the keys and their value
+//	validate            check all the configuration layers
+//
+// In JSON mode, the configuration is printed after any change. With the
+// "show-origin" option, the values are printed along with the layer they come
+// from.
 func Config(c *cli.Context) {
+	if c.Args().Present() && !c.Bool("server-url") {
+		switch action := c.Args().First(); action {
+		case "validate":
+			validateConfig(c)
+		case "get", "set", "unset", "list":
+			configAction(c, action, c.Args().Tail())
+		default:
+			fatal("unknown config action '", action, "', expected get, set, unset, list or validate")
+		}
+		return
+	}
+
 	// This will create the configuration directory and file if it does not
 	// already exist.
-	cfg, err := config.New()
+	cfg, err := loadConfig(c, ".")
 	if err != nil {
-		log.Fatal(err)
+		fatal(err)
 	}
 
 	if c.Bool("server-url") {
 		if len(c.Args()) > 1 {
-			log.Fatal("invalid number of argument")
+			fatal("invalid number of argument")
 		}
 
 		if !c.Args().Present() {
+			if jsonOutput(c) {
+				printJSON(cfg)
+				return
+			}
 			fmt.Println("server-url = ", cfg.DownloadServerURL)
 			return
 		}
 
-		cfg.DownloadServerURL = c.Args().First()
+		// set through the settings, so that the URL is checked and saved
+		if err = cfg.Set("download_server_url", c.Args().First()); err != nil {
+			fatal(configError(err))
+		}
 		if err = cfg.Save(); err != nil {
-			log.Fatal(err)
+			fatal(configError(err))
 		}
 
 		log.Success("download server URL successfully updated")
+	}
+
+	if c.Bool("show-origin") {
+		printConfig(c, cfg)
 		return
 	}
+
+	if jsonOutput(c) {
+		printJSON(cfg)
+	}
+}
+
+// configAction runs the get, set, unset and list actions of the config
+// command.
+func configAction(c *cli.Context, action string, args []string) {
+	nargs := map[string]int{"get": 1, "set": 2, "unset": 1, "list": 0}[action]
+	if len(args) != nargs {
+		fatal("config ", action, ": expected ", nargs, " argument(s), found ", len(args))
+	}
+
+	cfg, err := loadConfig(c, ".")
+	if err != nil {
+		fatal(err)
+	}
+
+	switch action {
+	case "get":
+		v, err := cfg.Get(args[0])
+		if err != nil {
+			fatal(configError(err))
+		}
+		if jsonOutput(c) {
+			printJSON(configValue{Key: args[0], Value: v, Origin: cfg.Origin(args[0])})
+			return
+		}
+		if c.Bool("show-origin") {
+			fmt.Printf("%s\t%s\n", cfg.Origin(args[0]), v)
+			return
+		}
+		fmt.Println(v)
+	case "set":
+		if err = cfg.Set(args[0], args[1]); err != nil {
+			fatal(configError(err))
+		}
+		if err = cfg.Save(); err != nil {
+			fatal(configError(err))
+		}
+		log.Success(args[0], " successfully updated")
+		if jsonOutput(c) {
+			printJSON(cfg)
+		}
+	case "unset":
+		cfg.Unset(args[0])
+		if err = cfg.Save(); err != nil {
+			fatal(configError(err))
+		}
+		log.Success(args[0], " successfully unset")
+		if jsonOutput(c) {
+			printJSON(cfg)
+		}
+	case "list":
+		printConfig(c, cfg)
+	}
+}
+
+// configValue is a configuration value along with its origin, in the JSON
+// output of the config command.
+type configValue struct {
+	Key    string        `json:"key"`
+	Value  string        `json:"value"`
+	Origin config.Origin `json:"origin"`
+}
+
+// printConfig prints the configuration values, along with their origin if
+// requested by the "show-origin" option or in JSON.
+func printConfig(c *cli.Context, cfg *config.Config) {
+	var values []configValue
+	for _, key := range cfg.Keys() {
+		v, _ := cfg.Get(key)
+		values = append(values, configValue{Key: key, Value: v, Origin: cfg.Origin(key)})
+	}
+
+	if jsonOutput(c) {
+		printJSON(struct {
+			Values []configValue `json:"values"`
+		}{values})
+		return
+	}
+
+	for _, v := range values {
+		if c.Bool("show-origin") {
+			fmt.Printf("%s\t", v.Origin)
+		}
+		fmt.Printf("%s = %s\n", v.Key, v.Value)
+	}
+}
+
+// configProblem is a problem of the configuration, in the JSON output of the
+// config validate command.
+type configProblem struct {
+	Origin  config.Origin `json:"origin"`
+	Key     string        `json:"key,omitempty"`
+	Message string        `json:"message"`
+	Level   string        `json:"level"` // "warning" or "error"
+}
+
+// validateConfig reports the problems of all the configuration layers. It
+// fails if any of them is an error, unknown keys being only warnings.
+func validateConfig(c *cli.Context) {
+	if len(c.Args()) != 1 {
+		fatal("config validate: expected 0 argument(s), found ", len(c.Args())-1)
+	}
+
+	flags, err := setFlags(c)
+	if err != nil {
+		fatal(err)
+	}
+
+	problems := config.Validate(".", flags)
+
+	errs := 0
+	var out []configProblem
+	for _, p := range problems {
+		level := "warning"
+		if p.Warning {
+			log.Warn(p)
+		} else {
+			log.Fail(p)
+			level = "error"
+			errs++
+		}
+		out = append(out, configProblem{Origin: p.Origin, Key: p.Key, Message: p.Message, Level: level})
+	}
+
+	if jsonOutput(c) {
+		if out == nil {
+			out = []configProblem{}
+		}
+		printJSON(struct {
+			Problems []configProblem `json:"problems"`
+		}{out})
+		if errs > 0 {
+			os.Exit(int(errConfig))
+		}
+		return
+	}
+
+	if errs > 0 {
+		fatal(configError(fmt.Errorf("%d error(s) found in the configuration", errs)))
+	}
+	log.Success("the configuration is valid")
 }
@@ -0,0 +1,551 @@
+// Copyright 2014-2015 The DevMine authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cmd
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/codegangsta/cli"
+
+	"github.com/DevMine/srctool/log"
+	"github.com/DevMine/srctool/manager"
+)
+
+// coordinatorStateFile is the name of the file, in the output directory of
+// the coordinator, holding the state of the tasks.
+const coordinatorStateFile = "tasks.json"
+
+// Coordinator command distributes the parsing of a corpus of projects to
+// workers over HTTP. It expects one argument: a file listing the projects,
+// one per line, as paths reachable by the workers or git repository URLs.
+//
+// Workers lease tasks for the duration given by the "lease" option and must
+// send heartbeats to keep them. Tasks whose lease expires or that fail are
+// given to another worker, up to the number of attempts given by the
+// "max-attempts" option. Results are written into the directory given by the
+// "o" option, along with the state of the tasks, so that the coordinator can
+// be restarted. The parsers used by the workers are pinned by a lockfile,
+// either given by the "lockfile" option or made of the installed parsers.
+func Coordinator(c *cli.Context) {
+	if len(c.Args()) != 1 {
+		fatal("expected 1 argument, found ", len(c.Args()))
+	}
+
+	outDir := c.String("o")
+	if len(outDir) == 0 {
+		fatal("missing -o option")
+	}
+	if err := os.MkdirAll(outDir, 0755); err != nil {
+		log.Debug(err)
+		fatal("unable to create the output directory ", outDir)
+	}
+
+	var lf lockfile
+	var err error
+	if path := c.String("lockfile"); len(path) > 0 {
+		lf, err = readLockfile(path)
+	} else {
+		var m *manager.Manager
+		if m, err = lockManager(c, false); err == nil {
+			lf, err = installedLockfile(m)
+			unlockParsers()
+		}
+	}
+	if err != nil {
+		fatal(err)
+	}
+
+	projects, err := readProjectList(c.Args().First())
+	if err != nil {
+		fatal(err)
+	}
+
+	co, err := newCoordinator(outDir, projects, lf, c.Duration("lease"), c.Int("max-attempts"))
+	if err != nil {
+		fatal(err)
+	}
+
+	go func() {
+		for range time.Tick(co.lease / 4) {
+			co.expireLeases(time.Now())
+		}
+	}()
+
+	addr := c.String("listen")
+	log.Info(fmt.Sprintf("coordinating %d project(s) on %s", len(projects), addr))
+	if err = http.ListenAndServe(addr, co.handler()); err != nil {
+		log.Debug(err)
+		fatal("unable to listen on ", addr)
+	}
+}
+
+// readProjectList reads a list of projects, one per line. Empty lines and
+// lines starting with # are ignored.
+func readProjectList(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		log.Debug(err)
+		return nil, fmt.Errorf("unable to open the project list %s", path)
+	}
+	defer f.Close()
+
+	var projects []string
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		projects = append(projects, line)
+	}
+	if err = sc.Err(); err != nil {
+		log.Debug(err)
+		return nil, fmt.Errorf("unable to read the project list %s", path)
+	}
+
+	if len(projects) == 0 {
+		return nil, errors.New("the project list is empty")
+	}
+	return projects, nil
+}
+
+// task is the parsing of a project of the corpus.
+type task struct {
+	ID       string `json:"id"`
+	Project  string `json:"project"`
+	State    string `json:"state"`
+	Attempts int    `json:"attempts"`
+	Worker   string `json:"worker,omitempty"`
+	Error    string `json:"error,omitempty"`
+	Output   string `json:"output,omitempty"`
+
+	// lease identifies the current lease of the task, so that a worker
+	// whose lease expired cannot report on a task given to another one.
+	lease   string
+	expires time.Time
+}
+
+// lease is what a worker receives when it leases a task.
+type lease struct {
+	Task      task   `json:"task"`
+	Lease     string `json:"lease"`
+	Expires   string `json:"expires"`
+	Heartbeat int64  `json:"heartbeat_ms"` // heartbeat interval
+}
+
+// coordinator holds the tasks of a corpus. It is safe for concurrent use.
+type coordinator struct {
+	mu          sync.Mutex
+	outDir      string
+	tasks       []*task
+	byID        map[string]*task
+	lockfile    lockfile
+	lease       time.Duration
+	maxAttempts int
+}
+
+// newCoordinator creates a coordinator for the given projects. The state of
+// the tasks saved into outDir, if any, is restored: finished tasks are not
+// run again.
+func newCoordinator(outDir string, projects []string, lf lockfile, leaseDur time.Duration, maxAttempts int) (*coordinator, error) {
+	if leaseDur <= 0 {
+		return nil, errors.New("the lease duration must be positive")
+	}
+	if maxAttempts <= 0 {
+		return nil, errors.New("the maximum number of attempts must be positive")
+	}
+
+	co := &coordinator{
+		outDir:      outDir,
+		byID:        make(map[string]*task),
+		lockfile:    lf,
+		lease:       leaseDur,
+		maxAttempts: maxAttempts,
+	}
+
+	saved := make(map[string]*task)
+	lastID := 0
+	bs, err := ioutil.ReadFile(filepath.Join(outDir, coordinatorStateFile))
+	if err == nil {
+		var tasks []*task
+		if err = json.Unmarshal(bs, &tasks); err != nil {
+			log.Debug(err)
+			return nil, errors.New("malformed coordinator state file")
+		}
+		for _, t := range tasks {
+			saved[t.Project] = t
+			if n, err := strconv.Atoi(t.ID); err == nil && n > lastID {
+				lastID = n
+			}
+		}
+	} else if !os.IsNotExist(err) {
+		log.Debug(err)
+		return nil, errors.New("unable to read the coordinator state file")
+	}
+
+	seen := make(map[string]bool)
+	for _, project := range projects {
+		if seen[project] {
+			return nil, fmt.Errorf("duplicate project %s", project)
+		}
+		seen[project] = true
+
+		t, ok := saved[project]
+		if !ok {
+			lastID++
+			t = &task{ID: fmt.Sprintf("%06d", lastID), Project: project, State: jobQueued}
+		} else if t.State == jobRunning {
+			t.State, t.Worker = jobQueued, ""
+		}
+
+		co.tasks = append(co.tasks, t)
+		co.byID[t.ID] = t
+	}
+
+	return co, co.save()
+}
+
+// next leases the next queued task to worker. It returns false if no task is
+// queued.
+func (co *coordinator) next(worker string) (lease, bool, error) {
+	co.mu.Lock()
+	defer co.mu.Unlock()
+
+	for _, t := range co.tasks {
+		if t.State != jobQueued {
+			continue
+		}
+
+		token, err := newLeaseToken()
+		if err != nil {
+			return lease{}, false, err
+		}
+
+		t.State, t.Worker, t.Error = jobRunning, worker, ""
+		t.Attempts++
+		t.lease, t.expires = token, time.Now().Add(co.lease)
+		log.Info(fmt.Sprintf("task %s (%s) leased to %s, attempt %d", t.ID, t.Project, worker, t.Attempts))
+
+		l := lease{
+			Task:      *t,
+			Lease:     token,
+			Expires:   t.expires.UTC().Format(time.RFC3339),
+			Heartbeat: int64(co.lease/time.Millisecond) / 3,
+		}
+		return l, true, co.save()
+	}
+	return lease{}, false, nil
+}
+
+// finished tells whether all tasks are done or failed.
+func (co *coordinator) finished() bool {
+	co.mu.Lock()
+	defer co.mu.Unlock()
+
+	for _, t := range co.tasks {
+		if t.State == jobQueued || t.State == jobRunning {
+			return false
+		}
+	}
+	return true
+}
+
+// leased returns the task leased under the given token. The caller must hold
+// the lock.
+func (co *coordinator) leased(id, token string) (*task, error) {
+	t, ok := co.byID[id]
+	if !ok {
+		return nil, errTaskNotFound
+	}
+	if t.State != jobRunning || t.lease != token {
+		return nil, errLeaseLost
+	}
+	return t, nil
+}
+
+// errTaskNotFound is returned when a task does not exist.
+var errTaskNotFound = errors.New("task not found")
+
+// errLeaseLost is returned when a worker reports on a task it does not hold
+// anymore.
+var errLeaseLost = errors.New("lease lost")
+
+// invalidResultError is returned when an uploaded result is not a valid
+// project.
+type invalidResultError struct {
+	err error
+}
+
+func (e *invalidResultError) Error() string {
+	return "invalid result: " + e.err.Error()
+}
+
+// validateResult validates the result saved into the file at path against
+// the project schema.
+func validateResult(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = manager.DecodeProject(f)
+	return err
+}
+
+// heartbeat extends the lease of a task.
+func (co *coordinator) heartbeat(id, token string) error {
+	co.mu.Lock()
+	defer co.mu.Unlock()
+
+	t, err := co.leased(id, token)
+	if err != nil {
+		return err
+	}
+	t.expires = time.Now().Add(co.lease)
+	return nil
+}
+
+// complete saves the result of a task, read from r.
+func (co *coordinator) complete(id, token string, r io.Reader) error {
+	co.mu.Lock()
+	t, err := co.leased(id, token)
+	co.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	// the result is written without holding the lock, hence the lease is
+	// checked again afterwards
+	out := t.ID + ".json"
+	tmp, err := ioutil.TempFile(co.outDir, "."+out+".")
+	if err != nil {
+		log.Debug(err)
+		return errors.New("unable to create the result file")
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = io.Copy(tmp, r)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		log.Debug(err)
+		return errors.New("unable to write the result file")
+	}
+	verr := validateResult(tmp.Name())
+
+	co.mu.Lock()
+	defer co.mu.Unlock()
+
+	if t, err = co.leased(id, token); err != nil {
+		return err
+	}
+	if verr != nil {
+		// the worker does not report this failure, so it is handled here
+		co.retry(t, "invalid result: "+verr.Error())
+		if err = co.save(); err != nil {
+			log.Fail(err)
+		}
+		return &invalidResultError{verr}
+	}
+	if err = os.Rename(tmp.Name(), filepath.Join(co.outDir, out)); err != nil {
+		log.Debug(err)
+		return errors.New("unable to write the result file")
+	}
+	os.Chmod(filepath.Join(co.outDir, out), 0644)
+
+	t.State, t.Output, t.lease = jobDone, out, ""
+	log.Success(fmt.Sprintf("task %s (%s) done by %s", t.ID, t.Project, t.Worker))
+	return co.save()
+}
+
+// fail records the failure of a task.
+func (co *coordinator) fail(id, token, reason string) error {
+	co.mu.Lock()
+	defer co.mu.Unlock()
+
+	t, err := co.leased(id, token)
+	if err != nil {
+		return err
+	}
+	co.retry(t, reason)
+	return co.save()
+}
+
+// expireLeases handles the tasks whose lease expired as failures.
+func (co *coordinator) expireLeases(now time.Time) {
+	co.mu.Lock()
+	defer co.mu.Unlock()
+
+	expired := false
+	for _, t := range co.tasks {
+		if t.State == jobRunning && now.After(t.expires) {
+			co.retry(t, "lease expired")
+			expired = true
+		}
+	}
+
+	if expired {
+		if err := co.save(); err != nil {
+			log.Fail(err)
+		}
+	}
+}
+
+// retry queues a failed task again, unless it failed too many times. The
+// caller must hold the lock.
+func (co *coordinator) retry(t *task, reason string) {
+	t.Error, t.lease = reason, ""
+
+	if t.Attempts >= co.maxAttempts {
+		t.State = jobFailed
+		log.Fail(fmt.Sprintf("task %s (%s) failed after %d attempt(s): %s", t.ID, t.Project, t.Attempts, reason))
+		return
+	}
+
+	t.State = jobQueued
+	log.Fail(fmt.Sprintf("task %s (%s) failed on %s, retrying: %s", t.ID, t.Project, t.Worker, reason))
+}
+
+// save writes the state of the tasks into the output directory. The caller
+// must hold the lock.
+func (co *coordinator) save() error {
+	bs, err := json.MarshalIndent(co.tasks, "", "  ")
+	if err != nil {
+		log.Debug(err)
+		return errors.New("unable to marshal the coordinator state")
+	}
+
+	path := filepath.Join(co.outDir, coordinatorStateFile)
+	if err = ioutil.WriteFile(path+".tmp", bs, 0644); err == nil {
+		err = os.Rename(path+".tmp", path)
+	}
+	if err != nil {
+		log.Debug(err)
+		return errors.New("unable to save the coordinator state")
+	}
+	return nil
+}
+
+// status returns the number of tasks in each state and a copy of the tasks.
+func (co *coordinator) status() map[string]interface{} {
+	co.mu.Lock()
+	defer co.mu.Unlock()
+
+	counts := make(map[string]int)
+	tasks := make([]task, 0, len(co.tasks))
+	for _, t := range co.tasks {
+		counts[t.State]++
+		tasks = append(tasks, *t)
+	}
+	return map[string]interface{}{"counts": counts, "tasks": tasks}
+}
+
+// newLeaseToken returns a random lease identifier.
+func newLeaseToken() (string, error) {
+	bs := make([]byte, 8)
+	if _, err := rand.Read(bs); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(bs), nil
+}
+
+// handler returns the HTTP handler of the coordinator API:
+//
+//	GET  /lockfile
+//	GET  /status
+//	POST /lease?worker=<name>
+//	POST /tasks/<id>/heartbeat?lease=<lease>
+//	POST /tasks/<id>/fail?lease=<lease>       with the error message as body
+//	PUT  /tasks/<id>/result?lease=<lease>     with the result as body
+//
+// Leasing returns 204 when no task is available for now and 410 once all
+// tasks are finished. Reports on a lost lease return 409.
+func (co *coordinator) handler() http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/lockfile", func(w http.ResponseWriter, r *http.Request) {
+		writeHTTPJSON(w, http.StatusOK, co.lockfile)
+	})
+
+	mux.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+		writeHTTPJSON(w, http.StatusOK, co.status())
+	})
+
+	mux.HandleFunc("/lease", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			writeHTTPError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+
+		l, ok, err := co.next(r.URL.Query().Get("worker"))
+		switch {
+		case err != nil:
+			writeHTTPError(w, http.StatusInternalServerError, err.Error())
+		case ok:
+			writeHTTPJSON(w, http.StatusOK, l)
+		case co.finished():
+			writeHTTPError(w, http.StatusGone, "all tasks are finished")
+		default:
+			w.WriteHeader(http.StatusNoContent)
+		}
+	})
+
+	mux.HandleFunc("/tasks/", func(w http.ResponseWriter, r *http.Request) {
+		parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/tasks/"), "/"), "/")
+		if len(parts) != 2 {
+			writeHTTPError(w, http.StatusNotFound, "not found")
+			return
+		}
+		id, action, token := parts[0], parts[1], r.URL.Query().Get("lease")
+
+		var err error
+		switch {
+		case action == "heartbeat" && r.Method == "POST":
+			err = co.heartbeat(id, token)
+		case action == "fail" && r.Method == "POST":
+			var reason []byte
+			if reason, err = ioutil.ReadAll(io.LimitReader(r.Body, 64<<10)); err == nil {
+				err = co.fail(id, token, string(reason))
+			}
+		case action == "result" && r.Method == "PUT":
+			err = co.complete(id, token, r.Body)
+		default:
+			writeHTTPError(w, http.StatusNotFound, "not found")
+			return
+		}
+
+		_, invalid := err.(*invalidResultError)
+		switch {
+		case err == nil:
+			w.WriteHeader(http.StatusNoContent)
+		case err == errTaskNotFound:
+			writeHTTPError(w, http.StatusNotFound, err.Error())
+		case err == errLeaseLost:
+			writeHTTPError(w, http.StatusConflict, err.Error())
+		case invalid:
+			writeHTTPError(w, http.StatusBadRequest, err.Error())
+		default:
+			writeHTTPError(w, http.StatusInternalServerError, err.Error())
+		}
+	})
+
+	return mux
+}
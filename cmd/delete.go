@@ -5,56 +5,66 @@
 package cmd
 
 import (
-	"errors"
-	"os"
-
 	"github.com/codegangsta/cli"
 
-	"github.com/DevMine/srctool/config"
 	"github.com/DevMine/srctool/log"
+	"github.com/DevMine/srctool/manager"
 )
 
 // Delete command deletes one or all language parser(s).
 func Delete(c *cli.Context) {
+	m, err := lockManager(c, true)
+	if err != nil {
+		fatal(err)
+	}
+	defer unlockParsers()
+
 	if !c.Args().Present() {
-		deleteAll(c.Bool("dry"))
-	} else {
-		if err := deleteParser(genParserName(c.Args().First()), c.Bool("dry"), true); err != nil {
-			log.Fatal(err)
-		}
+		reportOutcomes(c, deleteAll(m, c.Bool("dry")))
+		return
+	}
+
+	out, err := deleteParser(m, c.Args().First(), c.Bool("dry"))
+	if err != nil {
+		log.Fail(err)
 	}
+	reportOutcomes(c, []parserOutcome{out})
 }
 
-func deleteAll(dryMode bool) {
-	parsers := getInstalledParsers()
-	for _, parser := range parsers {
-		if err := deleteParser(genParserName(parser), dryMode, true); err != nil {
+func deleteAll(m *manager.Manager, dryMode bool) []parserOutcome {
+	parsers, err := m.List()
+	if err != nil {
+		fatal(err)
+	}
+
+	var outs []parserOutcome
+	for _, p := range parsers {
+		out, err := deleteParser(m, p.Name, dryMode)
+		if err != nil {
 			log.Fail(err)
 		}
+		outs = append(outs, out)
 	}
+	return outs
 }
 
-func deleteParser(parserName string, dryMode bool, verbose bool) error {
-	parserPath := config.ParserPath(parserName)
-
-	if _, err := os.Stat(parserPath); os.IsNotExist(err) {
-		log.Debug(err)
-		return errors.New(parserName + " is not installed")
-	}
+func deleteParser(m *manager.Manager, lang string, dryMode bool) (parserOutcome, error) {
+	parserName := manager.ParserName(lang)
 
 	if dryMode {
-		log.Info("parser path:", parserPath)
-		return nil
+		p, err := m.Installed(lang)
+		if err != nil {
+			return failedOutcome(parserName, err), err
+		}
+		log.Info("parser path:", p.Dir)
+		return parserOutcome{Parser: parserName, Status: statusDryRun, Path: p.Dir}, nil
 	}
 
-	log.Debug("removing ", parserPath)
-	if err := os.RemoveAll(parserPath); err != nil {
-		log.Debug(err)
-		return errors.New("failed to remove " + parserName)
+	version := parserVersion(m, lang)
+	if err := m.Remove(lang); err != nil {
+		return failedOutcome(parserName, err), err
 	}
 
-	if verbose {
-		log.Success(parserName, " successfully removed")
-	}
-	return nil
+	log.Success(parserName, " successfully removed")
+	return parserOutcome{Parser: parserName, Status: statusDeleted, Version: version}, nil
 }
@@ -0,0 +1,30 @@
+// Copyright 2014-2015 The DevMine authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cmd
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+
+	"github.com/DevMine/srctool/log"
+	"github.com/DevMine/srctool/manager"
+)
+
+// saveDiagnostics writes the collected diagnostics in JSON into the file at
+// path.
+func saveDiagnostics(path string, diags *manager.Diagnostics) error {
+	bs, err := json.MarshalIndent(diags.Sorted(), "", "    ")
+	if err != nil {
+		log.Debug(err)
+		return errors.New("unable to marshal the diagnostics")
+	}
+
+	if err = ioutil.WriteFile(path, bs, 0644); err != nil {
+		log.Debug(err)
+		return errors.New("unable to write the diagnostics file")
+	}
+	return nil
+}
@@ -0,0 +1,274 @@
+// Copyright 2014-2015 The DevMine authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"github.com/DevMine/srcanlzr/src"
+	"github.com/codegangsta/cli"
+
+	"github.com/DevMine/srctool/log"
+)
+
+// Diff command compares two parse results structurally. It reports the
+// packages, files, types, methods and functions that were added, removed or
+// changed between both, along with the evolution of the size metrics.
+// It expects two arguments: the old and the new parse results.
+func Diff(c *cli.Context) {
+	if len(c.Args()) != 2 {
+		fatal("expected 2 arguments, found ", len(c.Args()))
+	}
+
+	oldPrj, err := decodeProjectFile(c.Args().Get(0))
+	if err != nil {
+		fatal(c.Args().Get(0), ": ", err)
+	}
+
+	newPrj, err := decodeProjectFile(c.Args().Get(1))
+	if err != nil {
+		fatal(c.Args().Get(1), ": ", err)
+	}
+
+	d, err := diffProjects(oldPrj, newPrj)
+	if err != nil {
+		fatal(err)
+	}
+
+	if c.Bool("json") || jsonOutput(c) {
+		bs, err := json.MarshalIndent(d, "", "  ")
+		if err != nil {
+			log.Debug(err)
+			fatal("unable to marshal the diff")
+		}
+		fmt.Println(string(bs))
+		return
+	}
+
+	d.print()
+}
+
+// Change statuses.
+const (
+	statusAdded   = "added"
+	statusRemoved = "removed"
+	statusChanged = "changed"
+)
+
+// change is an entity that differs between two projects.
+type change struct {
+	Kind   string `json:"kind"` // package, file, type, method or function
+	Name   string `json:"name"`
+	Status string `json:"status"`
+	OldLoC int64  `json:"old_loc"`
+	NewLoC int64  `json:"new_loc"`
+}
+
+// metricDiff is the evolution of a size metric.
+type metricDiff struct {
+	Name  string `json:"name"`
+	Old   int64  `json:"old"`
+	New   int64  `json:"new"`
+	Delta int64  `json:"delta"`
+}
+
+// projectDiff is the structural difference between two projects.
+type projectDiff struct {
+	Old     string       `json:"old"`
+	New     string       `json:"new"`
+	Metrics []metricDiff `json:"metrics"`
+	Changes []change     `json:"changes"`
+}
+
+// entityKinds is the order in which changes are reported.
+var entityKinds = []string{"package", "file", "type", "method", "function"}
+
+// snapshot is the state of an entity in a project.
+type snapshot struct {
+	kind  string
+	loc   int64
+	stmts int
+}
+
+type byEntity []change
+
+func (cs byEntity) Len() int      { return len(cs) }
+func (cs byEntity) Swap(i, j int) { cs[i], cs[j] = cs[j], cs[i] }
+func (cs byEntity) Less(i, j int) bool {
+	if cs[i].Kind != cs[j].Kind {
+		return kindRank(cs[i].Kind) < kindRank(cs[j].Kind)
+	}
+	return cs[i].Name < cs[j].Name
+}
+
+func kindRank(kind string) int {
+	for i, k := range entityKinds {
+		if k == kind {
+			return i
+		}
+	}
+	return len(entityKinds)
+}
+
+// diffProjects computes the structural difference between two projects.
+func diffProjects(oldPrj, newPrj *src.Project) (*projectDiff, error) {
+	oldEnts, err := projectEntities(oldPrj)
+	if err != nil {
+		return nil, err
+	}
+
+	newEnts, err := projectEntities(newPrj)
+	if err != nil {
+		return nil, err
+	}
+
+	d := &projectDiff{Old: oldPrj.Name, New: newPrj.Name}
+
+	for name, o := range oldEnts {
+		n, ok := newEnts[name]
+		if !ok {
+			d.Changes = append(d.Changes, change{Kind: o.kind, Name: name, Status: statusRemoved, OldLoC: o.loc})
+			continue
+		}
+		if o.loc != n.loc || o.stmts != n.stmts {
+			d.Changes = append(d.Changes, change{Kind: o.kind, Name: name, Status: statusChanged, OldLoC: o.loc, NewLoC: n.loc})
+		}
+	}
+
+	for name, n := range newEnts {
+		if _, ok := oldEnts[name]; !ok {
+			d.Changes = append(d.Changes, change{Kind: n.kind, Name: name, Status: statusAdded, NewLoC: n.loc})
+		}
+	}
+	sort.Sort(byEntity(d.Changes))
+
+	oldStats, err := computeStats(oldPrj)
+	if err != nil {
+		return nil, err
+	}
+
+	newStats, err := computeStats(newPrj)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, m := range []struct {
+		name     string
+		old, new int64
+	}{
+		{"packages", int64(oldStats.Packages), int64(newStats.Packages)},
+		{"files", int64(oldStats.Files), int64(newStats.Files)},
+		{"loc", oldStats.LoC, newStats.LoC},
+		{"functions", int64(oldStats.Functions), int64(newStats.Functions)},
+		{"methods", int64(oldStats.Methods), int64(newStats.Methods)},
+		{"types", int64(oldStats.Types), int64(newStats.Types)},
+	} {
+		d.Metrics = append(d.Metrics, metricDiff{Name: m.name, Old: m.old, New: m.new, Delta: m.new - m.old})
+	}
+
+	return d, nil
+}
+
+// projectEntities returns the packages, files, types, methods and functions
+// of a project, indexed by qualified name.
+func projectEntities(prj *src.Project) (map[string]snapshot, error) {
+	ents := make(map[string]snapshot)
+
+	add := func(name string, s snapshot) {
+		// Declarations whose name and signature are the same, or whose
+		// signature is unknown, are numbered.
+		key := name
+		for i := 2; ; i++ {
+			if _, ok := ents[key]; !ok {
+				break
+			}
+			key = fmt.Sprintf("%s#%d", name, i)
+		}
+		ents[key] = s
+	}
+
+	// names returns the names of declarations, qualified by prefix. The
+	// overloaded functions and methods, sharing the same name, are told
+	// apart by the types of their parameters.
+	names := func(prefix string, ds []decl) []string {
+		count := make(map[string]int)
+		for _, d := range ds {
+			count[d.name]++
+		}
+
+		names := make([]string, len(ds))
+		for i, d := range ds {
+			names[i] = prefix + d.name
+			if count[d.name] > 1 {
+				names[i] += declSignature(d)
+			}
+		}
+		return names
+	}
+
+	for _, pkg := range prj.Packages {
+		if pkg == nil {
+			continue
+		}
+		add(pkg.Path, snapshot{kind: "package", loc: pkg.LoC})
+
+		for _, sf := range pkg.SourceFiles {
+			if sf == nil {
+				continue
+			}
+			add(sf.Path, snapshot{kind: "file", loc: sf.LoC})
+
+			funcs, types, err := fileDecls(sf)
+			if err != nil {
+				return nil, fmt.Errorf("unable to read the declarations of %s: %v", sf.Path, err)
+			}
+
+			for i, name := range names(sf.Path+":", funcs) {
+				add(name, snapshot{kind: "function", loc: funcs[i].loc, stmts: countStatements(funcs[i].node)})
+			}
+
+			for _, t := range types {
+				add(sf.Path+":"+t.name, snapshot{kind: "type", loc: t.loc, stmts: countStatements(t.node)})
+				for i, name := range names(sf.Path+":"+t.name+".", t.methods) {
+					m := t.methods[i]
+					add(name, snapshot{kind: "method", loc: m.loc, stmts: countStatements(m.node)})
+				}
+			}
+		}
+	}
+
+	return ents, nil
+}
+
+// print prints the difference in a human readable form to stdout.
+func (d *projectDiff) print() {
+	fmt.Println("metrics:")
+	for _, m := range d.Metrics {
+		fmt.Printf("  %-10s %8d -> %-8d (%+d)\n", m.Name, m.Old, m.New, m.Delta)
+	}
+
+	kind := ""
+	for _, c := range d.Changes {
+		if c.Kind != kind {
+			kind = c.Kind
+			fmt.Printf("%ss:\n", kind)
+		}
+
+		switch c.Status {
+		case statusAdded:
+			fmt.Printf("  + %s\n", c.Name)
+		case statusRemoved:
+			fmt.Printf("  - %s\n", c.Name)
+		default:
+			fmt.Printf("  ~ %s (loc %d -> %d)\n", c.Name, c.OldLoC, c.NewLoC)
+		}
+	}
+
+	if len(d.Changes) == 0 {
+		fmt.Println("no structural change")
+	}
+}
@@ -2,5 +2,6 @@
 // Use of this source code is governed by a BSD-style
 // license that can be found in the LICENSE file.
 
-// Package cmd provides exported functions for each CLI command.
+// Package cmd provides exported functions for each CLI command. Parsers are
+// managed and run through the manager package.
 package cmd
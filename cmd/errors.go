@@ -0,0 +1,142 @@
+// Copyright 2014-2015 The DevMine authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cmd
+
+import (
+	"context"
+	"os"
+
+	"github.com/DevMine/srctool/log"
+	"github.com/DevMine/srctool/manager"
+)
+
+// errorKind is the kind of a command error. Each kind has its own exit code,
+// documented in the README, so that scripts can tell the errors worth a retry
+// from the ones requiring a fix of their input.
+type errorKind int
+
+// Error kinds. The values are the exit codes and must not change.
+const (
+	errOther     errorKind = 1 // any other error
+	errConfig    errorKind = 2 // missing or malformed configuration
+	errNotFound  errorKind = 3 // parser, project or file not found
+	errNetwork   errorKind = 4 // download server unreachable or failing
+	errIntegrity errorKind = 5 // checksum mismatch or invalid data
+	errParser    errorKind = 6 // a parser crashed or produced no output
+	errTimeout   errorKind = 7 // an operation timed out
+)
+
+// String returns the name of the kind, used as error code for the errors
+// having none.
+func (k errorKind) String() string {
+	switch k {
+	case errConfig:
+		return "config"
+	case errNotFound:
+		return "not_found"
+	case errNetwork:
+		return "network"
+	case errIntegrity:
+		return "integrity"
+	case errParser:
+		return "parser"
+	case errTimeout:
+		return "timeout"
+	}
+	return "error"
+}
+
+// cmdError is an error of a command along with its kind.
+type cmdError struct {
+	kind errorKind
+	err  error
+}
+
+func (e *cmdError) Error() string {
+	return e.err.Error()
+}
+
+// Code returns the code of the underlying error or, if it has none, the name
+// of the kind.
+func (e *cmdError) Code() string {
+	if c, ok := e.err.(interface {
+		Code() string
+	}); ok {
+		return c.Code()
+	}
+	return e.kind.String()
+}
+
+// ExitCode returns the exit code of the kind of the error.
+func (e *cmdError) ExitCode() int {
+	return int(e.kind)
+}
+
+// configError marks err as a configuration error.
+func configError(err error) error {
+	return &cmdError{kind: errConfig, err: err}
+}
+
+// classify returns err along with its kind.
+func classify(err error) *cmdError {
+	if ce, ok := err.(*cmdError); ok {
+		return ce
+	}
+	return &cmdError{kind: kindOf(err), err: err}
+}
+
+// kindOf returns the kind of err.
+func kindOf(err error) errorKind {
+	if err == context.DeadlineExceeded || isTimeout(err) {
+		return errTimeout
+	}
+	if err == manager.ErrNoParsers || os.IsNotExist(err) {
+		return errNotFound
+	}
+	if err == manager.ErrNoOutput {
+		return errIntegrity
+	}
+
+	switch e := err.(type) {
+	case *manager.NotInstalledError, *manager.NotAvailableError:
+		return errNotFound
+	case *manager.NetworkError:
+		if isTimeout(e.Err) {
+			return errTimeout
+		}
+		return errNetwork
+	case *manager.ChecksumError, *manager.MetadataError, *manager.OutputError:
+		return errIntegrity
+	case *manager.ParserError:
+		return errParser
+	case *manager.FileError:
+		if os.IsNotExist(e.Err) {
+			return errNotFound
+		}
+	}
+	return errOther
+}
+
+// isTimeout tells whether err is a timeout, as reported by the net package.
+func isTimeout(err error) bool {
+	t, ok := err.(interface {
+		Timeout() bool
+	})
+	return ok && t.Timeout()
+}
+
+// fatal is like log.Fatal, but exits with the exit code of the kind of the
+// first error found in a. The lock of the parsers directory is released
+// first.
+func fatal(a ...interface{}) {
+	unlockParsers()
+
+	for i, v := range a {
+		if err, ok := v.(error); ok {
+			a[i] = classify(err)
+		}
+	}
+	log.Fatal(a...)
+}
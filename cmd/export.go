@@ -0,0 +1,317 @@
+// Copyright 2014-2015 The DevMine authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cmd
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/DevMine/srcanlzr/src"
+	"github.com/codegangsta/cli"
+	_ "github.com/mattn/go-sqlite3" // SQLite driver
+
+	"github.com/DevMine/srctool/log"
+)
+
+// sqliteSchema creates the tables of the SQLite export.
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS runs (
+	id         INTEGER PRIMARY KEY,
+	created_at TEXT NOT NULL,
+	version    TEXT NOT NULL,
+	host       TEXT NOT NULL,
+	tag        TEXT
+);
+
+CREATE TABLE IF NOT EXISTS projects (
+	id     INTEGER PRIMARY KEY,
+	run_id INTEGER NOT NULL REFERENCES runs(id),
+	name   TEXT NOT NULL,
+	source TEXT NOT NULL,
+	loc    INTEGER NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS repositories (
+	id         INTEGER PRIMARY KEY,
+	project_id INTEGER NOT NULL REFERENCES projects(id),
+	name       TEXT,
+	vcs        TEXT,
+	clone_url  TEXT,
+	clone_path TEXT,
+	data       TEXT NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS packages (
+	id         INTEGER PRIMARY KEY,
+	project_id INTEGER NOT NULL REFERENCES projects(id),
+	name       TEXT NOT NULL,
+	path       TEXT NOT NULL,
+	loc        INTEGER NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS files (
+	id         INTEGER PRIMARY KEY,
+	package_id INTEGER NOT NULL REFERENCES packages(id),
+	path       TEXT NOT NULL,
+	language   TEXT NOT NULL,
+	loc        INTEGER NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS types (
+	id      INTEGER PRIMARY KEY,
+	file_id INTEGER NOT NULL REFERENCES files(id),
+	kind    TEXT NOT NULL,
+	name    TEXT NOT NULL,
+	loc     INTEGER NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS functions (
+	id         INTEGER PRIMARY KEY,
+	file_id    INTEGER NOT NULL REFERENCES files(id),
+	name       TEXT NOT NULL,
+	loc        INTEGER NOT NULL,
+	statements INTEGER NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS methods (
+	id         INTEGER PRIMARY KEY,
+	type_id    INTEGER NOT NULL REFERENCES types(id),
+	name       TEXT NOT NULL,
+	loc        INTEGER NOT NULL,
+	statements INTEGER NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS imports (
+	id      INTEGER PRIMARY KEY,
+	file_id INTEGER NOT NULL REFERENCES files(id),
+	path    TEXT NOT NULL
+);
+`
+
+// Export command exports saved parse results into a SQLite database.
+// It expects one or more parse results as arguments, "-" meaning stdin.
+// The projects are flattened into normalized tables. The database is created
+// if it does not exist, otherwise the projects are appended to it. Every
+// export is recorded as a run, to which the exported projects belong.
+func Export(c *cli.Context) {
+	if !c.Args().Present() {
+		fatal("expected at least 1 argument, found 0")
+	}
+
+	dbPath := c.String("sqlite")
+	if len(dbPath) == 0 {
+		fatal("missing --sqlite option")
+	}
+
+	db, err := sql.Open("sqlite3", dbPath)
+	if err != nil {
+		log.Debug(err)
+		fatal("unable to open the database ", dbPath)
+	}
+	defer db.Close()
+
+	// Pragmas are set per connection, hence use a single one.
+	db.SetMaxOpenConns(1)
+
+	if err = initSQLite(db); err != nil {
+		fatal(err)
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		log.Debug(err)
+		fatal("unable to start a transaction")
+	}
+
+	runID, err := insertRun(tx, c.App.Version, c.String("tag"))
+	if err != nil {
+		tx.Rollback()
+		fatal(err)
+	}
+
+	n := 0
+	for _, path := range c.Args() {
+		prjs, err := readProjects(path)
+		if err != nil {
+			tx.Rollback()
+			fatal(path, ": ", err)
+		}
+
+		for _, prj := range prjs {
+			if err = exportProject(tx, runID, path, prj); err != nil {
+				tx.Rollback()
+				fatal(path, ": ", err)
+			}
+			n++
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		log.Debug(err)
+		fatal("unable to commit the export")
+	}
+
+	log.Success(n, " project(s) exported into ", dbPath, " (run ", runID, ")")
+}
+
+// initSQLite enables the foreign keys and creates the tables.
+func initSQLite(db *sql.DB) error {
+	if _, err := db.Exec("PRAGMA foreign_keys = ON"); err != nil {
+		log.Debug(err)
+		return errors.New("unable to enable foreign keys")
+	}
+
+	for _, stmt := range strings.Split(sqliteSchema, ";") {
+		if len(strings.TrimSpace(stmt)) == 0 {
+			continue
+		}
+		if _, err := db.Exec(stmt); err != nil {
+			log.Debug(err)
+			return errors.New("unable to create the database schema")
+		}
+	}
+	return nil
+}
+
+// insertRun records a new export run and returns its id.
+func insertRun(tx *sql.Tx, version, tag string) (int64, error) {
+	host, err := os.Hostname()
+	if err != nil {
+		log.Debug(err)
+		host = "unknown"
+	}
+
+	var tagVal interface{}
+	if len(tag) > 0 {
+		tagVal = tag
+	}
+
+	res, err := tx.Exec("INSERT INTO runs (created_at, version, host, tag) VALUES (?, ?, ?, ?)",
+		time.Now().UTC().Format(time.RFC3339), version, host, tagVal)
+	if err != nil {
+		log.Debug(err)
+		return 0, errors.New("unable to record the run")
+	}
+	return res.LastInsertId()
+}
+
+// exportProject inserts a project and all its entities.
+func exportProject(tx *sql.Tx, runID int64, source string, prj *src.Project) error {
+	prjID, err := insertRow(tx, "INSERT INTO projects (run_id, name, source, loc) VALUES (?, ?, ?, ?)",
+		runID, prj.Name, source, prj.LoC)
+	if err != nil {
+		return err
+	}
+
+	if prj.Repo != nil {
+		if err = exportRepository(tx, prjID, prj); err != nil {
+			return err
+		}
+	}
+
+	for _, pkg := range prj.Packages {
+		if pkg == nil {
+			continue
+		}
+
+		pkgID, err := insertRow(tx, "INSERT INTO packages (project_id, name, path, loc) VALUES (?, ?, ?, ?)",
+			prjID, pkg.Name, pkg.Path, pkg.LoC)
+		if err != nil {
+			return err
+		}
+
+		for _, sf := range pkg.SourceFiles {
+			if sf == nil {
+				continue
+			}
+			if err = exportFile(tx, pkgID, sf); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// exportRepository inserts the repository of a project.
+func exportRepository(tx *sql.Tx, prjID int64, prj *src.Project) error {
+	g, err := toGeneric(prj.Repo)
+	if err != nil {
+		return err
+	}
+	repo, _ := g.(map[string]interface{})
+
+	bs, err := json.Marshal(prj.Repo)
+	if err != nil {
+		return err
+	}
+
+	_, err = insertRow(tx, "INSERT INTO repositories (project_id, name, vcs, clone_url, clone_path, data) VALUES (?, ?, ?, ?, ?, ?)",
+		prjID, stringField(repo, "name"), stringField(repo, "vcs"), stringField(repo, "clone_url"),
+		stringField(repo, "clone_path"), string(bs))
+	return err
+}
+
+// exportFile inserts a source file along with its imports, types, methods
+// and functions.
+func exportFile(tx *sql.Tx, pkgID int64, sf *src.SourceFile) error {
+	fileID, err := insertRow(tx, "INSERT INTO files (package_id, path, language, loc) VALUES (?, ?, ?, ?)",
+		pkgID, sf.Path, fileLanguage(sf), sf.LoC)
+	if err != nil {
+		return err
+	}
+
+	for _, imp := range sf.Imports {
+		if _, err = insertRow(tx, "INSERT INTO imports (file_id, path) VALUES (?, ?)", fileID, imp); err != nil {
+			return err
+		}
+	}
+
+	funcs, types, err := fileDecls(sf)
+	if err != nil {
+		return fmt.Errorf("unable to read the declarations of %s: %v", sf.Path, err)
+	}
+
+	for _, f := range funcs {
+		_, err = insertRow(tx, "INSERT INTO functions (file_id, name, loc, statements) VALUES (?, ?, ?, ?)",
+			fileID, f.name, f.loc, countStatements(f.node))
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, t := range types {
+		typeID, err := insertRow(tx, "INSERT INTO types (file_id, kind, name, loc) VALUES (?, ?, ?, ?)",
+			fileID, t.kind, t.name, t.loc)
+		if err != nil {
+			return err
+		}
+
+		for _, m := range t.methods {
+			_, err = insertRow(tx, "INSERT INTO methods (type_id, name, loc, statements) VALUES (?, ?, ?, ?)",
+				typeID, m.name, m.loc, countStatements(m.node))
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// insertRow executes an INSERT statement and returns the id of the new row.
+func insertRow(tx *sql.Tx, query string, args ...interface{}) (int64, error) {
+	res, err := tx.Exec(query, args...)
+	if err != nil {
+		log.Debug(query, ": ", err)
+		return 0, errors.New("unable to insert into the database")
+	}
+	return res.LastInsertId()
+}
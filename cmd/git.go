@@ -0,0 +1,50 @@
+// Copyright 2014-2015 The DevMine authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cmd
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"strings"
+
+	"github.com/DevMine/srctool/log"
+)
+
+// git runs a git command into the repository dir and returns its output.
+func git(dir string, args ...string) (string, error) {
+	outBuf := new(bytes.Buffer)
+	errBuf := new(bytes.Buffer)
+
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	cmd.Stdout = outBuf
+	cmd.Stderr = errBuf
+
+	log.Debug("command: ", strings.Join(cmd.Args, " "))
+
+	if err := cmd.Run(); err != nil {
+		log.Debug(err, ": ", strings.TrimSpace(errBuf.String()))
+		return "", fmt.Errorf("git %s failed: %s", args[0], strings.TrimSpace(errBuf.String()))
+	}
+	return outBuf.String(), nil
+}
+
+// gitLines runs a git command into the repository dir and returns the
+// non-empty lines of its output.
+func gitLines(dir string, args ...string) ([]string, error) {
+	out, err := git(dir, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	var lines []string
+	for _, line := range strings.Split(out, "\n") {
+		if line = strings.TrimSpace(line); len(line) > 0 {
+			lines = append(lines, line)
+		}
+	}
+	return lines, nil
+}
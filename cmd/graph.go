@@ -0,0 +1,495 @@
+// Copyright 2014-2015 The DevMine authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cmd
+
+import (
+	"bufio"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/DevMine/srcanlzr/src"
+	"github.com/codegangsta/cli"
+
+	"github.com/DevMine/srctool/log"
+)
+
+// Graph kinds.
+const (
+	graphImports = "imports" // files importing packages
+	graphCalls   = "calls"   // functions calling functions
+	graphTypes   = "types"   // types extending or implementing types
+)
+
+// Graph output formats.
+const (
+	graphDOT     = "dot"
+	graphGraphML = "graphml"
+	graphJSON    = "json"
+)
+
+// callExprName is the expression name of function calls in the srcanlzr AST.
+const callExprName = "CALL"
+
+// Graph command exports a graph extracted from a saved parse result.
+// It expects one argument: the parse result. The "kind" option selects the
+// graph (imports, calls or types) and the "format" option the output format
+// (dot, graphml or json). The "collapse" option collapses the nodes to the
+// package level and the "prefix" option keeps only the nodes defined in files
+// whose path starts with the given prefix.
+func Graph(c *cli.Context) {
+	if len(c.Args()) != 1 {
+		fatal("expected 1 argument, found ", len(c.Args()))
+	}
+
+	kind, format := c.String("kind"), c.String("format")
+	switch format {
+	case graphDOT, graphGraphML, graphJSON:
+	default:
+		fatal("unknown graph format '", format, "', expected dot, graphml or json")
+	}
+
+	prj, err := decodeProjectFile(c.Args().First())
+	if err != nil {
+		fatal(err)
+	}
+
+	opts := graphOptions{collapse: c.Bool("collapse"), prefix: c.String("prefix")}
+
+	var g *graph
+	switch kind {
+	case graphImports:
+		g, err = importGraph(prj, opts)
+	case graphCalls:
+		g, err = callGraph(prj, opts)
+	case graphTypes:
+		g, err = typeGraph(prj, opts)
+	default:
+		fatal("unknown graph kind '", kind, "', expected imports, calls or types")
+	}
+	if err != nil {
+		fatal(err)
+	}
+
+	w := bufio.NewWriter(os.Stdout)
+	switch format {
+	case graphDOT:
+		err = g.writeDOT(w)
+	case graphGraphML:
+		err = g.writeGraphML(w)
+	case graphJSON:
+		err = g.writeJSON(w)
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if err != nil {
+		log.Debug(err)
+		fatal("unable to write the graph")
+	}
+}
+
+// graphOptions holds the options of the graph extraction.
+type graphOptions struct {
+	collapse bool   // collapse the nodes to the package level
+	prefix   string // keep only the nodes of the files with this path prefix
+}
+
+// keep tells whether the entities of a source file belong to the graph.
+func (opts graphOptions) keep(sf *src.SourceFile) bool {
+	return strings.HasPrefix(sf.Path, opts.prefix)
+}
+
+// graphNode is a node of a graph.
+type graphNode struct {
+	ID   string `json:"id"`
+	Kind string `json:"kind"`
+}
+
+// graphEdge is a weighted edge of a graph.
+type graphEdge struct {
+	From   string `json:"from"`
+	To     string `json:"to"`
+	Weight int    `json:"weight"`
+}
+
+// graph is a directed graph.
+type graph struct {
+	kind  string
+	nodes map[string]string // node id -> node kind
+	edges map[[2]string]int // (from, to) -> weight
+}
+
+func newGraph(kind string) *graph {
+	return &graph{
+		kind:  kind,
+		nodes: make(map[string]string),
+		edges: make(map[[2]string]int),
+	}
+}
+
+// addNode adds a node, unless it already exists.
+func (g *graph) addNode(id, kind string) {
+	if _, ok := g.nodes[id]; !ok {
+		g.nodes[id] = kind
+	}
+}
+
+// addEdge adds an edge, or increments its weight if it already exists.
+// Self loops are ignored.
+func (g *graph) addEdge(from, to string) {
+	if from != to {
+		g.edges[[2]string{from, to}]++
+	}
+}
+
+// sortedNodes returns the nodes sorted by id.
+func (g *graph) sortedNodes() []graphNode {
+	nodes := make([]graphNode, 0, len(g.nodes))
+	for id, kind := range g.nodes {
+		nodes = append(nodes, graphNode{ID: id, Kind: kind})
+	}
+	sort.Sort(byNodeID(nodes))
+	return nodes
+}
+
+// sortedEdges returns the edges sorted by source and destination.
+func (g *graph) sortedEdges() []graphEdge {
+	edges := make([]graphEdge, 0, len(g.edges))
+	for e, w := range g.edges {
+		edges = append(edges, graphEdge{From: e[0], To: e[1], Weight: w})
+	}
+	sort.Sort(byEndpoints(edges))
+	return edges
+}
+
+type byNodeID []graphNode
+
+func (ns byNodeID) Len() int           { return len(ns) }
+func (ns byNodeID) Swap(i, j int)      { ns[i], ns[j] = ns[j], ns[i] }
+func (ns byNodeID) Less(i, j int) bool { return ns[i].ID < ns[j].ID }
+
+type byEndpoints []graphEdge
+
+func (es byEndpoints) Len() int      { return len(es) }
+func (es byEndpoints) Swap(i, j int) { es[i], es[j] = es[j], es[i] }
+func (es byEndpoints) Less(i, j int) bool {
+	if es[i].From != es[j].From {
+		return es[i].From < es[j].From
+	}
+	return es[i].To < es[j].To
+}
+
+// importGraph builds the graph of the imports of the files (or packages) of a
+// project.
+func importGraph(prj *src.Project, opts graphOptions) (*graph, error) {
+	g := newGraph(graphImports)
+
+	for _, pkg := range prj.Packages {
+		if pkg == nil {
+			continue
+		}
+		for _, sf := range pkg.SourceFiles {
+			if sf == nil || !opts.keep(sf) {
+				continue
+			}
+
+			from, kind := sf.Path, "file"
+			if opts.collapse {
+				from, kind = pkg.Path, "package"
+			}
+			g.addNode(from, kind)
+
+			for _, imp := range sf.Imports {
+				g.addNode(imp, "import")
+				g.addEdge(from, imp)
+			}
+		}
+	}
+
+	return g, nil
+}
+
+// callGraph builds the graph of the calls between the functions and methods
+// (or packages) of a project. Callees are matched to the functions and
+// methods of the project by name; calls that cannot be resolved point to
+// external nodes.
+func callGraph(prj *src.Project, opts graphOptions) (*graph, error) {
+	g := newGraph(graphCalls)
+
+	type caller struct {
+		id, pkg string
+		node    map[string]interface{}
+	}
+	var callers []caller
+
+	// functions and methods of the project, by name
+	byName := make(map[string][]caller)
+
+	for _, pkg := range prj.Packages {
+		if pkg == nil {
+			continue
+		}
+		for _, sf := range pkg.SourceFiles {
+			if sf == nil {
+				continue
+			}
+
+			funcs, types, err := fileDecls(sf)
+			if err != nil {
+				return nil, fmt.Errorf("unable to read the declarations of %s: %v", sf.Path, err)
+			}
+
+			var fs []caller
+			for _, f := range funcs {
+				fs = append(fs, caller{id: sf.Path + ":" + f.name, pkg: pkg.Path, node: f.node})
+				byName[f.name] = append(byName[f.name], fs[len(fs)-1])
+			}
+			for _, t := range types {
+				for _, m := range t.methods {
+					fs = append(fs, caller{id: sf.Path + ":" + t.name + "." + m.name, pkg: pkg.Path, node: m.node})
+					byName[m.name] = append(byName[m.name], fs[len(fs)-1])
+				}
+			}
+
+			if opts.keep(sf) {
+				callers = append(callers, fs...)
+			}
+		}
+	}
+
+	for _, c := range callers {
+		from, kind := c.id, "function"
+		if opts.collapse {
+			from, kind = c.pkg, "package"
+		}
+		g.addNode(from, kind)
+
+		for _, name := range callees(c.node) {
+			short := name
+			if i := strings.LastIndex(name, "."); i >= 0 {
+				short = name[i+1:]
+			}
+
+			to, toKind := name, "external"
+			if targets := byName[short]; len(targets) == 1 {
+				to, toKind = targets[0].id, "function"
+				if opts.collapse {
+					to, toKind = targets[0].pkg, "package"
+				}
+			}
+
+			g.addNode(to, toKind)
+			g.addEdge(from, to)
+		}
+	}
+
+	return g, nil
+}
+
+// callees returns the names of the functions called in v, the generic JSON
+// representation of a piece of AST.
+func callees(v interface{}) []string {
+	var names []string
+	switch v := v.(type) {
+	case map[string]interface{}:
+		if stringField(v, "expression_name") == callExprName {
+			switch fun := v["function"].(type) {
+			case string:
+				names = append(names, fun)
+			case map[string]interface{}:
+				name := stringField(fun, "name")
+				if ns := stringField(fun, "namespace"); len(ns) > 0 {
+					name = ns + "." + name
+				}
+				if len(name) > 0 {
+					names = append(names, name)
+				}
+			}
+		}
+		for _, e := range v {
+			names = append(names, callees(e)...)
+		}
+	case []interface{}:
+		for _, e := range v {
+			names = append(names, callees(e)...)
+		}
+	}
+	return names
+}
+
+// superTypeFields are the fields of a type declaration referencing the types
+// it extends or implements.
+var superTypeFields = []string{"extended_classes", "implemented_interfaces", "extended_interfaces", "traits_used"}
+
+// typeGraph builds the graph of the types (or packages) of a project, with
+// edges from each type to the types it extends or implements.
+func typeGraph(prj *src.Project, opts graphOptions) (*graph, error) {
+	g := newGraph(graphTypes)
+
+	type typeDef struct {
+		id, pkg string
+		node    map[string]interface{}
+	}
+	var defs []typeDef
+	byName := make(map[string][]typeDef)
+
+	for _, pkg := range prj.Packages {
+		if pkg == nil {
+			continue
+		}
+		for _, sf := range pkg.SourceFiles {
+			if sf == nil {
+				continue
+			}
+
+			_, types, err := fileDecls(sf)
+			if err != nil {
+				return nil, fmt.Errorf("unable to read the declarations of %s: %v", sf.Path, err)
+			}
+
+			for _, t := range types {
+				td := typeDef{id: sf.Path + ":" + t.name, pkg: pkg.Path, node: t.node}
+				byName[t.name] = append(byName[t.name], td)
+				if opts.keep(sf) {
+					defs = append(defs, td)
+				}
+			}
+		}
+	}
+
+	for _, td := range defs {
+		from, kind := td.id, "type"
+		if opts.collapse {
+			from, kind = td.pkg, "package"
+		}
+		g.addNode(from, kind)
+
+		for _, field := range superTypeFields {
+			refs, _ := td.node[field].([]interface{})
+			for _, ref := range refs {
+				var name string
+				switch ref := ref.(type) {
+				case string:
+					name = ref
+				case map[string]interface{}:
+					name = stringField(ref, "name")
+				}
+				if len(name) == 0 {
+					continue
+				}
+
+				to, toKind := name, "external"
+				if targets := byName[name]; len(targets) == 1 {
+					to, toKind = targets[0].id, "type"
+					if opts.collapse {
+						to, toKind = targets[0].pkg, "package"
+					}
+				}
+
+				g.addNode(to, toKind)
+				g.addEdge(from, to)
+			}
+		}
+	}
+
+	return g, nil
+}
+
+// writeDOT writes the graph in the Graphviz DOT language.
+func (g *graph) writeDOT(w io.Writer) error {
+	fmt.Fprintf(w, "digraph %s {\n", g.kind)
+	for _, n := range g.sortedNodes() {
+		fmt.Fprintf(w, "\t%s [label=%s, kind=%s];\n", strconv.Quote(n.ID), strconv.Quote(filepath.Base(n.ID)), strconv.Quote(n.Kind))
+	}
+	for _, e := range g.sortedEdges() {
+		fmt.Fprintf(w, "\t%s -> %s [weight=%d];\n", strconv.Quote(e.From), strconv.Quote(e.To), e.Weight)
+	}
+	_, err := fmt.Fprintln(w, "}")
+	return err
+}
+
+// writeGraphML writes the graph in GraphML.
+func (g *graph) writeGraphML(w io.Writer) error {
+	type data struct {
+		Key   string `xml:"key,attr"`
+		Value string `xml:",chardata"`
+	}
+	type node struct {
+		ID   string `xml:"id,attr"`
+		Data []data `xml:"data"`
+	}
+	type edge struct {
+		Source string `xml:"source,attr"`
+		Target string `xml:"target,attr"`
+		Data   []data `xml:"data"`
+	}
+	type key struct {
+		ID   string `xml:"id,attr"`
+		For  string `xml:"for,attr"`
+		Name string `xml:"attr.name,attr"`
+		Type string `xml:"attr.type,attr"`
+	}
+	type graphML struct {
+		XMLName xml.Name `xml:"graphml"`
+		XMLNS   string   `xml:"xmlns,attr"`
+		Keys    []key    `xml:"key"`
+		Graph   struct {
+			ID          string `xml:"id,attr"`
+			EdgeDefault string `xml:"edgedefault,attr"`
+			Nodes       []node `xml:"node"`
+			Edges       []edge `xml:"edge"`
+		} `xml:"graph"`
+	}
+
+	doc := graphML{
+		XMLNS: "http://graphml.graphdrawing.org/xmlns",
+		Keys: []key{
+			{ID: "kind", For: "node", Name: "kind", Type: "string"},
+			{ID: "weight", For: "edge", Name: "weight", Type: "int"},
+		},
+	}
+	doc.Graph.ID = g.kind
+	doc.Graph.EdgeDefault = "directed"
+
+	for _, n := range g.sortedNodes() {
+		doc.Graph.Nodes = append(doc.Graph.Nodes, node{ID: n.ID, Data: []data{{"kind", n.Kind}}})
+	}
+	for _, e := range g.sortedEdges() {
+		doc.Graph.Edges = append(doc.Graph.Edges, edge{Source: e.From, Target: e.To, Data: []data{{"weight", strconv.Itoa(e.Weight)}}})
+	}
+
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	if err := enc.Encode(doc); err != nil {
+		return err
+	}
+	_, err := fmt.Fprintln(w)
+	return err
+}
+
+// writeJSON writes the graph in JSON.
+func (g *graph) writeJSON(w io.Writer) error {
+	bs, err := json.MarshalIndent(struct {
+		Kind  string      `json:"kind"`
+		Nodes []graphNode `json:"nodes"`
+		Edges []graphEdge `json:"edges"`
+	}{g.kind, g.sortedNodes(), g.sortedEdges()}, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintln(w, string(bs))
+	return err
+}
@@ -0,0 +1,332 @@
+// Copyright 2014-2015 The DevMine authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/codegangsta/cli"
+
+	"github.com/DevMine/srctool/log"
+	"github.com/DevMine/srctool/manager"
+)
+
+// historyIndexFile is the name of the index file written by the history
+// command.
+const historyIndexFile = "index.json"
+
+// Steps of the history command.
+const (
+	stepTags    = "tags"    // parse the tagged commits only
+	stepCommits = "commits" // parse every commit
+)
+
+// History command parses a range of revisions of a git repository.
+// It expects one argument: the path of the repository. The "range" option
+// is a git revision range (HEAD by default) and the "step" option tells which
+// revisions of the range are parsed: the tagged ones, every commit or every
+// Nth commit. Each revision is checked out into a temporary worktree and
+// parsed, and the results are written into the directory given by the "o"
+// option, along with an index file. Revisions whose tree is identical to the
+// one of an already parsed revision are not parsed again, and the results of
+// the files unchanged since the previously parsed revision are reused.
+// Failures are recorded into the index and do not stop the walk, but make the
+// command exit with the code of the first one.
+func History(c *cli.Context) {
+	if len(c.Args()) != 1 {
+		fatal("expected 1 argument, found ", len(c.Args()))
+	}
+
+	repo, err := filepath.Abs(c.Args().First())
+	if err != nil {
+		fatal(err)
+	}
+
+	outDir := c.String("o")
+	if len(outDir) == 0 {
+		fatal("missing -o option")
+	}
+
+	format := c.String("format")
+	if err = checkFormat(format); err != nil {
+		fatal(err)
+	}
+
+	ms, err := manager.ParseMergeStrategy(c.String("on-conflict"))
+	if err != nil {
+		fatal(err)
+	}
+
+	revs, err := historyRevisions(repo, c.String("range"), c.String("step"))
+	if err != nil {
+		fatal(err)
+	}
+	if len(revs) == 0 {
+		fatal("no revision to parse")
+	}
+
+	if err = os.MkdirAll(outDir, 0755); err != nil {
+		log.Debug(err)
+		fatal("unable to create the output directory ", outDir)
+	}
+
+	m, err := lockManager(c, false)
+	if err != nil {
+		fatal(err)
+	}
+	defer unlockParsers()
+
+	opts := manager.ParseOptions{Strategy: ms, Cache: manager.NewParseCache()}
+	failures, err := walkHistory(m, repo, revs, outDir, format, opts)
+	if err != nil {
+		fatal(err)
+	}
+
+	if err = writeHistoryIndex(filepath.Join(outDir, historyIndexFile), revs); err != nil {
+		fatal(err)
+	}
+
+	if len(failures) > 0 {
+		fatal(&cmdError{
+			kind: classify(failures[0]).kind,
+			err:  fmt.Errorf("%d revision(s) out of %d failed", len(failures), len(revs)),
+		})
+	}
+	log.Success(len(revs), " revision(s) parsed")
+}
+
+// walkHistory parses revs into outDir, in a temporary worktree of repo removed
+// before returning, and records the outcome of each revision. It returns the
+// errors of the failed revisions.
+func walkHistory(m *manager.Manager, repo string, revs []revision, outDir, format string, opts manager.ParseOptions) ([]error, error) {
+	wt, err := addWorktree(repo, revs[0].Commit)
+	if err != nil {
+		return nil, err
+	}
+	defer removeWorktree(repo, wt)
+
+	opts.Servers = manager.NewServerPool("")
+	defer opts.Servers.Close()
+
+	parsed := make(map[string]string) // tree -> output file
+
+	var failures []error
+	for i := range revs {
+		rev := &revs[i]
+		log.Info(fmt.Sprintf("[%d/%d] parsing %s", i+1, len(revs), rev.name()))
+
+		if out, ok := parsed[rev.Tree]; ok {
+			rev.Output, rev.Cached = out, true
+			log.Info("tree unchanged, reusing ", out)
+			continue
+		}
+
+		out := fmt.Sprintf("%04d-%s%s", i+1, rev.Commit[:12], formatExt(format))
+		if err := parseRevision(m, wt, *rev, filepath.Join(outDir, out), format, opts); err != nil {
+			log.Fail(rev.name(), ": ", err)
+			rev.Error = err.Error()
+			failures = append(failures, err)
+			continue
+		}
+
+		rev.Output = out
+		parsed[rev.Tree] = out
+	}
+	return failures, nil
+}
+
+// revision is a revision of a git repository, as recorded in the index.
+type revision struct {
+	Commit string `json:"commit"`
+	Tree   string `json:"tree"`
+	Tag    string `json:"tag,omitempty"`
+	Date   string `json:"date"`
+	Output string `json:"output,omitempty"`
+	Cached bool   `json:"cached,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// name returns the tag of the revision if any, its commit otherwise.
+func (rev revision) name() string {
+	if len(rev.Tag) > 0 {
+		return rev.Tag
+	}
+	return rev.Commit[:12]
+}
+
+// historyRevisions returns the revisions of the range selected by step, from
+// the oldest to the newest. The lower bound of a range of the form "A..B" is
+// included.
+func historyRevisions(repo, rng, step string) ([]revision, error) {
+	if len(rng) == 0 {
+		rng = "HEAD"
+	}
+
+	args := []string{"rev-list", "--reverse", "--topo-order", "--format=%T %cI", rng}
+	if i := strings.Index(rng, ".."); i > 0 && !strings.Contains(rng, "...") {
+		args = append(args, "--boundary")
+	}
+
+	lines, err := gitLines(repo, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	// With --format, rev-list prints "commit <sha>" followed by the
+	// formatted line. Boundary commits are prefixed by "-".
+	var revs []revision
+	var boundary []revision
+	for i := 0; i+1 < len(lines); i += 2 {
+		commit := strings.TrimPrefix(lines[i], "commit ")
+		isBoundary := strings.HasPrefix(commit, "-")
+		commit = strings.TrimPrefix(commit, "-")
+
+		fields := strings.Fields(lines[i+1])
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("unexpected git rev-list output: %s", lines[i+1])
+		}
+
+		rev := revision{Commit: commit, Tree: fields[0], Date: fields[1]}
+		if isBoundary {
+			boundary = append(boundary, rev)
+			continue
+		}
+		revs = append(revs, rev)
+	}
+	revs = append(boundary, revs...)
+
+	tags, err := commitTags(repo)
+	if err != nil {
+		return nil, err
+	}
+	for i := range revs {
+		revs[i].Tag = tags[revs[i].Commit]
+	}
+
+	switch step {
+	case stepCommits:
+		return revs, nil
+	case "", stepTags:
+		var tagged []revision
+		for _, rev := range revs {
+			if len(rev.Tag) > 0 {
+				tagged = append(tagged, rev)
+			}
+		}
+		return tagged, nil
+	}
+
+	n, err := strconv.Atoi(step)
+	if err != nil || n <= 0 {
+		return nil, fmt.Errorf("invalid step '%s', expected tags, commits or a positive number", step)
+	}
+
+	var every []revision
+	for i, rev := range revs {
+		if i%n == 0 || i == len(revs)-1 {
+			every = append(every, rev)
+		}
+	}
+	return every, nil
+}
+
+// commitTags returns the tags of a repository, indexed by commit. When a
+// commit has several tags, only the first one is kept.
+func commitTags(repo string) (map[string]string, error) {
+	lines, err := gitLines(repo, "for-each-ref", "--format=%(objectname) %(*objectname) %(refname:short)", "refs/tags")
+	if err != nil {
+		return nil, err
+	}
+
+	tags := make(map[string]string)
+	for _, line := range lines {
+		fields := strings.Fields(line)
+
+		// Annotated tags have the peeled commit as second field.
+		var commit, tag string
+		switch len(fields) {
+		case 2:
+			commit, tag = fields[0], fields[1]
+		case 3:
+			commit, tag = fields[1], fields[2]
+		default:
+			continue
+		}
+
+		if _, ok := tags[commit]; !ok {
+			tags[commit] = tag
+		}
+	}
+	return tags, nil
+}
+
+// addWorktree creates a temporary worktree of the repository, detached at the
+// given commit, and returns its path.
+func addWorktree(repo, commit string) (string, error) {
+	dir, err := ioutil.TempDir("", "srctool-history-")
+	if err != nil {
+		log.Debug(err)
+		return "", errors.New("unable to create a temporary directory")
+	}
+
+	// git refuses to create a worktree into an existing directory
+	wt := filepath.Join(dir, filepath.Base(repo))
+	if _, err = git(repo, "worktree", "add", "--detach", wt, commit); err != nil {
+		os.RemoveAll(dir)
+		return "", err
+	}
+	return wt, nil
+}
+
+// removeWorktree removes a worktree created by addWorktree.
+func removeWorktree(repo, wt string) {
+	if err := os.RemoveAll(filepath.Dir(wt)); err != nil {
+		log.Debug(err)
+	}
+	if _, err := git(repo, "worktree", "prune"); err != nil {
+		log.Debug(err)
+	}
+}
+
+// parseRevision checks out a revision into the worktree wt, parses it and
+// writes the result into the file at out.
+func parseRevision(m *manager.Manager, wt string, rev revision, out, format string, opts manager.ParseOptions) error {
+	if _, err := git(wt, "checkout", "--quiet", "--force", "--detach", rev.Commit); err != nil {
+		return err
+	}
+	if _, err := git(wt, "clean", "--quiet", "--force", "-d", "-x"); err != nil {
+		return err
+	}
+
+	prj, err := m.Parse(context.Background(), wt, opts)
+	if err != nil {
+		return err
+	}
+
+	return writeDocument(out, format, document{Project: prj})
+}
+
+// writeHistoryIndex writes the index of the parsed revisions.
+func writeHistoryIndex(path string, revs []revision) error {
+	bs, err := json.MarshalIndent(revs, "", "  ")
+	if err != nil {
+		log.Debug(err)
+		return errors.New("unable to marshal the history index")
+	}
+
+	if err = ioutil.WriteFile(path, bs, 0644); err != nil {
+		log.Debug(err)
+		return errors.New("unable to write the history index")
+	}
+	return nil
+}
@@ -5,83 +5,83 @@
 package cmd
 
 import (
-	"errors"
-	"io/ioutil"
+	"context"
+	"time"
 
 	"github.com/codegangsta/cli"
 
-	"github.com/DevMine/srctool/config"
 	"github.com/DevMine/srctool/log"
+	"github.com/DevMine/srctool/manager"
 )
 
 // Install command installs one or all language parser(s).
 func Install(c *cli.Context) {
-	cfg, err := config.New()
+	m, err := lockManager(c, true)
 	if err != nil {
-		log.Fatal(err)
-	}
-
-	installedParsers := make(map[string]struct{})
-	for _, parser := range getInstalledParsers() {
-		installedParsers[parser] = struct{}{}
+		fatal(err)
 	}
+	defer unlockParsers()
 
 	if !c.Args().Present() {
-		installAll(cfg, installedParsers)
-	} else {
-		parser := c.Args().First()
-		parserName := genParserName(parser)
-		if _, ok := installedParsers[parser]; !ok {
-			if err := installParser(cfg, parserName, true); err != nil {
-				log.Fatal(err)
-			}
-		} else {
-			log.Info(parserName, " already installed")
-		}
+		reportOutcomes(c, installAll(m))
+		return
 	}
-}
 
-func installAll(cfg *config.Config, installedParsers map[string]struct{}) {
-	parsers := getRemoteParsers(cfg.DownloadServerURL)
-	for _, parser := range parsers {
-		if _, ok := installedParsers[parser]; !ok {
-			if err := installParser(cfg, genParserName(parser), true); err != nil {
-				log.Fail(err)
-			}
-		} else {
-			log.Info(genParserName(parser), " already installed")
-		}
+	out, err := installParser(m, c.Args().First())
+	if err != nil {
+		log.Fail(err)
 	}
+	reportOutcomes(c, []parserOutcome{out})
 }
 
-func installParser(cfg *config.Config, parserName string, verbose bool) error {
-	if err := downloadParser(cfg.DownloadServerURL, parserName, verbose); err != nil {
-		return err
+func installAll(m *manager.Manager) []parserOutcome {
+	parsers, err := m.ListRemote(context.Background())
+	if err != nil {
+		fatal(err)
 	}
 
-	defer func() {
-		if err := deleteParserTarball(parserName); err != nil {
+	var outs []parserOutcome
+	for _, p := range parsers {
+		out, err := installParser(m, p.Name)
+		if err != nil {
 			log.Fail(err)
 		}
-	}()
-
-	if err := uncompressParser(parserName, config.ParsersDir()); err != nil {
-		log.Debug(err)
-		return errors.New("failed to uncompress the " + parserName + " archive")
+		outs = append(outs, out)
 	}
+	return outs
+}
 
-	md5sum, err := checksum(config.TempPath(parserName))
-	if err != nil {
-		return err
+// installParser installs a parser, given by its language or its name, unless
+// it is already installed.
+func installParser(m *manager.Manager, lang string) (parserOutcome, error) {
+	parserName := manager.ParserName(lang)
+
+	start := time.Now()
+	err := m.Install(context.Background(), lang)
+	if _, ok := err.(*manager.AlreadyInstalledError); ok {
+		log.Info(parserName, " already installed")
+		return parserOutcome{Parser: parserName, Status: statusAlreadyInstalled, Version: parserVersion(m, lang)}, nil
+	} else if err != nil {
+		return failedOutcome(parserName, err), err
 	}
 
-	if err := ioutil.WriteFile(config.LocalChecksumPath(parserName), []byte(md5sum), 0644); err != nil {
+	log.Fields{"parser": parserName, "duration": time.Since(start)}.Success(parserName, " successfully installed")
+	return parserOutcome{Parser: parserName, Status: statusInstalled, Version: parserVersion(m, lang)}, nil
+}
+
+// parserVersion returns the version of an installed parser, that is the MD5
+// sum of its archive, or an empty string if unknown.
+func parserVersion(m *manager.Manager, lang string) string {
+	p, err := m.Installed(lang)
+	if err != nil {
 		log.Debug(err)
-		return errors.New("failed to write MD5SUM file in the parser directory")
+		return ""
 	}
 
-	if verbose {
-		log.Success(parserName, " successfully installed")
+	sum, err := p.Checksum()
+	if err != nil {
+		log.Debug(err)
+		return ""
 	}
-	return nil
+	return sum
 }
@@ -0,0 +1,382 @@
+// Copyright 2014-2015 The DevMine authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cmd
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/DevMine/srctool/log"
+	"github.com/DevMine/srctool/manager"
+)
+
+// Job states.
+const (
+	jobQueued  = "queued"
+	jobRunning = "running"
+	jobDone    = "done"
+	jobFailed  = "failed"
+)
+
+// Files of a job directory.
+const (
+	jobFile       = "job.json"
+	jobResultFile = "result.json"
+	jobProjectDir = "project" // where uploaded projects are extracted
+)
+
+// errJobNotFound is returned when a job does not exist.
+var errJobNotFound = errors.New("job not found")
+
+// Job is a parse job of the HTTP server.
+type Job struct {
+	ID    string `json:"id"`
+	State string `json:"state"`
+
+	// Path is the path of the project to parse, for local projects.
+	Path string `json:"path,omitempty"`
+
+	// Upload tells whether the project was uploaded.
+	Upload bool `json:"upload,omitempty"`
+
+	// OnConflict is the merge strategy of the parsers outputs.
+	OnConflict string `json:"on_conflict,omitempty"`
+
+	Error       string `json:"error,omitempty"`
+	Diagnostics int    `json:"diagnostics"`
+
+	Created  string `json:"created"`
+	Started  string `json:"started,omitempty"`
+	Finished string `json:"finished,omitempty"`
+}
+
+// jobStore persists the parse jobs into a directory, one sub-directory per
+// job, and queues the jobs waiting to be run. It is safe for concurrent use.
+type jobStore struct {
+	mu     sync.Mutex
+	cond   *sync.Cond
+	dir    string
+	jobs   map[string]*Job
+	queue  []string
+	closed bool
+}
+
+// openJobStore opens the job store located in dir, creating it if needed.
+// Jobs that were running when the store was last closed are queued again.
+func openJobStore(dir string) (*jobStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		log.Debug(err)
+		return nil, fmt.Errorf("unable to create the jobs directory %s", dir)
+	}
+
+	fis, err := ioutil.ReadDir(dir)
+	if err != nil {
+		log.Debug(err)
+		return nil, fmt.Errorf("unable to read the jobs directory %s", dir)
+	}
+
+	js := &jobStore{dir: dir, jobs: make(map[string]*Job)}
+	js.cond = sync.NewCond(&js.mu)
+
+	for _, fi := range fis {
+		if !fi.IsDir() {
+			continue
+		}
+
+		bs, err := ioutil.ReadFile(filepath.Join(dir, fi.Name(), jobFile))
+		if os.IsNotExist(err) {
+			// interrupted upload
+			log.Debug("removing incomplete job ", fi.Name())
+			os.RemoveAll(filepath.Join(dir, fi.Name()))
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+
+		job := new(Job)
+		if err = json.Unmarshal(bs, job); err != nil {
+			log.Debug(err)
+			log.Fail("skipping malformed job ", fi.Name())
+			continue
+		}
+
+		if job.State == jobRunning {
+			log.Info("job ", job.ID, " was interrupted, queuing it again")
+			job.State, job.Started = jobQueued, ""
+			if err = js.save(job); err != nil {
+				return nil, err
+			}
+		}
+		js.jobs[job.ID] = job
+	}
+
+	for _, job := range js.sortedJobs() {
+		if job.State == jobQueued {
+			js.queue = append(js.queue, job.ID)
+		}
+	}
+
+	return js, nil
+}
+
+// newJobID returns a new job identifier. Identifiers sort in creation order.
+func newJobID() (string, error) {
+	bs := make([]byte, 4)
+	if _, err := rand.Read(bs); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%016x%s", time.Now().UnixNano(), hex.EncodeToString(bs)), nil
+}
+
+// jobDir returns the directory of a job.
+func (js *jobStore) jobDir(id string) string {
+	return filepath.Join(js.dir, id)
+}
+
+// resultPath returns the path of the result of a job.
+func (js *jobStore) resultPath(id string) string {
+	return filepath.Join(js.jobDir(id), jobResultFile)
+}
+
+// projectDir returns the directory where the project of a job is uploaded.
+func (js *jobStore) projectDir(id string) string {
+	return filepath.Join(js.jobDir(id), jobProjectDir)
+}
+
+// add saves a new job and queues it. The job directory may already exist,
+// holding the uploaded project.
+func (js *jobStore) add(job *Job) error {
+	js.mu.Lock()
+	defer js.mu.Unlock()
+
+	job.State = jobQueued
+	job.Created = time.Now().UTC().Format(time.RFC3339)
+
+	if err := os.MkdirAll(js.jobDir(job.ID), 0755); err != nil {
+		log.Debug(err)
+		return errors.New("unable to create the job directory")
+	}
+	if err := js.save(job); err != nil {
+		return err
+	}
+
+	js.jobs[job.ID] = job
+	js.queue = append(js.queue, job.ID)
+	js.cond.Signal()
+	return nil
+}
+
+// get returns a copy of a job.
+func (js *jobStore) get(id string) (Job, error) {
+	js.mu.Lock()
+	defer js.mu.Unlock()
+
+	job, ok := js.jobs[id]
+	if !ok {
+		return Job{}, errJobNotFound
+	}
+	return *job, nil
+}
+
+// list returns a copy of all jobs, in creation order.
+func (js *jobStore) list() []Job {
+	js.mu.Lock()
+	defer js.mu.Unlock()
+
+	jobs := make([]Job, 0, len(js.jobs))
+	for _, job := range js.sortedJobs() {
+		jobs = append(jobs, *job)
+	}
+	return jobs
+}
+
+// remove removes a job that is not running, along with its files.
+func (js *jobStore) remove(id string) error {
+	js.mu.Lock()
+	defer js.mu.Unlock()
+
+	job, ok := js.jobs[id]
+	if !ok {
+		return errJobNotFound
+	}
+	if job.State == jobRunning {
+		return errors.New("job is running")
+	}
+
+	for i, qid := range js.queue {
+		if qid == id {
+			js.queue = append(js.queue[:i], js.queue[i+1:]...)
+			break
+		}
+	}
+	delete(js.jobs, id)
+
+	if err := os.RemoveAll(js.jobDir(id)); err != nil {
+		log.Debug(err)
+		return errors.New("unable to remove the job files")
+	}
+	return nil
+}
+
+// next waits for a queued job, marks it as running and returns a copy of it.
+// It returns false once the store is closed.
+func (js *jobStore) next() (Job, bool) {
+	js.mu.Lock()
+	defer js.mu.Unlock()
+
+	for len(js.queue) == 0 && !js.closed {
+		js.cond.Wait()
+	}
+	if js.closed {
+		return Job{}, false
+	}
+
+	job := js.jobs[js.queue[0]]
+	js.queue = js.queue[1:]
+
+	job.State = jobRunning
+	job.Started = time.Now().UTC().Format(time.RFC3339)
+	if err := js.save(job); err != nil {
+		log.Fail(err)
+	}
+	return *job, true
+}
+
+// finish records the outcome of a job.
+func (js *jobStore) finish(id string, diags int, jobErr error) {
+	js.mu.Lock()
+	defer js.mu.Unlock()
+
+	job, ok := js.jobs[id]
+	if !ok {
+		return
+	}
+
+	job.State = jobDone
+	job.Diagnostics = diags
+	if jobErr != nil {
+		job.State = jobFailed
+		job.Error = jobErr.Error()
+	}
+	job.Finished = time.Now().UTC().Format(time.RFC3339)
+
+	if err := js.save(job); err != nil {
+		log.Fail(err)
+	}
+}
+
+// close wakes up the workers waiting for a job and makes them return.
+func (js *jobStore) close() {
+	js.mu.Lock()
+	js.closed = true
+	js.cond.Broadcast()
+	js.mu.Unlock()
+}
+
+// save writes a job into its directory. The caller must hold the lock.
+func (js *jobStore) save(job *Job) error {
+	bs, err := json.MarshalIndent(job, "", "  ")
+	if err != nil {
+		log.Debug(err)
+		return errors.New("unable to marshal job " + job.ID)
+	}
+
+	path := filepath.Join(js.jobDir(job.ID), jobFile)
+	if err = ioutil.WriteFile(path+".tmp", bs, 0644); err == nil {
+		err = os.Rename(path+".tmp", path)
+	}
+	if err != nil {
+		log.Debug(err)
+		return errors.New("unable to save job " + job.ID)
+	}
+	return nil
+}
+
+// sortedJobs returns the jobs sorted by identifier, hence by creation. The
+// caller must hold the lock.
+func (js *jobStore) sortedJobs() []*Job {
+	ids := make([]string, 0, len(js.jobs))
+	for id := range js.jobs {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	jobs := make([]*Job, 0, len(ids))
+	for _, id := range ids {
+		jobs = append(jobs, js.jobs[id])
+	}
+	return jobs
+}
+
+// work runs the queued jobs with the parsers of m until the store is closed.
+func (js *jobStore) work(m *manager.Manager, opts manager.ParseOptions) {
+	for {
+		job, ok := js.next()
+		if !ok {
+			return
+		}
+
+		log.Info("running job ", job.ID)
+		opts.Diagnostics = new(manager.Diagnostics)
+		err := js.run(m, job, opts)
+		if err != nil {
+			log.Fail("job ", job.ID, ": ", err)
+		} else {
+			log.Success("job ", job.ID, " done")
+		}
+		js.finish(job.ID, len(opts.Diagnostics.Sorted()), err)
+	}
+}
+
+// run parses the project of a job and writes the result, along with the
+// diagnostics, into the job directory.
+func (js *jobStore) run(m *manager.Manager, job Job, opts manager.ParseOptions) error {
+	ms, err := manager.ParseMergeStrategy(job.OnConflict)
+	if err != nil {
+		return err
+	}
+	opts.Strategy = ms
+
+	projectPath := job.Path
+	if job.Upload {
+		if projectPath, err = uploadedProjectRoot(js.projectDir(job.ID)); err != nil {
+			return err
+		}
+	}
+
+	prj, err := m.Parse(context.Background(), projectPath, opts)
+	if err != nil {
+		return err
+	}
+
+	doc := document{Project: prj, Diagnostics: opts.Diagnostics.Sorted()}
+	return writeDocument(js.resultPath(job.ID), formatJSON, doc)
+}
+
+// uploadedProjectRoot returns the root of an uploaded project: the only
+// directory of dir when the archive held a single top-level directory, dir
+// itself otherwise.
+func uploadedProjectRoot(dir string) (string, error) {
+	fis, err := ioutil.ReadDir(dir)
+	if err != nil {
+		log.Debug(err)
+		return "", errors.New("unable to read the uploaded project")
+	}
+
+	if len(fis) == 1 && fis[0].IsDir() {
+		return filepath.Join(dir, fis[0].Name()), nil
+	}
+	return dir, nil
+}
@@ -5,40 +5,114 @@
 package cmd
 
 import (
+	"context"
 	"fmt"
 
 	"github.com/codegangsta/cli"
 
-	"github.com/DevMine/srctool/config"
 	"github.com/DevMine/srctool/log"
+	"github.com/DevMine/srctool/manager"
 )
 
 // List command is used to list installed parsers or available parsers.
 func List(c *cli.Context) {
 	// this will create the config dir if it does not already exist
-	cfg, err := config.New()
+	m, err := lockManager(c, false)
 	if err != nil {
-		log.Fatal(err)
+		fatal(err)
 	}
+	defer unlockParsers()
 
-	var parsers []string
-	var parserStatus string
+	var parsers []parserStatus
+	var listStatus string
 
 	if c.Bool("r") {
-		parsers = getRemoteParsers(cfg.DownloadServerURL)
-		parserStatus = "available"
+		parsers, err = remoteParsers(m)
+		listStatus = statusAvailable
 	} else {
-		parsers = getInstalledParsers()
-		parserStatus = "installed"
+		parsers, err = installedParsers(m)
+		listStatus = statusInstalled
+	}
+	if err != nil {
+		fatal(err)
+	}
+
+	if jsonOutput(c) {
+		if parsers == nil {
+			parsers = []parserStatus{}
+		}
+		printJSON(struct {
+			Parsers []parserStatus `json:"parsers"`
+		}{parsers})
+		return
 	}
 
 	if len(parsers) == 0 {
-		fmt.Println("no parser", parserStatus)
+		fmt.Println("no parser", listStatus)
 		return
 	}
 
-	fmt.Println(parserStatus, "parsers:")
-	for _, parser := range parsers {
-		fmt.Println("  * ", parser)
+	fmt.Println(listStatus, "parsers:")
+	for _, p := range parsers {
+		fmt.Println("  * ", p.Language)
+	}
+}
+
+// installedParsers returns the status of the installed parsers.
+func installedParsers(m *manager.Manager) ([]parserStatus, error) {
+	installed, err := m.List()
+	if err != nil {
+		return nil, err
+	}
+
+	var parsers []parserStatus
+	for _, p := range installed {
+		version, err := p.Checksum()
+		if err != nil {
+			log.Debug(err)
+		}
+		parsers = append(parsers, parserStatus{
+			Name:     p.Name,
+			Language: p.Language(),
+			Version:  version,
+			Status:   statusInstalled,
+		})
+	}
+	return parsers, nil
+}
+
+// remoteParsers returns the status of the parsers provided by the download
+// server, compared to the installed ones.
+func remoteParsers(m *manager.Manager) ([]parserStatus, error) {
+	remote, err := m.ListRemote(context.Background())
+	if err != nil {
+		return nil, err
+	}
+
+	installed, err := installedParsers(m)
+	if err != nil {
+		return nil, err
+	}
+	versions := make(map[string]string)
+	for _, p := range installed {
+		versions[p.Name] = p.Version
+	}
+
+	var parsers []parserStatus
+	for _, rp := range remote {
+		status := statusAvailable
+		if version, ok := versions[rp.Name]; ok {
+			status = statusInstalled
+			if version != rp.Checksum {
+				status = statusOutdated
+			}
+		}
+		parsers = append(parsers, parserStatus{
+			Name:     rp.Name,
+			Language: rp.Language(),
+			Version:  rp.Checksum,
+			Status:   status,
+		})
 	}
+	return parsers, nil
 }
@@ -0,0 +1,183 @@
+// Copyright 2014-2015 The DevMine authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"sort"
+
+	"github.com/codegangsta/cli"
+
+	"github.com/DevMine/srctool/config"
+	"github.com/DevMine/srctool/log"
+	"github.com/DevMine/srctool/manager"
+)
+
+// lockfile pins the parsers used to parse a corpus: every worker must run
+// exactly these parsers, identified by the MD5 sum of their archive.
+type lockfile struct {
+	Parsers map[string]string `json:"parsers"` // parser name -> MD5 sum
+}
+
+// names returns the names of the parsers of the lockfile, sorted.
+func (lf lockfile) names() []string {
+	names := make([]string, 0, len(lf.Parsers))
+	for name := range lf.Parsers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// installedLockfile returns the lockfile of the parsers installed by m.
+func installedLockfile(m *manager.Manager) (lockfile, error) {
+	lf := lockfile{Parsers: make(map[string]string)}
+
+	parsers, err := m.List()
+	if err != nil {
+		return lf, err
+	}
+	if len(parsers) == 0 {
+		return lf, manager.ErrNoParsers
+	}
+
+	for _, p := range parsers {
+		sum, err := p.Checksum()
+		if err != nil {
+			return lf, err
+		}
+		lf.Parsers[p.Name] = sum
+	}
+	return lf, nil
+}
+
+// readLockfile reads the lockfile at path.
+func readLockfile(path string) (lockfile, error) {
+	var lf lockfile
+
+	bs, err := ioutil.ReadFile(path)
+	if err != nil {
+		log.Debug(err)
+		return lf, fmt.Errorf("unable to read the lockfile %s", path)
+	}
+
+	if err = json.Unmarshal(bs, &lf); err != nil {
+		log.Debug(err)
+		return lf, fmt.Errorf("malformed lockfile %s", path)
+	}
+	if len(lf.Parsers) == 0 {
+		return lf, errors.New("the lockfile does not list any parser")
+	}
+	return lf, nil
+}
+
+// maxLockfileAttempts is the maximum number of times the parsers of a
+// lockfile are installed by lockLockfileParsers.
+const maxLockfileAttempts = 3
+
+// lockLockfileParsers installs the parsers of the lockfile as ensureParsers,
+// under an exclusive lock of the parsers directory, then locks it in shared
+// mode until unlockParsers is called. As the lock is released in between, the
+// parsers are checked again once locked in shared mode.
+func lockLockfileParsers(c *cli.Context, cfg *config.Config, m *manager.Manager, lf lockfile) error {
+	for attempt := 1; ; attempt++ {
+		if err := lockParsers(c, cfg, false); err != nil {
+			return err
+		}
+		if len(outdatedParsers(m, lf)) == 0 {
+			return nil
+		}
+		unlockParsers()
+
+		if attempt > maxLockfileAttempts {
+			return errors.New("the parsers of the lockfile keep being changed by other srctool processes")
+		}
+		if err := lockParsers(c, cfg, true); err != nil {
+			return err
+		}
+		err := ensureParsers(m, lf)
+		unlockParsers()
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// outdatedParsers returns the parsers of the lockfile that are missing or
+// whose version differs.
+func outdatedParsers(m *manager.Manager, lf lockfile) []string {
+	var names []string
+	for _, name := range lf.names() {
+		if p, err := m.Installed(name); err == nil {
+			if sum, err := p.Checksum(); err == nil && sum == lf.Parsers[name] {
+				log.Debug(name, " matches the lockfile")
+				continue
+			}
+		}
+		names = append(names, name)
+	}
+	return names
+}
+
+// ensureParsers installs the parsers of the lockfile that are missing and
+// replaces the ones whose version differs. It fails if the download server
+// does not provide the locked versions, before touching the installed
+// parsers.
+func ensureParsers(m *manager.Manager, lf lockfile) error {
+	ctx := context.Background()
+
+	missing := outdatedParsers(m, lf)
+	if len(missing) == 0 {
+		return nil
+	}
+
+	remote, err := m.ListRemote(ctx)
+	if err != nil {
+		return err
+	}
+	available := make(map[string]string, len(remote))
+	for _, rp := range remote {
+		available[rp.Name] = rp.Checksum
+	}
+	for _, name := range missing {
+		if available[name] != lf.Parsers[name] {
+			return fmt.Errorf("the download server does not provide the version of %s of the lockfile", name)
+		}
+	}
+
+	for _, name := range missing {
+		want := lf.Parsers[name]
+
+		if _, err := m.Installed(name); err == nil {
+			log.Info("replacing ", name, " by the version of the lockfile")
+			if err := m.Remove(name); err != nil {
+				return err
+			}
+		} else {
+			log.Info("installing ", name)
+		}
+
+		if err := m.Install(ctx, name); err != nil {
+			return err
+		}
+
+		p, err := m.Installed(name)
+		if err != nil {
+			return err
+		}
+		sum, err := p.Checksum()
+		if err != nil {
+			return err
+		}
+		if sum != want {
+			return fmt.Errorf("the download server does not provide the version of %s of the lockfile", name)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,63 @@
+// Copyright 2014-2015 The DevMine authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/codegangsta/cli"
+
+	"github.com/DevMine/srctool/log"
+	"github.com/DevMine/srctool/manager"
+)
+
+// Merge command merges previously saved parse results into a single project.
+// It expects one or more files as arguments, "-" meaning stdin. Each file may
+// contain several projects, one after the other. The results are decoded,
+// validated and merged exactly like the outputs of the parsers in the parse
+// command.
+func Merge(c *cli.Context) {
+	if !c.Args().Present() {
+		fatal("expected at least 1 argument, found 0")
+	}
+
+	ms, err := manager.ParseMergeStrategy(c.String("on-conflict"))
+	if err != nil {
+		fatal(err)
+	}
+
+	format := c.String("format")
+	if err = checkFormat(format); err != nil {
+		fatal(err)
+	}
+
+	var outs []manager.Output
+	for _, path := range c.Args() {
+		prjs, err := readProjects(path)
+		if err != nil {
+			fatal(path, ": ", err)
+		}
+
+		for i, prj := range prjs {
+			name := path
+			if len(prjs) > 1 {
+				name = fmt.Sprintf("%s#%d", path, i+1)
+			}
+			outs = append(outs, manager.Output{Parser: name, Project: prj})
+		}
+	}
+
+	log.Info("merging ", len(outs), " projects")
+	prj, err := manager.Merge(outs, ms)
+	if err != nil {
+		fatal(err)
+	}
+
+	if err = writeDocument(c.String("o"), format, document{Project: prj}); err != nil {
+		fatal(err)
+	}
+
+	log.Success("done merging")
+}
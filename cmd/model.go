@@ -0,0 +1,159 @@
+// Copyright 2014-2015 The DevMine authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cmd
+
+import (
+	"strings"
+
+	"github.com/DevMine/srcanlzr/src"
+)
+
+// decl is a declaration (function, method or type) of a source file.
+//
+// Declarations are read from the JSON representation of the source files
+// rather than from the srcanlzr AST types, so that all kinds of types
+// declared by the different languages are handled the same way.
+type decl struct {
+	kind    string // function, method, class, struct, interface, ...
+	name    string
+	loc     int64
+	methods []decl // methods of a type declaration
+
+	node map[string]interface{} // JSON representation of the declaration
+}
+
+// typeFields maps the fields of a source file holding type declarations to
+// the kind of these types.
+var typeFields = []struct {
+	field string
+	kind  string
+}{
+	{"type_specifiers", "type"},
+	{"structs", "struct"},
+	{"interfaces", "interface"},
+	{"classes", "class"},
+	{"enums", "enum"},
+	{"traits", "trait"},
+}
+
+// methodFields are the fields of a type declaration holding its methods.
+var methodFields = []string{"methods", "prototypes"}
+
+// fileDecls returns the functions and the types declared in a source file.
+func fileDecls(sf *src.SourceFile) (funcs, types []decl, err error) {
+	g, err := toGeneric(sf)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	node, _ := g.(map[string]interface{})
+	funcs = declsOf(node, "functions", "function")
+
+	for _, tf := range typeFields {
+		ts := declsOf(node, tf.field, tf.kind)
+		for i := range ts {
+			for _, mf := range methodFields {
+				ts[i].methods = append(ts[i].methods, declsOf(ts[i].node, mf, "method")...)
+			}
+		}
+		types = append(types, ts...)
+	}
+
+	return funcs, types, nil
+}
+
+// declsOf returns the declarations listed in the given field of node.
+func declsOf(node map[string]interface{}, field, kind string) []decl {
+	list, _ := node[field].([]interface{})
+
+	decls := make([]decl, 0, len(list))
+	for _, e := range list {
+		n, ok := e.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		decls = append(decls, decl{
+			kind: kind,
+			name: stringField(n, "name"),
+			loc:  intField(n, "loc"),
+			node: n,
+		})
+	}
+	return decls
+}
+
+// declSignature returns the types of the parameters of a function or method
+// declaration, such as "(int, String)", or an empty string if the parser does
+// not describe them. The parameters are read from the function type of the
+// declaration, its "type" field, or from the declaration itself.
+func declSignature(d decl) string {
+	node := d.node
+	if t, ok := node["type"].(map[string]interface{}); ok {
+		node = t
+	}
+
+	params, ok := node["parameters"].([]interface{})
+	if !ok {
+		return ""
+	}
+
+	types := make([]string, 0, len(params))
+	for _, p := range params {
+		pn, _ := p.(map[string]interface{})
+		t := stringField(pn, "type")
+		if len(t) == 0 {
+			t = "?"
+		}
+		types = append(types, t)
+	}
+	return "(" + strings.Join(types, ", ") + ")"
+}
+
+// stringField returns the value of a string field of node, or an empty string
+// if there is no such field.
+func stringField(node map[string]interface{}, name string) string {
+	s, _ := node[name].(string)
+	return s
+}
+
+// intField returns the value of a numeric field of node, or 0 if there is no
+// such field.
+func intField(node map[string]interface{}, name string) int64 {
+	switch n := node[name].(type) {
+	case int64:
+		return n
+	case float64:
+		return int64(n)
+	}
+	return 0
+}
+
+// countStatements returns the number of statements, including the nested
+// ones, found in v, the generic JSON representation of a piece of AST.
+func countStatements(v interface{}) int {
+	n := 0
+	switch v := v.(type) {
+	case map[string]interface{}:
+		if _, ok := v["statement_name"]; ok {
+			n++
+		}
+		for _, e := range v {
+			n += countStatements(e)
+		}
+	case []interface{}:
+		for _, e := range v {
+			n += countStatements(e)
+		}
+	}
+	return n
+}
+
+// fileLanguage returns the language of a source file.
+func fileLanguage(sf *src.SourceFile) string {
+	if sf.Language == nil || len(sf.Language.Lang) == 0 {
+		return "unknown"
+	}
+	return sf.Language.Lang
+}
@@ -0,0 +1,280 @@
+// Copyright 2014-2015 The DevMine authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cmd
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/DevMine/srcanlzr/src"
+	"github.com/ugorji/go/codec"
+
+	"github.com/DevMine/srctool/log"
+	"github.com/DevMine/srctool/manager"
+)
+
+// Output formats.
+const (
+	formatJSON    = "json"    // compact JSON, on a single line
+	formatPretty  = "pretty"  // indented JSON
+	formatJSONL   = "jsonl"   // JSON Lines, one record per package and file
+	formatGzip    = "gzip"    // gzip compressed JSON
+	formatCBOR    = "cbor"    // CBOR (RFC 7049)
+	formatMsgpack = "msgpack" // MessagePack
+)
+
+var outputFormats = []string{
+	formatJSON,
+	formatPretty,
+	formatJSONL,
+	formatGzip,
+	formatCBOR,
+	formatMsgpack,
+}
+
+// checkFormat returns an error if format is not a supported output format.
+func checkFormat(format string) error {
+	for _, f := range outputFormats {
+		if f == format {
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown output format '%s', expected one of %v", format, outputFormats)
+}
+
+// document is what srctool outputs: a project, the version of the project
+// schema it follows and optional extra sections, such as the parsers
+// diagnostics, that are output along with the fields of the project. Empty
+// sections are omitted. The field names are the same in all formats.
+type document struct {
+	*src.Project
+	SchemaVersion int `json:"schema_version"`
+
+	Authors     []FileAuthorship     `json:"authors,omitempty"`
+	Diagnostics []manager.Diagnostic `json:"diagnostics,omitempty"`
+}
+
+// writeDocument writes doc in the given format into the file at path or to
+// stdout if path is empty. The file is replaced atomically so that readers
+// never see a partially written output.
+func writeDocument(path, format string, doc document) error {
+	if err := checkFormat(format); err != nil {
+		return err
+	}
+
+	if len(path) == 0 {
+		return encodeOutput(os.Stdout, format, doc)
+	}
+
+	f, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".")
+	if err != nil {
+		log.Debug(err)
+		return fmt.Errorf("unable to create the output file %s", path)
+	}
+	defer os.Remove(f.Name())
+
+	err = encodeOutput(f, format, doc)
+	if cerr := f.Close(); err == nil && cerr != nil {
+		log.Debug(cerr)
+		err = errors.New("unable to write the output")
+	}
+	if err != nil {
+		return err
+	}
+
+	if err = os.Chmod(f.Name(), 0644); err != nil {
+		log.Debug(err)
+	}
+	if err = os.Rename(f.Name(), path); err != nil {
+		log.Debug(err)
+		return fmt.Errorf("unable to create the output file %s", path)
+	}
+	return nil
+}
+
+// encodeOutput encodes doc in the given format into out, through a buffer.
+func encodeOutput(out io.Writer, format string, doc document) error {
+	w := bufio.NewWriter(out)
+	if err := encodeDocument(w, format, doc); err != nil {
+		log.Debug(err)
+		return fmt.Errorf("unable to encode the final %s", format)
+	}
+
+	if err := w.Flush(); err != nil {
+		log.Debug(err)
+		return errors.New("unable to write the output")
+	}
+	return nil
+}
+
+// encodeDocument encodes doc in the given format into w, declaring the
+// version of the project schema srctool follows.
+func encodeDocument(w io.Writer, format string, doc document) error {
+	doc.SchemaVersion = manager.SchemaVersion
+
+	switch format {
+	case formatJSON:
+		return json.NewEncoder(w).Encode(doc)
+	case formatPretty:
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(doc)
+	case formatJSONL:
+		return encodeJSONL(w, doc)
+	case formatGzip:
+		gw := gzip.NewWriter(w)
+		if err := json.NewEncoder(gw).Encode(doc); err != nil {
+			return err
+		}
+		return gw.Close()
+	case formatCBOR:
+		h := new(codec.CborHandle)
+		h.Canonical = true
+		return encodeBinary(w, h, doc)
+	case formatMsgpack:
+		h := new(codec.MsgpackHandle)
+		h.Canonical = true
+		h.WriteExt = true
+		return encodeBinary(w, h, doc)
+	}
+
+	return fmt.Errorf("unknown output format '%s'", format)
+}
+
+// encodeBinary encodes doc with a binary codec. The codec reads the field
+// names from the JSON tags.
+func encodeBinary(w io.Writer, h codec.Handle, doc document) error {
+	return codec.NewEncoder(w, h).Encode(doc)
+}
+
+// encodeJSONL encodes doc as JSON Lines. The first record holds the project
+// without its packages, followed by one record per package, one record per
+// source file and finally one record per extra section. Every record has a
+// "record" field telling its kind.
+func encodeJSONL(w io.Writer, doc document) error {
+	enc := json.NewEncoder(w)
+
+	// the fields hiding the ones of the embedded values are always nil,
+	// hence omitted
+	err := enc.Encode(struct {
+		Record string `json:"record"`
+		*src.Project
+		SchemaVersion int            `json:"schema_version"`
+		Packages      []*src.Package `json:"packages,omitempty"`
+	}{"project", doc.Project, doc.SchemaVersion, nil})
+	if err != nil {
+		return err
+	}
+
+	for _, pkg := range doc.Packages {
+		if pkg == nil {
+			continue
+		}
+
+		err = enc.Encode(struct {
+			Record string `json:"record"`
+			*src.Package
+			SourceFiles []*src.SourceFile `json:"source_files,omitempty"`
+		}{"package", pkg, nil})
+		if err != nil {
+			return err
+		}
+
+		for _, sf := range pkg.SourceFiles {
+			if sf == nil {
+				continue
+			}
+
+			err = enc.Encode(struct {
+				Record string `json:"record"`
+				*src.SourceFile
+				Package string `json:"package"`
+			}{"file", sf, pkg.Path})
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	if len(doc.Authors) > 0 {
+		err = enc.Encode(struct {
+			Record  string           `json:"record"`
+			Authors []FileAuthorship `json:"authors"`
+		}{"authors", doc.Authors})
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(doc.Diagnostics) > 0 {
+		err = enc.Encode(struct {
+			Record      string               `json:"record"`
+			Diagnostics []manager.Diagnostic `json:"diagnostics"`
+		}{"diagnostics", doc.Diagnostics})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// toGeneric converts v into the generic values (maps, slices, strings,
+// numbers, booleans and nil) of its JSON representation. Integral numbers are
+// converted into int64 and others into float64.
+func toGeneric(v interface{}) (interface{}, error) {
+	bs, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(bs))
+	dec.UseNumber()
+
+	var g interface{}
+	if err = dec.Decode(&g); err != nil {
+		return nil, err
+	}
+	return convertNumbers(g), nil
+}
+
+func convertNumbers(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for k, e := range v {
+			v[k] = convertNumbers(e)
+		}
+	case []interface{}:
+		for i, e := range v {
+			v[i] = convertNumbers(e)
+		}
+	case json.Number:
+		if n, err := v.Int64(); err == nil {
+			return n
+		}
+		f, _ := v.Float64()
+		return f
+	}
+	return v
+}
+
+// formatExt returns the file extension of an output format.
+func formatExt(format string) string {
+	switch format {
+	case formatJSON, formatPretty:
+		return ".json"
+	case formatGzip:
+		return ".json.gz"
+	}
+	return "." + format
+}
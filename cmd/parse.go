@@ -5,121 +5,137 @@
 package cmd
 
 import (
-	"bytes"
-	"encoding/json"
-	"fmt"
-	"io/ioutil"
-	"os/exec"
-	"path/filepath"
-	"strings"
+	"context"
+	"time"
 
 	"github.com/DevMine/srcanlzr/src"
 	"github.com/codegangsta/cli"
 
-	"github.com/DevMine/srctool/config"
 	"github.com/DevMine/srctool/log"
+	"github.com/DevMine/srctool/manager"
 )
 
 // Parse command runs all installed parsers on a project, merges the resulting
-// JSON and outputs the result in JSON to stdout.
+// JSON and outputs the result to stdout or into the file given by the "o"
+// option. The output format is JSON by default and can be changed with the
+// "format" option.
 // It expects only one command line argument: the directory of a project.
+//
+// The output of each parser is validated against the project schema before
+// being merged. Invalid outputs are rejected.
+//
+// The standard error output of the parsers is streamed to the log, each line
+// being prefixed by the parser name. Diagnostics emitted in JSON by the
+// parsers are collected and either saved into a separate file or embedded
+// into the output.
+//
+// The outputs of the parsers are merged in the order of the parser names, so
+// that the final JSON is deterministic. The "on-conflict" option tells what to
+// do when several parsers claim the same language or file.
+//
+// With the "shard" option, projects are split into shards, by top-level
+// directory or by number of files, for the parsers accepting a list of files.
+// The shards are parsed in parallel and the results merged.
+//
+// With the "authors" option, the project must be a git repository: each
+// source file is blamed and the authorship of its functions and types is
+// added to the output.
 func Parse(ctx *cli.Context) {
 	if !ctx.Args().Present() {
-		log.Fatal("expected 1 argument, found 0")
+		fatal("expected 1 argument, found 0")
 	}
 
-	projectPath := ctx.Args().First()
-	parsersPath := filepath.Join(config.DataDir(), config.ParsersFolder)
-
-	fis, err := ioutil.ReadDir(parsersPath)
+	ms, err := manager.ParseMergeStrategy(ctx.String("on-conflict"))
 	if err != nil {
-		log.Fatal(err)
+		fatal(err)
 	}
 
-	if len(fis) == 0 {
-		log.Fatal("no parser installed")
-		return
+	format := ctx.String("format")
+	if err = checkFormat(format); err != nil {
+		fatal(err)
 	}
 
-	totalWaits := 0
-	c := make(chan *bytes.Buffer)
-
-	for _, fi := range fis {
-		if !fi.IsDir() {
-			continue
-		}
-
-		if marched, err := filepath.Match("parser-*", fi.Name()); err != nil {
-			log.Debug(err)
-			continue
-		} else if !marched {
-			continue
-		}
-
-		totalWaits++
-		go cmdRoutine(parsersPath, fi.Name(), projectPath, c)
+	so, err := manager.ParseShardOptions(ctx.String("shard"), ctx.Int("shard-size"), ctx.Int("shard-jobs"))
+	if err != nil {
+		fatal(err)
 	}
 
-	var prjs []*src.Project
+	diags := new(manager.Diagnostics)
+	opts := manager.ParseOptions{
+		Strategy:    ms,
+		LogDir:      ctx.String("parser-logs"),
+		Shard:       so,
+		Diagnostics: diags,
+	}
+	projectPath := ctx.Args().First()
 
-	for ; totalWaits > 0; totalWaits-- {
-		select {
-		case buf := <-c:
-			prj, err := src.Decode(buf)
-			if err != nil {
-				log.Fail(err)
-			}
+	cfg, err := loadConfig(ctx, projectPath)
+	if err != nil {
+		fatal(err)
+	}
+	m := newManager(ctx, cfg)
 
-			prjs = append(prjs, prj)
-		}
+	// the parsers must not change while they run, which lasts until
+	// interrupted in watch mode
+	if err = lockParsers(ctx, cfg, false); err != nil {
+		fatal(err)
 	}
 
-	close(c)
+	if ctx.Bool("watch") {
+		wopts := watchOptions{
+			debounce: ctx.Duration("debounce"),
+			ignored:  []string{ctx.String("o"), ctx.String("diagnostics"), ctx.String("parser-logs")},
+		}
+		if len(ctx.String("o")) == 0 {
+			fatal("the watch mode requires an output file (-o option)")
+		}
 
-	log.Info("merging JSON outputs")
-	var prj *src.Project
-	if prj, err = src.MergeAll(prjs...); err != nil {
-		log.Debug(err)
-		log.Fatal("failed to merge all JSON")
+		err = watchProject(m, projectPath, opts, wopts, func(prj *src.Project) error {
+			return writeParseOutput(ctx, projectPath, prj, diags)
+		})
+		if err != nil {
+			fatal(err)
+		}
+		unlockParsers()
+		return
 	}
 
-	bs, err := json.Marshal(prj)
+	start := time.Now()
+	prj, err := m.Parse(context.Background(), projectPath, opts)
 	if err != nil {
-		log.Debug(err)
-		log.Fatal("unable to marshal the final JSON")
+		fatal(err)
 	}
+	unlockParsers()
 
-	fmt.Println(string(bs))
+	if err = writeParseOutput(ctx, projectPath, prj, diags); err != nil {
+		fatal(err)
+	}
 
-	log.Success("done parsing")
+	log.Fields{"project": projectPath, "duration": time.Since(start)}.Success("done parsing")
 }
 
-// cmdRoutine runs a language parser on a project.
-func cmdRoutine(parsersPath, parserName, projectPath string, c chan *bytes.Buffer) {
-	outBuf := new(bytes.Buffer)
-	errBuf := new(bytes.Buffer)
-
-	parserBin := filepath.Join(parsersPath, parserName, "parser")
-
-	cmd := exec.Command(parserBin, projectPath)
-	cmd.Stdout = outBuf
-	cmd.Stderr = errBuf
-
-	log.Debug("command: ", strings.Join(cmd.Args, " "))
-
-	if err := cmd.Run(); err != nil {
-		log.Debug("debug:", err)
-		log.Fatal(fmt.Sprintf("failed to parse with the %s parser", parserName))
+// writeParseOutput writes the result of the parse command, along with the
+// diagnostics and the authorship if requested.
+func writeParseOutput(ctx *cli.Context, projectPath string, prj *src.Project, diags *manager.Diagnostics) error {
+	if path := ctx.String("diagnostics"); len(path) > 0 {
+		if err := saveDiagnostics(path, diags); err != nil {
+			log.Fail(err)
+		}
 	}
 
-	if errBuf.Len() > 0 {
-		log.Info(fmt.Sprintf("parser %s errors:", parserName))
-		log.Fail(errBuf.String())
+	doc := document{Project: prj}
+	if ctx.Bool("inline-diagnostics") {
+		doc.Diagnostics = diags.Sorted()
 	}
 
-	if outBuf.Len() == 0 {
-		log.Fatal(fmt.Sprintf("the %s parser did not produce any output", parserName))
+	if ctx.Bool("authors") {
+		log.Info("annotating authorship")
+		fas, err := projectAuthorship(projectPath, prj)
+		if err != nil {
+			return err
+		}
+		doc.Authors = fas
 	}
 
-	c <- outBuf
+	return writeDocument(ctx.String("o"), ctx.String("format"), doc)
 }
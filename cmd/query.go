@@ -0,0 +1,638 @@
+// Copyright 2014-2015 The DevMine authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cmd
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"unicode"
+
+	"github.com/codegangsta/cli"
+
+	"github.com/DevMine/srctool/log"
+)
+
+// Query command evaluates a query over a saved parse result and prints the
+// matching values. It expects two arguments: the parse result and the query.
+//
+// A query is a path of field names separated by dots, walking down the JSON
+// representation of the project. Arrays are transparently flattened, hence
+// "packages.source_files.functions" selects all the functions of the project.
+// The special step "*" selects all the fields of an object. Each step can be
+// followed by one or more filters between brackets:
+//
+//	packages[name = "main"].source_files.functions[@statements > 20]
+//	packages.source_files.classes[methods.name = "run"]
+//
+// A filter compares operands with one of the =, !=, <, <=, >, >= and ~
+// (regular expression match) operators, and conditions can be combined with
+// "and", "or", "not" and parentheses. An operand is either a literal (string,
+// number, true, false or null), a relative path, "#path" which is the number
+// of values selected by the path, or "@statements" which is the number of
+// statements of the current value. A comparison involving a path holds if it
+// holds for any of the values selected by the path, and a path alone holds if
+// it selects a value other than null or false.
+func Query(c *cli.Context) {
+	if len(c.Args()) != 2 {
+		fatal("expected 2 arguments, found ", len(c.Args()))
+	}
+
+	q, err := parseQuery(c.Args().Get(1))
+	if err != nil {
+		fatal("invalid query: ", err)
+	}
+
+	prj, err := decodeProjectFile(c.Args().First())
+	if err != nil {
+		fatal(err)
+	}
+
+	root, err := toGeneric(prj)
+	if err != nil {
+		log.Debug(err)
+		fatal("unable to convert the project")
+	}
+
+	results, err := q.eval([]queryValue{{path: "$", v: root}})
+	if err != nil {
+		fatal(err)
+	}
+
+	if c.Bool("json") || jsonOutput(c) {
+		vs := make([]interface{}, len(results))
+		for i, r := range results {
+			vs[i] = r.v
+		}
+
+		bs, err := json.MarshalIndent(vs, "", "  ")
+		if err != nil {
+			log.Debug(err)
+			fatal("unable to marshal the results")
+		}
+		fmt.Println(string(bs))
+		return
+	}
+
+	printQueryResults(results)
+}
+
+// queryValue is a value selected by a query, along with its JSON path.
+type queryValue struct {
+	path string
+	v    interface{}
+}
+
+// query is a parsed query.
+type query struct {
+	steps []queryStep
+}
+
+// queryStep is a step of a query path.
+type queryStep struct {
+	field   string // field name, "*" for all fields
+	filters []queryExpr
+}
+
+// queryExpr is a filter expression.
+type queryExpr interface {
+	// holds tells whether the expression holds for the value v.
+	holds(v queryValue) (bool, error)
+}
+
+// eval evaluates the query starting from values.
+func (q *query) eval(values []queryValue) ([]queryValue, error) {
+	for _, step := range q.steps {
+		values = step.apply(values)
+		for _, f := range step.filters {
+			var kept []queryValue
+			for _, v := range values {
+				ok, err := f.holds(v)
+				if err != nil {
+					return nil, err
+				}
+				if ok {
+					kept = append(kept, v)
+				}
+			}
+			values = kept
+		}
+	}
+	return values, nil
+}
+
+// apply selects the field of the step in every value. Arrays are flattened.
+func (step queryStep) apply(values []queryValue) []queryValue {
+	var res []queryValue
+	for _, qv := range values {
+		for _, e := range flatten(qv) {
+			obj, ok := e.v.(map[string]interface{})
+			if !ok {
+				continue
+			}
+
+			if step.field != "*" {
+				if fv, ok := obj[step.field]; ok {
+					res = append(res, flatten(queryValue{e.path + "." + step.field, fv})...)
+				}
+				continue
+			}
+
+			keys := make([]string, 0, len(obj))
+			for k := range obj {
+				keys = append(keys, k)
+			}
+			sort.Strings(keys)
+			for _, k := range keys {
+				res = append(res, flatten(queryValue{e.path + "." + k, obj[k]})...)
+			}
+		}
+	}
+	return res
+}
+
+// flatten returns the elements of qv if it is an array, qv itself otherwise.
+func flatten(qv queryValue) []queryValue {
+	list, ok := qv.v.([]interface{})
+	if !ok {
+		return []queryValue{qv}
+	}
+
+	var res []queryValue
+	for i, e := range list {
+		res = append(res, flatten(queryValue{fmt.Sprintf("%s[%d]", qv.path, i), e})...)
+	}
+	return res
+}
+
+// Filter expressions.
+type (
+	andExpr struct{ left, right queryExpr }
+	orExpr  struct{ left, right queryExpr }
+	notExpr struct{ e queryExpr }
+
+	// cmpExpr compares two operands. If op is empty, it checks that left
+	// selects a value other than null or false.
+	cmpExpr struct {
+		left, right operand
+		op          string
+		re          *regexp.Regexp
+	}
+)
+
+func (e andExpr) holds(v queryValue) (bool, error) {
+	ok, err := e.left.holds(v)
+	if err != nil || !ok {
+		return false, err
+	}
+	return e.right.holds(v)
+}
+
+func (e orExpr) holds(v queryValue) (bool, error) {
+	ok, err := e.left.holds(v)
+	if err != nil || ok {
+		return ok, err
+	}
+	return e.right.holds(v)
+}
+
+func (e notExpr) holds(v queryValue) (bool, error) {
+	ok, err := e.e.holds(v)
+	return !ok, err
+}
+
+func (e cmpExpr) holds(v queryValue) (bool, error) {
+	lefts := e.left.values(v)
+	if len(e.op) == 0 {
+		for _, l := range lefts {
+			if l != nil && l != false {
+				return true, nil
+			}
+		}
+		return false, nil
+	}
+
+	rights := e.right.values(v)
+	for _, l := range lefts {
+		for _, r := range rights {
+			if ok, err := e.compare(l, r); err != nil || ok {
+				return ok, err
+			}
+		}
+	}
+	return false, nil
+}
+
+// compare compares two values. Only numbers and strings are ordered.
+func (e cmpExpr) compare(l, r interface{}) (bool, error) {
+	if e.op == "~" {
+		s, ok := l.(string)
+		return ok && e.re.MatchString(s), nil
+	}
+
+	if lf, ok := toFloat(l); ok {
+		rf, ok := toFloat(r)
+		if !ok {
+			return e.op == "!=", nil
+		}
+		return compareOrdered(e.op, lf < rf, lf == rf), nil
+	}
+
+	if ls, ok := l.(string); ok {
+		rs, ok := r.(string)
+		if !ok {
+			return e.op == "!=", nil
+		}
+		return compareOrdered(e.op, ls < rs, ls == rs), nil
+	}
+
+	// objects and arrays are compared by content, == panics on them
+	switch e.op {
+	case "=":
+		return reflect.DeepEqual(l, r), nil
+	case "!=":
+		return !reflect.DeepEqual(l, r), nil
+	}
+	return false, nil
+}
+
+func compareOrdered(op string, less, equal bool) bool {
+	switch op {
+	case "=":
+		return equal
+	case "!=":
+		return !equal
+	case "<":
+		return less
+	case "<=":
+		return less || equal
+	case ">":
+		return !less && !equal
+	case ">=":
+		return !less
+	}
+	return false
+}
+
+func toFloat(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case int64:
+		return float64(n), true
+	case float64:
+		return n, true
+	}
+	return 0, false
+}
+
+// operand is an operand of a comparison.
+type operand struct {
+	literal interface{}
+	path    []string // relative path, if not a literal
+	count   bool     // number of values selected by path
+	stmts   bool     // number of statements of the current value
+}
+
+// values returns the values of the operand for the current value v.
+func (o operand) values(v queryValue) []interface{} {
+	switch {
+	case o.stmts:
+		return []interface{}{int64(countStatements(v.v))}
+	case o.path == nil:
+		return []interface{}{o.literal}
+	}
+
+	vs := []queryValue{v}
+	for _, f := range o.path {
+		vs = queryStep{field: f}.apply(vs)
+	}
+
+	if o.count {
+		return []interface{}{int64(len(vs))}
+	}
+
+	res := make([]interface{}, len(vs))
+	for i, qv := range vs {
+		res[i] = qv.v
+	}
+	return res
+}
+
+// queryParser is a recursive descent parser of queries.
+type queryParser struct {
+	toks []string
+	pos  int
+}
+
+// parseQuery parses a query.
+func parseQuery(s string) (*query, error) {
+	toks, err := tokenizeQuery(s)
+	if err != nil {
+		return nil, err
+	}
+	if len(toks) == 0 {
+		return nil, errors.New("empty query")
+	}
+
+	p := &queryParser{toks: toks}
+	q := new(query)
+	for {
+		step, err := p.parseStep()
+		if err != nil {
+			return nil, err
+		}
+		q.steps = append(q.steps, step)
+
+		if p.peek() != "." {
+			break
+		}
+		p.next()
+	}
+
+	if p.pos < len(p.toks) {
+		return nil, fmt.Errorf("unexpected '%s'", p.peek())
+	}
+	return q, nil
+}
+
+func (p *queryParser) peek() string {
+	if p.pos < len(p.toks) {
+		return p.toks[p.pos]
+	}
+	return ""
+}
+
+func (p *queryParser) next() string {
+	t := p.peek()
+	p.pos++
+	return t
+}
+
+func (p *queryParser) expect(tok string) error {
+	if t := p.next(); t != tok {
+		if len(t) == 0 {
+			return fmt.Errorf("expected '%s', found end of query", tok)
+		}
+		return fmt.Errorf("expected '%s', found '%s'", tok, t)
+	}
+	return nil
+}
+
+func (p *queryParser) parseStep() (queryStep, error) {
+	var step queryStep
+
+	if t := p.next(); t == "*" || isIdent(t) {
+		step.field = t
+	} else {
+		return step, fmt.Errorf("expected field name, found '%s'", t)
+	}
+
+	for p.peek() == "[" {
+		p.next()
+		e, err := p.parseOr()
+		if err != nil {
+			return step, err
+		}
+		if err = p.expect("]"); err != nil {
+			return step, err
+		}
+		step.filters = append(step.filters, e)
+	}
+
+	return step, nil
+}
+
+func (p *queryParser) parseOr() (queryExpr, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek() == "or" {
+		p.next()
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = orExpr{left, right}
+	}
+	return left, nil
+}
+
+func (p *queryParser) parseAnd() (queryExpr, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek() == "and" {
+		p.next()
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		left = andExpr{left, right}
+	}
+	return left, nil
+}
+
+func (p *queryParser) parseUnary() (queryExpr, error) {
+	switch p.peek() {
+	case "not":
+		p.next()
+		e, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return notExpr{e}, nil
+	case "(":
+		p.next()
+		e, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		return e, p.expect(")")
+	}
+
+	left, err := p.parseOperand()
+	if err != nil {
+		return nil, err
+	}
+
+	e := cmpExpr{left: left}
+	switch op := p.peek(); op {
+	case "=", "!=", "<", "<=", ">", ">=", "~":
+		p.next()
+		if e.right, err = p.parseOperand(); err != nil {
+			return nil, err
+		}
+		e.op = op
+	default:
+		return e, nil
+	}
+
+	if e.op == "~" {
+		pattern, ok := e.right.literal.(string)
+		if !ok || e.right.path != nil {
+			return nil, errors.New("the ~ operator expects a string pattern")
+		}
+		if e.re, err = regexp.Compile(pattern); err != nil {
+			return nil, fmt.Errorf("invalid pattern %q: %v", pattern, err)
+		}
+	}
+
+	return e, nil
+}
+
+func (p *queryParser) parseOperand() (operand, error) {
+	t := p.next()
+	switch {
+	case t == "@":
+		if name := p.next(); name != "statements" {
+			return operand{}, fmt.Errorf("unknown attribute '@%s'", name)
+		}
+		return operand{stmts: true}, nil
+	case t == "#":
+		path, err := p.parsePath()
+		return operand{path: path, count: true}, err
+	case t == "true":
+		return operand{literal: true}, nil
+	case t == "false":
+		return operand{literal: false}, nil
+	case t == "null":
+		return operand{literal: nil}, nil
+	case strings.HasPrefix(t, "\""):
+		s, err := strconv.Unquote(t)
+		if err != nil {
+			return operand{}, fmt.Errorf("invalid string %s", t)
+		}
+		return operand{literal: s}, nil
+	case len(t) > 0 && (t[0] == '-' || unicode.IsDigit(rune(t[0]))):
+		if n, err := strconv.ParseInt(t, 10, 64); err == nil {
+			return operand{literal: n}, nil
+		}
+		f, err := strconv.ParseFloat(t, 64)
+		if err != nil {
+			return operand{}, fmt.Errorf("invalid number %s", t)
+		}
+		return operand{literal: f}, nil
+	case isIdent(t):
+		p.pos--
+		path, err := p.parsePath()
+		return operand{path: path}, err
+	case len(t) == 0:
+		return operand{}, errors.New("unexpected end of query")
+	}
+	return operand{}, fmt.Errorf("unexpected '%s'", t)
+}
+
+func (p *queryParser) parsePath() ([]string, error) {
+	var path []string
+	for {
+		t := p.next()
+		if !isIdent(t) {
+			return nil, fmt.Errorf("expected field name, found '%s'", t)
+		}
+		path = append(path, t)
+
+		if p.peek() != "." {
+			return path, nil
+		}
+		p.next()
+	}
+}
+
+// queryKeywords cannot be used as field names in filters.
+var queryKeywords = map[string]struct{}{
+	"and": {}, "or": {}, "not": {}, "true": {}, "false": {}, "null": {},
+}
+
+func isIdent(t string) bool {
+	if len(t) == 0 {
+		return false
+	}
+	if _, ok := queryKeywords[t]; ok {
+		return false
+	}
+	for i, r := range t {
+		if r != '_' && !unicode.IsLetter(r) && (i == 0 || !unicode.IsDigit(r)) {
+			return false
+		}
+	}
+	return true
+}
+
+// tokenizeQuery splits a query into tokens.
+func tokenizeQuery(s string) ([]string, error) {
+	var toks []string
+	for i := 0; i < len(s); {
+		c := s[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n':
+			i++
+		case strings.HasPrefix(s[i:], "!=") || strings.HasPrefix(s[i:], "<=") || strings.HasPrefix(s[i:], ">="):
+			toks = append(toks, s[i:i+2])
+			i += 2
+		case strings.IndexByte(".*[]()#@=<>~", c) >= 0:
+			toks = append(toks, string(c))
+			i++
+		case c == '"':
+			j := i + 1
+			for ; j < len(s) && s[j] != '"'; j++ {
+				if s[j] == '\\' {
+					j++
+				}
+			}
+			if j >= len(s) {
+				return nil, errors.New("unterminated string")
+			}
+			toks = append(toks, s[i:j+1])
+			i = j + 1
+		case c == '-' || (c >= '0' && c <= '9'):
+			j := i + 1
+			for ; j < len(s) && (s[j] == '.' || (s[j] >= '0' && s[j] <= '9')); j++ {
+			}
+			toks = append(toks, s[i:j])
+			i = j
+		case c == '_' || unicode.IsLetter(rune(c)):
+			j := i + 1
+			for ; j < len(s) && (s[j] == '_' || unicode.IsLetter(rune(s[j])) || unicode.IsDigit(rune(s[j]))); j++ {
+			}
+			toks = append(toks, s[i:j])
+			i = j
+		default:
+			return nil, fmt.Errorf("unexpected character '%c' at offset %d", c, i)
+		}
+	}
+	return toks, nil
+}
+
+// printQueryResults prints the results of a query as a table to stdout.
+// Objects are summarized by their name and size, other values are printed
+// as is.
+func printQueryResults(results []queryValue) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "path\tname\tloc\t")
+	for _, r := range results {
+		switch v := r.v.(type) {
+		case map[string]interface{}:
+			name := stringField(v, "name")
+			if len(name) == 0 {
+				name = stringField(v, "path")
+			}
+			fmt.Fprintf(w, "%s\t%s\t%d\t\n", r.path, name, intField(v, "loc"))
+		default:
+			bs, _ := json.Marshal(v)
+			fmt.Fprintf(w, "%s\t%s\t\t\n", r.path, string(bs))
+		}
+	}
+	w.Flush()
+
+	log.Info(len(results), " result(s)")
+}
@@ -0,0 +1,237 @@
+// Copyright 2014-2015 The DevMine authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cmd
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestTokenizeQuery(t *testing.T) {
+	tests := []struct {
+		query string
+		toks  []string
+	}{
+		{"", nil},
+		{"packages", []string{"packages"}},
+		{"packages.source_files", []string{"packages", ".", "source_files"}},
+		{"*.name", []string{"*", ".", "name"}},
+		{
+			`packages[name = "main"]`,
+			[]string{"packages", "[", "name", "=", `"main"`, "]"},
+		},
+		{
+			"a[b!=1 and c<=2 or d>=3]",
+			[]string{"a", "[", "b", "!=", "1", "and", "c", "<=", "2", "or", "d", ">=", "3", "]"},
+		},
+		{"a[b<1][c>2]", []string{"a", "[", "b", "<", "1", "]", "[", "c", ">", "2", "]"}},
+		{"a[#b > 0]", []string{"a", "[", "#", "b", ">", "0", "]"}},
+		{"a[@statements > -1.5]", []string{"a", "[", "@", "statements", ">", "-1.5", "]"}},
+		{`a[b ~ "^x\"y"]`, []string{"a", "[", "b", "~", `"^x\"y"`, "]"}},
+		{"a[not (b)]", []string{"a", "[", "not", "(", "b", ")", "]"}},
+		{" \ta \n. b ", []string{"a", ".", "b"}},
+		{"f_1.x2", []string{"f_1", ".", "x2"}},
+	}
+
+	for _, tt := range tests {
+		toks, err := tokenizeQuery(tt.query)
+		if err != nil {
+			t.Errorf("tokenizeQuery(%q): unexpected error: %v", tt.query, err)
+			continue
+		}
+		if !reflect.DeepEqual(toks, tt.toks) {
+			t.Errorf("tokenizeQuery(%q) = %q, want %q", tt.query, toks, tt.toks)
+		}
+	}
+}
+
+func TestTokenizeQueryErrors(t *testing.T) {
+	tests := []struct {
+		query string
+		err   string
+	}{
+		{`a[b = "main]`, "unterminated string"},
+		{`a[b = "main\"]`, "unterminated string"},
+		{"a[b & c]", "unexpected character '&' at offset 4"},
+		{"a;b", "unexpected character ';' at offset 1"},
+		{"a[b = 'x']", "unexpected character '''"},
+	}
+
+	for _, tt := range tests {
+		_, err := tokenizeQuery(tt.query)
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("tokenizeQuery(%q): error %v, want %q", tt.query, err, tt.err)
+		}
+	}
+}
+
+func TestQueryPrecedence(t *testing.T) {
+	// the values of a, b and c of each element, in binary: element i has
+	// a = i>>2&1, b = i>>1&1 and c = i&1
+	var elems []interface{}
+	for i := int64(0); i < 8; i++ {
+		elems = append(elems, map[string]interface{}{
+			"i": i,
+			"a": i >> 2 & 1,
+			"b": i >> 1 & 1,
+			"c": i & 1,
+		})
+	}
+	root := map[string]interface{}{"x": elems}
+
+	tests := []struct {
+		filter string
+		want   []int64 // i of the selected elements
+	}{
+		// and binds tighter than or
+		{"a = 1 or b = 1 and c = 1", []int64{3, 4, 5, 6, 7}},
+		{"b = 1 and c = 1 or a = 1", []int64{3, 4, 5, 6, 7}},
+		{"(a = 1 or b = 1) and c = 1", []int64{3, 5, 7}},
+
+		// not binds tighter than and
+		{"not a = 1 and b = 1", []int64{2, 3}},
+		{"not (a = 1 and b = 1)", []int64{0, 1, 2, 3, 4, 5}},
+		{"not not c = 1", []int64{1, 3, 5, 7}},
+
+		// and and or are left associative
+		{"a = 1 and b = 1 and c = 1", []int64{7}},
+		{"a = 1 or b = 1 or c = 1", []int64{1, 2, 3, 4, 5, 6, 7}},
+
+		// comparisons
+		{"i >= 6", []int64{6, 7}},
+		{"i < 2 or i > 5", []int64{0, 1, 6, 7}},
+		{"i != 0 and i <= 2", []int64{1, 2}},
+	}
+
+	for _, tt := range tests {
+		q, err := parseQuery("x[" + tt.filter + "]")
+		if err != nil {
+			t.Errorf("parseQuery(%q): unexpected error: %v", tt.filter, err)
+			continue
+		}
+
+		results, err := q.eval([]queryValue{{path: "$", v: root}})
+		if err != nil {
+			t.Errorf("%q: unexpected error: %v", tt.filter, err)
+			continue
+		}
+
+		var got []int64
+		for _, r := range results {
+			got = append(got, r.v.(map[string]interface{})["i"].(int64))
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%q selected %v, want %v", tt.filter, got, tt.want)
+		}
+	}
+}
+
+func TestQueryEval(t *testing.T) {
+	root := map[string]interface{}{
+		"packages": []interface{}{
+			map[string]interface{}{
+				"name": "main",
+				"source_files": []interface{}{
+					map[string]interface{}{
+						"path":      "main.go",
+						"functions": []interface{}{map[string]interface{}{"name": "main"}},
+					},
+					map[string]interface{}{"path": "util.go"},
+				},
+			},
+			map[string]interface{}{"name": "lib", "doc": nil},
+		},
+	}
+
+	tests := []struct {
+		query string
+		paths []string
+	}{
+		{"packages.name", []string{"$.packages[0].name", "$.packages[1].name"}},
+		{`packages[name = "lib"]`, []string{"$.packages[1]"}},
+		{`packages[name ~ "^m"].source_files.path`, []string{
+			"$.packages[0].source_files[0].path",
+			"$.packages[0].source_files[1].path",
+		}},
+		{"packages.source_files[functions]", []string{"$.packages[0].source_files[0]"}},
+		{"packages[#source_files = 2]", []string{"$.packages[0]"}},
+		{"packages[doc]", nil},
+		{"packages[source_files.functions.name = \"main\"].name", []string{"$.packages[0].name"}},
+		{"packages[source_files = source_files]", []string{"$.packages[0]"}},
+		{"packages.source_files[functions = functions].path", []string{"$.packages[0].source_files[0].path"}},
+		{"packages.source_files[functions != functions]", nil},
+		{"packages.source_files[functions != path].path", []string{"$.packages[0].source_files[0].path"}},
+		{"packages.*", []string{
+			"$.packages[0].name",
+			"$.packages[0].source_files[0]",
+			"$.packages[0].source_files[1]",
+			"$.packages[1].doc",
+			"$.packages[1].name",
+		}},
+	}
+
+	for _, tt := range tests {
+		q, err := parseQuery(tt.query)
+		if err != nil {
+			t.Errorf("parseQuery(%q): unexpected error: %v", tt.query, err)
+			continue
+		}
+
+		results, err := q.eval([]queryValue{{path: "$", v: root}})
+		if err != nil {
+			t.Errorf("%q: unexpected error: %v", tt.query, err)
+			continue
+		}
+
+		var paths []string
+		for _, r := range results {
+			paths = append(paths, r.path)
+		}
+		if !reflect.DeepEqual(paths, tt.paths) {
+			t.Errorf("%q selected %q, want %q", tt.query, paths, tt.paths)
+		}
+	}
+}
+
+func TestParseQueryErrors(t *testing.T) {
+	tests := []struct {
+		query string
+		err   string
+	}{
+		{"", "empty query"},
+		{"   ", "empty query"},
+		{"packages.", "expected field name, found ''"},
+		{".packages", "expected field name, found '.'"},
+		{"packages..name", "expected field name, found '.'"},
+		{"and", "expected field name, found 'and'"},
+		{"1", "expected field name, found '1'"},
+		{"packages name", "unexpected 'name'"},
+		{"packages]", "unexpected ']'"},
+		{"packages[", "unexpected end of query"},
+		{"packages[]", "unexpected ']'"},
+		{"packages[name = ]", "unexpected ']'"},
+		{"packages[name = 1", "expected ']', found end of query"},
+		{"packages[(name = 1]", "expected ')', found ']'"},
+		{"packages[name = 1 and]", "unexpected ']'"},
+		{"packages[name = 1 or or]", "unexpected 'or'"},
+		{"packages[name = 1.2.3]", "invalid number 1.2.3"},
+		{"packages[name ~ 1]", "the ~ operator expects a string pattern"},
+		{"packages[name ~ path]", "the ~ operator expects a string pattern"},
+		{`packages[name ~ "("]`, `invalid pattern "("`},
+		{"packages[@loc > 1]", "unknown attribute '@loc'"},
+		{"packages[# > 1]", "expected field name, found '>'"},
+		{"packages[source_files. = 1]", "expected field name, found '='"},
+		{`packages[name = "\q"]`, `invalid string "\q"`},
+		{`packages[name = "a"`, "expected ']', found end of query"},
+	}
+
+	for _, tt := range tests {
+		_, err := parseQuery(tt.query)
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("parseQuery(%q): error %v, want %q", tt.query, err, tt.err)
+		}
+	}
+}
@@ -0,0 +1,103 @@
+// Copyright 2014-2015 The DevMine authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/codegangsta/cli"
+
+	"github.com/DevMine/srctool/log"
+)
+
+// Parser statuses reported in JSON mode.
+const (
+	statusInstalled        = "installed"
+	statusAvailable        = "available"
+	statusOutdated         = "outdated"
+	statusAlreadyInstalled = "already_installed"
+	statusUpdated          = "updated"
+	statusUpToDate         = "up_to_date"
+	statusDeleted          = "removed"
+	statusDryRun           = "dry_run"
+	statusFailed           = "failed"
+)
+
+// jsonOutput tells whether the results must be printed in JSON, as
+// requested by the global "json" option.
+func jsonOutput(c *cli.Context) bool {
+	return c.GlobalBool("json")
+}
+
+// printJSON prints v into stdout in JSON.
+func printJSON(v interface{}) {
+	bs, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		log.Debug(err)
+		fatal("unable to marshal the results")
+	}
+	fmt.Println(string(bs))
+}
+
+// jsonError is the JSON representation of an error.
+type jsonError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+
+	kind errorKind
+}
+
+// newJSONError returns the JSON representation of err.
+func newJSONError(err error) *jsonError {
+	ce := classify(err)
+	return &jsonError{Code: ce.Code(), Message: ce.Error(), kind: ce.kind}
+}
+
+// parserStatus describes a parser in the JSON output of the list command.
+type parserStatus struct {
+	Name     string `json:"name"`
+	Language string `json:"language"`
+	Version  string `json:"version,omitempty"` // MD5 sum of the archive
+	Status   string `json:"status"`
+}
+
+// parserOutcome is the outcome of an operation on a parser, in the JSON
+// output of the install, update and delete commands.
+type parserOutcome struct {
+	Parser  string     `json:"parser"`
+	Status  string     `json:"status"`
+	Version string     `json:"version,omitempty"`
+	Path    string     `json:"path,omitempty"`
+	Error   *jsonError `json:"error,omitempty"`
+}
+
+// failedOutcome returns the outcome of an operation that failed with err.
+func failedOutcome(parserName string, err error) parserOutcome {
+	return parserOutcome{Parser: parserName, Status: statusFailed, Error: newJSONError(err)}
+}
+
+// reportOutcomes prints the outcomes of the operations of a command in JSON
+// as {"results": [...]} if requested, the failures being already logged. If an
+// operation failed, the program then exits with the exit code of the first
+// failure.
+func reportOutcomes(c *cli.Context, outs []parserOutcome) {
+	if jsonOutput(c) {
+		if outs == nil {
+			outs = []parserOutcome{}
+		}
+		printJSON(struct {
+			Results []parserOutcome `json:"results"`
+		}{outs})
+	}
+
+	for _, out := range outs {
+		if out.Error != nil {
+			unlockParsers()
+			os.Exit(int(out.Error.kind))
+		}
+	}
+}
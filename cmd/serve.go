@@ -0,0 +1,396 @@
+// Copyright 2014-2015 The DevMine authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cmd
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+
+	"github.com/codegangsta/cli"
+
+	"github.com/DevMine/srctool/log"
+	"github.com/DevMine/srctool/manager"
+)
+
+// maxUploadSize is the maximum size of an uploaded project archive.
+const maxUploadSize = 1 << 30
+
+// Serve command starts an HTTP server exposing the parsing as a REST API.
+// Parse jobs are submitted as an uploaded tarball or, if the "root" option is
+// set, for a local path under the root directory. They are run by a pool of
+// workers whose size is given by the "workers" option, and persisted into the
+// data directory so that queued jobs survive a restart.
+func Serve(c *cli.Context) {
+	workers := c.Int("workers")
+	if workers <= 0 {
+		fatal("the number of workers must be positive")
+	}
+
+	var root string
+	if len(c.String("root")) > 0 {
+		var err error
+		if root, err = resolveRoot(c.String("root")); err != nil {
+			fatal(err)
+		}
+	}
+
+	cfg, err := loadConfig(c, ".")
+	if err != nil {
+		fatal(err)
+	}
+
+	js, err := openJobStore(cfg.JobsDir())
+	if err != nil {
+		fatal(err)
+	}
+
+	// parser servers are shared by all jobs and run until the server stops,
+	// so the parsers must not change in the meantime
+	m := newManager(c, cfg)
+	if err = lockParsers(c, cfg, false); err != nil {
+		fatal(err)
+	}
+	opts := manager.ParseOptions{Servers: manager.NewServerPool("")}
+
+	for i := 0; i < workers; i++ {
+		go js.work(m, opts)
+	}
+
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	go func() {
+		<-interrupt
+		log.Info("shutting down, running jobs will be run again on restart")
+		js.close()
+		opts.Servers.Close()
+		unlockParsers()
+		os.Exit(0)
+	}()
+
+	api := &jobAPI{store: js, manager: m, root: root}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/parsers", api.handleParsers)
+	mux.HandleFunc("/jobs", api.handleJobs)
+	mux.HandleFunc("/jobs/", api.handleJob)
+
+	addr := c.String("listen")
+	log.Info("listening on ", addr)
+	if err = http.ListenAndServe(addr, mux); err != nil {
+		log.Debug(err)
+		fatal("unable to listen on ", addr)
+	}
+}
+
+// jobAPI serves the REST API of the HTTP server.
+type jobAPI struct {
+	store   *jobStore
+	manager *manager.Manager
+	root    string // directory holding the local paths, empty if not allowed
+}
+
+// parserInfo describes an installed parser.
+type parserInfo struct {
+	Name       string   `json:"name"`
+	Language   string   `json:"language"`
+	Extensions []string `json:"extensions,omitempty"`
+	Server     bool     `json:"server"`
+	FileList   bool     `json:"file_list"`
+}
+
+// handleParsers lists the installed parsers.
+//
+//	GET /parsers
+func (api *jobAPI) handleParsers(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		writeHTTPError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	parsers, err := api.manager.List()
+	if err != nil {
+		writeHTTPError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	infos := make([]parserInfo, 0, len(parsers))
+	for _, p := range parsers {
+		infos = append(infos, parserInfo{
+			Name:       p.Name,
+			Language:   p.Language(),
+			Extensions: p.Extensions(),
+			Server:     p.Meta.Server,
+			FileList:   p.Meta.FileList,
+		})
+	}
+	writeHTTPJSON(w, http.StatusOK, infos)
+}
+
+// handleJobs lists the jobs or submits a new one.
+//
+//	GET /jobs
+//	POST /jobs  {"path": "/path/to/project", "on_conflict": "keep"}
+//	POST /jobs?on_conflict=keep  with a tar or tar.gz archive as body
+func (api *jobAPI) handleJobs(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		writeHTTPJSON(w, http.StatusOK, api.store.list())
+	case "POST":
+		api.submit(w, r)
+	default:
+		writeHTTPError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+// submit creates a job from a JSON request or an uploaded archive.
+func (api *jobAPI) submit(w http.ResponseWriter, r *http.Request) {
+	id, err := newJobID()
+	if err != nil {
+		log.Debug(err)
+		writeHTTPError(w, http.StatusInternalServerError, "unable to create a job")
+		return
+	}
+
+	job := &Job{ID: id}
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+		var req struct {
+			Path       string `json:"path"`
+			OnConflict string `json:"on_conflict"`
+		}
+		if err = json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeHTTPError(w, http.StatusBadRequest, "malformed request: "+err.Error())
+			return
+		}
+		job.OnConflict = req.OnConflict
+
+		if len(req.Path) == 0 {
+			writeHTTPError(w, http.StatusBadRequest, "missing project path")
+			return
+		}
+		if job.Path, err = api.localPath(req.Path); err != nil {
+			writeHTTPError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+	} else {
+		job.Upload = true
+		job.OnConflict = r.URL.Query().Get("on_conflict")
+
+		dir := api.store.projectDir(id)
+		if err = extractTarball(http.MaxBytesReader(w, r.Body, maxUploadSize), dir); err != nil {
+			os.RemoveAll(api.store.jobDir(id))
+			writeHTTPError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+
+	if len(job.OnConflict) == 0 {
+		job.OnConflict = manager.MergeKeep
+	}
+	if _, err = manager.ParseMergeStrategy(job.OnConflict); err != nil {
+		os.RemoveAll(api.store.jobDir(id))
+		writeHTTPError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if err = api.store.add(job); err != nil {
+		os.RemoveAll(api.store.jobDir(id))
+		writeHTTPError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	created, _ := api.store.get(id)
+	w.Header().Set("Location", "/jobs/"+id)
+	writeHTTPJSON(w, http.StatusCreated, created)
+}
+
+// localPath returns the project directory at path, which must be under the
+// root directory. Relative paths are relative to the root directory.
+func (api *jobAPI) localPath(path string) (string, error) {
+	if len(api.root) == 0 {
+		return "", errors.New("local paths are not accepted by this server, upload an archive of the project instead")
+	}
+
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(api.root, path)
+	}
+	resolved, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return "", fmt.Errorf("%s is not a directory", path)
+	}
+	if !isUnder(resolved, api.root) {
+		return "", fmt.Errorf("%s is not under the root directory of the server", path)
+	}
+	if fi, err := os.Stat(resolved); err != nil || !fi.IsDir() {
+		return "", fmt.Errorf("%s is not a directory", path)
+	}
+	return resolved, nil
+}
+
+// resolveRoot returns the absolute path of the root directory, symbolic links
+// resolved.
+func resolveRoot(root string) (string, error) {
+	abs, err := filepath.Abs(root)
+	if err != nil {
+		return "", err
+	}
+	if abs, err = filepath.EvalSymlinks(abs); err != nil {
+		return "", err
+	}
+	if fi, err := os.Stat(abs); err != nil || !fi.IsDir() {
+		return "", fmt.Errorf("root %s is not a directory", root)
+	}
+	return abs, nil
+}
+
+// isUnder tells whether path is dir or one of its descendants, both paths
+// being absolute and clean.
+func isUnder(path, dir string) bool {
+	rel, err := filepath.Rel(dir, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// handleJob serves a job, its result or deletes it.
+//
+//	GET /jobs/<id>
+//	GET /jobs/<id>/result
+//	DELETE /jobs/<id>
+func (api *jobAPI) handleJob(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/jobs/"), "/"), "/")
+	id := parts[0]
+
+	job, err := api.store.get(id)
+	if err != nil {
+		writeHTTPError(w, http.StatusNotFound, err.Error())
+		return
+	}
+
+	switch {
+	case len(parts) == 1 && r.Method == "GET":
+		writeHTTPJSON(w, http.StatusOK, job)
+	case len(parts) == 1 && r.Method == "DELETE":
+		if err = api.store.remove(id); err != nil {
+			writeHTTPError(w, http.StatusConflict, err.Error())
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case len(parts) == 2 && parts[1] == "result" && r.Method == "GET":
+		if job.State != jobDone {
+			writeHTTPError(w, http.StatusConflict, "job is "+job.State)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		http.ServeFile(w, r, api.store.resultPath(id))
+	case len(parts) <= 2:
+		writeHTTPError(w, http.StatusMethodNotAllowed, "method not allowed")
+	default:
+		writeHTTPError(w, http.StatusNotFound, "not found")
+	}
+}
+
+// writeHTTPJSON writes v in JSON with the given status code.
+func writeHTTPJSON(w http.ResponseWriter, status int, v interface{}) {
+	bs, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		log.Debug(err)
+		status, bs = http.StatusInternalServerError, []byte(`{"error": "unable to marshal the response"}`)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(bs)
+	w.Write([]byte("\n"))
+}
+
+// writeHTTPError writes an error message in JSON with the given status code.
+func writeHTTPError(w http.ResponseWriter, status int, msg string) {
+	writeHTTPJSON(w, status, map[string]string{"error": msg})
+}
+
+// extractTarball extracts a tar archive, possibly gzip compressed, into dir.
+// Only directories and regular files are extracted. Entries escaping dir are
+// rejected.
+func extractTarball(r io.Reader, dir string) error {
+	br := bufio.NewReader(r)
+
+	var tr *tar.Reader
+	if magic, err := br.Peek(2); err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		gr, err := gzip.NewReader(br)
+		if err != nil {
+			log.Debug(err)
+			return errors.New("malformed gzip archive")
+		}
+		defer gr.Close()
+		tr = tar.NewReader(gr)
+	} else {
+		tr = tar.NewReader(br)
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		log.Debug(err)
+		return errors.New("unable to create the project directory")
+	}
+
+	for n := 0; ; n++ {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			if n == 0 {
+				return errors.New("empty archive")
+			}
+			return nil
+		}
+		if err != nil {
+			log.Debug(err)
+			return errors.New("malformed tar archive")
+		}
+
+		name := filepath.Clean(filepath.FromSlash(hdr.Name))
+		if filepath.IsAbs(name) || name == ".." || strings.HasPrefix(name, ".."+string(filepath.Separator)) {
+			return fmt.Errorf("invalid path in archive: %s", hdr.Name)
+		}
+		path := filepath.Join(dir, name)
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err = os.MkdirAll(path, 0755); err != nil {
+				log.Debug(err)
+				return errors.New("unable to extract the archive")
+			}
+		case tar.TypeReg, tar.TypeRegA:
+			if err = extractFile(tr, path, os.FileMode(hdr.Mode).Perm()); err != nil {
+				log.Debug(err)
+				return errors.New("unable to extract the archive")
+			}
+		default:
+			log.Debug("skipping ", hdr.Name, " of type ", hdr.Typeflag)
+		}
+	}
+}
+
+// extractFile copies the content of r into a new file.
+func extractFile(r io.Reader, path string, perm os.FileMode) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm|0600)
+	if err != nil {
+		return err
+	}
+
+	if _, err = io.Copy(f, r); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,171 @@
+// Copyright 2014-2015 The DevMine authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"text/tabwriter"
+
+	"github.com/DevMine/srcanlzr/src"
+	"github.com/codegangsta/cli"
+
+	"github.com/DevMine/srctool/log"
+	"github.com/DevMine/srctool/manager"
+)
+
+// Stats command prints a summary of a project: per language file counts,
+// lines of code and counts of functions, types and packages.
+// It expects one argument: either a project directory, that is parsed first,
+// or a saved parse result.
+func Stats(c *cli.Context) {
+	if len(c.Args()) != 1 {
+		fatal("expected 1 argument, found ", len(c.Args()))
+	}
+
+	prj, err := loadProject(c, c.Args().First())
+	if err != nil {
+		fatal(err)
+	}
+
+	st, err := computeStats(prj)
+	if err != nil {
+		fatal(err)
+	}
+
+	if c.Bool("json") || jsonOutput(c) {
+		bs, err := json.MarshalIndent(st, "", "  ")
+		if err != nil {
+			log.Debug(err)
+			fatal("unable to marshal the statistics")
+		}
+		fmt.Println(string(bs))
+		return
+	}
+
+	st.print()
+}
+
+// loadProject returns the project at path. If path is a directory, the
+// project is parsed with all installed parsers, otherwise path is expected to
+// be a saved parse result.
+func loadProject(c *cli.Context, path string) (*src.Project, error) {
+	if fi, err := os.Stat(path); err == nil && fi.IsDir() {
+		cfg, err := loadConfig(c, path)
+		if err != nil {
+			return nil, err
+		}
+		if err = lockParsers(c, cfg, false); err != nil {
+			return nil, err
+		}
+		defer unlockParsers()
+		return newManager(c, cfg).Parse(context.Background(), path, manager.ParseOptions{})
+	}
+	return decodeProjectFile(path)
+}
+
+// counts holds the headline numbers of a set of source files.
+type counts struct {
+	Packages  int   `json:"packages"`
+	Files     int   `json:"files"`
+	LoC       int64 `json:"loc"`
+	Functions int   `json:"functions"`
+	Methods   int   `json:"methods"`
+	Types     int   `json:"types"`
+}
+
+// langStats holds the statistics of a language.
+type langStats struct {
+	Language string `json:"language"`
+	counts
+}
+
+// projectStats holds the statistics of a project.
+type projectStats struct {
+	Project string `json:"project"`
+	counts
+	Languages []langStats `json:"languages"`
+}
+
+type byLanguage []langStats
+
+func (ls byLanguage) Len() int           { return len(ls) }
+func (ls byLanguage) Swap(i, j int)      { ls[i], ls[j] = ls[j], ls[i] }
+func (ls byLanguage) Less(i, j int) bool { return ls[i].Language < ls[j].Language }
+
+// computeStats computes the statistics of a project.
+func computeStats(prj *src.Project) (*projectStats, error) {
+	st := &projectStats{Project: prj.Name}
+	langs := make(map[string]*langStats)
+
+	for _, pkg := range prj.Packages {
+		if pkg == nil {
+			continue
+		}
+		st.Packages++
+
+		pkgLangs := make(map[string]struct{})
+		for _, sf := range pkg.SourceFiles {
+			if sf == nil {
+				continue
+			}
+
+			lang := fileLanguage(sf)
+			ls, ok := langs[lang]
+			if !ok {
+				ls = &langStats{Language: lang}
+				langs[lang] = ls
+			}
+			if _, ok := pkgLangs[lang]; !ok {
+				pkgLangs[lang] = struct{}{}
+				ls.Packages++
+			}
+
+			funcs, types, err := fileDecls(sf)
+			if err != nil {
+				return nil, fmt.Errorf("unable to read the declarations of %s: %v", sf.Path, err)
+			}
+
+			methods := 0
+			for _, t := range types {
+				methods += len(t.methods)
+			}
+
+			for _, cs := range []*counts{&st.counts, &ls.counts} {
+				cs.Files++
+				cs.LoC += sf.LoC
+				cs.Functions += len(funcs)
+				cs.Methods += methods
+				cs.Types += len(types)
+			}
+		}
+	}
+
+	for _, ls := range langs {
+		st.Languages = append(st.Languages, *ls)
+	}
+	sort.Sort(byLanguage(st.Languages))
+
+	return st, nil
+}
+
+// print prints the statistics as a table to stdout.
+func (st *projectStats) print() {
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(w, "language\tpackages\tfiles\tloc\tfunctions\tmethods\ttypes\t")
+	for _, ls := range st.Languages {
+		ls.counts.printRow(w, ls.Language)
+	}
+	st.counts.printRow(w, "total")
+	w.Flush()
+}
+
+func (cs counts) printRow(w *tabwriter.Writer, label string) {
+	fmt.Fprintf(w, "%s\t%d\t%d\t%d\t%d\t%d\t%d\t\n",
+		label, cs.Packages, cs.Files, cs.LoC, cs.Functions, cs.Methods, cs.Types)
+}
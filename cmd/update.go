@@ -5,81 +5,64 @@
 package cmd
 
 import (
-	"io/ioutil"
-	"os"
+	"context"
+	"time"
 
 	"github.com/codegangsta/cli"
 
-	"github.com/DevMine/srctool/config"
 	"github.com/DevMine/srctool/log"
+	"github.com/DevMine/srctool/manager"
 )
 
 // Update command updates one or all installed parser(s).
 func Update(c *cli.Context) {
-	cfg, err := config.New()
+	m, err := lockManager(c, true)
 	if err != nil {
-		log.Fatal(err)
+		fatal(err)
 	}
+	defer unlockParsers()
 
+	var outs []parserOutcome
 	if !c.Args().Present() {
-		updateAll(cfg)
+		outs = updateAll(m)
 	} else {
-		updateParser(cfg, genParserName(c.Args().First()))
+		outs = []parserOutcome{updateParser(m, c.Args().First())}
 	}
-}
 
-func updateAll(cfg *config.Config) {
-	parsers := getInstalledParsers()
-	for _, parser := range parsers {
-		updateParser(cfg, genParserName(parser))
-	}
+	reportOutcomes(c, outs)
 }
 
-func updateParser(cfg *config.Config, parserName string) {
-	if !isAlreadyInstalled(parserName) {
-		log.Fail(" parser " + parserName + " not installed, install it first")
-		return
-	}
-
-	LocalChecksum, err := ioutil.ReadFile(config.LocalChecksumPath(parserName))
+func updateAll(m *manager.Manager) []parserOutcome {
+	parsers, err := m.List()
 	if err != nil {
-		log.Debug(err)
-		log.Fail("unable to read the MD5 file of the currently installed " + parserName + " parser")
-		return
-	}
-
-	remoteCheckSum, err := fetchChecksum(cfg.DownloadServerURL, parserName)
-	if err != nil {
-		log.Fail(err)
-		return
+		fatal(err)
 	}
 
-	if string(LocalChecksum) == remoteCheckSum {
-		log.Info("latest version of " + parserName + " already installed")
-		return
+	var outs []parserOutcome
+	for _, p := range parsers {
+		outs = append(outs, updateParser(m, p.Name))
 	}
+	return outs
+}
 
-	if err = deleteParser(parserName, false, false); err != nil {
-		log.Fail(err)
-		return
-	}
+func updateParser(m *manager.Manager, lang string) parserOutcome {
+	parserName := manager.ParserName(lang)
 
-	if err = installParser(cfg, parserName, false); err != nil {
+	start := time.Now()
+	updated, err := m.Update(context.Background(), lang)
+	if _, ok := err.(*manager.NotInstalledError); ok {
+		log.Fail("parser " + parserName + " not installed, install it first")
+		return failedOutcome(parserName, err)
+	} else if err != nil {
 		log.Fail(err)
-		return
+		return failedOutcome(parserName, err)
 	}
 
-	log.Success("parser " + parserName + " successfully updated")
-}
-
-func isAlreadyInstalled(parserName string) bool {
-	parserPath := config.ParserPath(parserName)
-	log.Debug("=> ", parserPath)
-
-	if _, err := os.Stat(parserPath); err != nil {
-		log.Debug(err)
-		return false
+	if !updated {
+		log.Info("latest version of " + parserName + " already installed")
+		return parserOutcome{Parser: parserName, Status: statusUpToDate, Version: parserVersion(m, lang)}
 	}
 
-	return true
+	log.Fields{"parser": parserName, "duration": time.Since(start)}.Success("parser " + parserName + " successfully updated")
+	return parserOutcome{Parser: parserName, Status: statusUpdated, Version: parserVersion(m, lang)}
 }
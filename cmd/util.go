@@ -5,278 +5,145 @@
 package cmd
 
 import (
-	"archive/zip"
-	"crypto/md5"
-	"encoding/hex"
-	"errors"
 	"fmt"
-	"io"
-	"io/ioutil"
 	"net/http"
 	"os"
 	"path/filepath"
-	"runtime"
-	"strconv"
 	"strings"
-	"time"
 
+	"github.com/codegangsta/cli"
 	"github.com/mitchellh/ioprogress"
 
 	"github.com/DevMine/srctool/config"
 	"github.com/DevMine/srctool/log"
+	"github.com/DevMine/srctool/manager"
 )
 
-func getRemoteParsers(serverURL string) []string {
-	var remoteParsers []string
-
-	md5sums, err := fetchChecksumsFile(serverURL)
-	if err != nil {
-		log.Fatal(err)
-	}
-
-	for _, line := range strings.Split(md5sums, "\n") {
-		tmp := strings.Split(line, " ")
-		if len(tmp) != 2 {
-			continue
-		}
-
-		path, parser := filepath.Split(tmp[1])
-		if isSupported(path) {
-			remoteParsers = append(remoteParsers, formatParserName(parser))
-		}
-	}
-
-	return remoteParsers
-}
-
-func getInstalledParsers() []string {
-	var installedParsers []string
-
-	fis, err := ioutil.ReadDir(filepath.Join(config.DataDir(), config.ParsersFolder))
-	if err != nil {
-		log.Fatal(err)
+// newManager creates the parser manager of the commands, configured by cfg.
+// The download progress is printed on stdout, unless the results are printed
+// in JSON.
+func newManager(c *cli.Context, cfg *config.Config) *manager.Manager {
+	opts := manager.Options{
+		ParsersDir: cfg.ParsersDir(),
+		TempDir:    cfg.CacheDir(),
+		ServerURL:  cfg.DownloadServerURL,
+		HTTPClient: &http.Client{Timeout: cfg.DownloadTimeout},
 	}
-
-	for _, fi := range fis {
-		if !fi.IsDir() {
-			continue
-		}
-
-		if marched, err := filepath.Match("parser-*", fi.Name()); err != nil {
-			log.Debug(err)
-			continue
-		} else if !marched {
-			continue
-		}
-
-		installedParsers = append(installedParsers, formatParserName(fi.Name()))
+	if !jsonOutput(c) {
+		opts.Progress = printProgress
 	}
-
-	return installedParsers
-}
-
-// isSupported checks whether the current OS and architecture are supported.
-func isSupported(path string) bool {
-	suppPath := filepath.Join(runtime.GOOS, runtime.GOARCH) + string(filepath.Separator)
-	return path == suppPath
-}
-
-func formatParserName(fileName string) string {
-	return strings.Replace(removeExt(fileName), "parser-", "", -1)
-}
-
-func genParserName(lang string) string {
-	return fmt.Sprintf("parser-%s", lang)
+	return manager.New(opts)
 }
 
-// removeExt removes the extension of a given file name.
-func removeExt(fileName string) string {
-	ext := filepath.Ext(fileName)
-	return fileName[0 : len(fileName)-len(ext)]
-}
-
-func downloadParser(serverURL, parserName string, verbose bool) error {
-	resp, err := http.Get(config.ParserURI(serverURL, parserName))
+// loadConfig reads the configuration, the project configuration file being
+// looked up from dir, and applies the values given by the global "set"
+// options, as key=value.
+func loadConfig(c *cli.Context, dir string) (*config.Config, error) {
+	flags, err := setFlags(c)
 	if err != nil {
-		log.Debug(err)
-		return errors.New("failed to download " + parserName)
+		return nil, err
 	}
-	defer resp.Body.Close()
 
-	contentLen := resp.Header.Get("Content-Length")
-	size, err := strconv.ParseInt(contentLen, 10, 64)
+	cfg, err := config.Load(dir, flags)
 	if err != nil {
-		log.Debug(err)
-		return errors.New("malformed or missing Content-Length header")
-	}
-
-	out, err := os.Create(config.TempPath(parserName))
-	if err != nil {
-		return err
-	}
-	defer out.Close()
-
-	progressR := &ioprogress.Reader{
-		Reader:       resp.Body,
-		Size:         size,
-		DrawInterval: time.Millisecond,
-		DrawFunc: func(progress, total int64) error {
-			if progress == total {
-				// Small hack to make sure that the progress text is up to date
-				// at the end of the download.
-				fmt.Printf("\rDownloading: %s%10s", ioprogress.DrawTextFormatBytes(size, size), "")
-				return nil
-			}
-
-			fmt.Printf("\rDownloading: %s%10s", ioprogress.DrawTextFormatBytes(progress, total), "")
-
-			return nil
-		},
+		return nil, configError(err)
 	}
+	return cfg, nil
+}
 
-	if _, err = io.Copy(out, progressR); err != nil {
-		log.Debug(err)
-		return errors.New("failed to download " + parserName)
+// setFlags returns the configuration values given by the global "set" and
+// "data-dir" options, by key.
+func setFlags(c *cli.Context) (map[string]string, error) {
+	flags := make(map[string]string)
+	for _, kv := range c.GlobalStringSlice("set") {
+		i := strings.Index(kv, "=")
+		if i < 0 {
+			return nil, configError(fmt.Errorf("invalid --set option %q, expected key=value", kv))
+		}
+		flags[kv[:i]] = kv[i+1:]
 	}
 
-	fmt.Println()
-	if verbose {
-		log.Success(parserName, " successfully downloaded")
+	if dir := c.GlobalString("data-dir"); len(dir) > 0 {
+		abs, err := filepath.Abs(dir)
+		if err != nil {
+			return nil, configError(err)
+		}
+		flags["data_dir"] = abs
 	}
+	return flags, nil
+}
 
-	expectedSum, err := fetchChecksum(serverURL, parserName)
+// OpenLogFile makes the log package also write into the log file of the
+// data directory, as configured for the working directory.
+func OpenLogFile(c *cli.Context) error {
+	flags, err := setFlags(c)
 	if err != nil {
 		return err
 	}
 
-	if ok, err := verifyChecksum(config.TempPath(parserName), expectedSum); err != nil {
+	dir := config.Resolve(".", flags).DataDir()
+	if err = os.MkdirAll(dir, 0755); err != nil {
 		return err
-	} else if !ok {
-		return errors.New("MD5 sum mismatch")
 	}
+	return log.OpenFile(filepath.Join(dir, config.LogFileName))
+}
 
-	if verbose {
-		log.Success("MD5 sum verified")
+// loadManager reads the configuration and creates the parser manager of the
+// commands.
+func loadManager(c *cli.Context) (*manager.Manager, error) {
+	cfg, err := loadConfig(c, ".")
+	if err != nil {
+		return nil, err
 	}
-	return nil
+	return newManager(c, cfg), nil
 }
 
-func uncompressParser(parserName, target string) error {
-	if _, err := os.Stat(filepath.Join(target, parserName)); os.IsExist(err) {
-		return errors.New(parserName + " already installed, if you want to update it, use the 'update' command")
-	}
+// parsersLock is the lock of the parsers directory held by the command, if
+// any.
+var parsersLock *config.Lock
 
-	r, err := zip.OpenReader(config.TempPath(parserName))
+// lockParsers locks the parsers directory of cfg until unlockParsers is
+// called: exclusively for the commands changing the parsers, in shared mode
+// for the ones running them.
+func lockParsers(c *cli.Context, cfg *config.Config, exclusive bool) error {
+	l, err := cfg.LockParsers(c.Command.Name, exclusive)
 	if err != nil {
 		return err
 	}
-	defer r.Close()
-
-	for _, f := range r.File {
-		rc, err := f.Open()
-		if err != nil {
-			return err
-		}
-
-		path := filepath.Join(target, f.Name)
-
-		// create target file or directory
-		if f.FileInfo().IsDir() {
-			if err := os.Mkdir(path, f.Mode()); err != nil {
-				return err
-			}
-			continue
-		}
-
-		out, err := os.Create(path)
-		if err != nil {
-			return err
-		}
-
-		if err = out.Chmod(f.Mode()); err != nil {
-			return err
-		}
-
-		// unzip file content
-		if _, err = io.Copy(out, rc); err != nil {
-			return err
-		}
-		rc.Close()
-	}
-
+	parsersLock = l
 	return nil
 }
 
-func deleteParserTarball(parserName string) error {
-	return os.Remove(config.TempPath(parserName))
-}
-
-func fetchChecksumsFile(serverURL string) (string, error) {
-	resp, err := http.Get(config.RemoteChecksumsPath(serverURL))
-	if err != nil {
-		log.Debug(err)
-		return "", errors.New("failed to fetch the MD5SUMS file")
+// unlockParsers releases the lock of the parsers directory, if any. It must be
+// called before exiting, otherwise the next commands would take the command
+// for crashed.
+func unlockParsers() {
+	if parsersLock == nil {
+		return
 	}
-	defer resp.Body.Close()
-
-	bs, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
+	if err := parsersLock.Unlock(); err != nil {
 		log.Debug(err)
-		return "", errors.New("failed to download MD5SUMS file")
 	}
-
-	return string(bs), nil
+	parsersLock = nil
 }
 
-func fetchChecksum(serverURL, parserName string) (string, error) {
-	checksums, err := fetchChecksumsFile(serverURL)
+// lockManager is like loadManager, but it also locks the parsers directory
+// as lockParsers.
+func lockManager(c *cli.Context, exclusive bool) (*manager.Manager, error) {
+	cfg, err := loadConfig(c, ".")
 	if err != nil {
-		return "", err
+		return nil, err
 	}
-
-	for _, line := range strings.Split(checksums, "\n") {
-		tmp := strings.Split(line, " ")
-		if len(tmp) != 2 {
-			return "", errors.New("malformed MD5SUMS file")
-		}
-
-		sum, remotePath := tmp[0], tmp[1]
-
-		if remotePath == config.RemoteParserPath(parserName) {
-			return sum, nil
-		}
+	if err = lockParsers(c, cfg, exclusive); err != nil {
+		return nil, err
 	}
-
-	return "", fmt.Errorf("no MD5 sum found for file %s", parserName)
+	return newManager(c, cfg), nil
 }
 
-// verifyChecksum verifies the checksum of a given file.
-func verifyChecksum(path, expectedSum string) (bool, error) {
-	md5sum, err := checksum(path)
-	if err != nil {
-		return false, err
+// printProgress prints the progress of the download of a parser.
+func printProgress(parserName string, done, total int64) {
+	fmt.Printf("\rDownloading: %s%10s", ioprogress.DrawTextFormatBytes(done, total), "")
+	if done == total {
+		fmt.Println()
 	}
-
-	log.Debug("expected MD5 sum:", expectedSum)
-	log.Debug("MD5 sum found:", md5sum)
-
-	return expectedSum == md5sum, nil
-}
-
-// checksum computes the MD5 checksum.
-func checksum(path string) (string, error) {
-	f, err := os.Open(path)
-	if err != nil {
-		log.Debug(err)
-		return "", errors.New("cannot open file")
-	}
-	defer f.Close()
-
-	h := md5.New()
-	if _, err := io.Copy(h, f); err != nil {
-		log.Debug(err)
-		return "", fmt.Errorf("failed to compute MD5 sum of %s", path)
-	}
-
-	return hex.EncodeToString(h.Sum(nil)), nil
 }
@@ -0,0 +1,308 @@
+// Copyright 2014-2015 The DevMine authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cmd
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+
+	"github.com/DevMine/srcanlzr/src"
+	"github.com/codegangsta/cli"
+	"github.com/ugorji/go/codec"
+
+	"github.com/DevMine/srctool/log"
+	"github.com/DevMine/srctool/manager"
+)
+
+// Validate command checks that saved parse results are valid projects.
+// It expects one or more files as arguments, "-" meaning stdin, in any of the
+// output formats.
+func Validate(c *cli.Context) {
+	if !c.Args().Present() {
+		fatal("expected at least 1 argument, found 0")
+	}
+
+	var files []validation
+	invalid := 0
+	for _, path := range c.Args() {
+		if _, err := readProjects(path); err != nil {
+			log.Fail(path, ": ", err)
+			files = append(files, validation{Path: path, Error: newJSONError(err)})
+			invalid++
+			continue
+		}
+		log.Success(path, " is valid")
+		files = append(files, validation{Path: path, Valid: true})
+	}
+
+	if jsonOutput(c) {
+		printJSON(struct {
+			Files []validation `json:"files"`
+		}{files})
+		if invalid > 0 {
+			os.Exit(int(errIntegrity))
+		}
+		return
+	}
+
+	if invalid > 0 {
+		fatal(&cmdError{kind: errIntegrity, err: fmt.Errorf("%d invalid file(s)", invalid)})
+	}
+}
+
+// validation is the result of the validation of a file, in the JSON output of
+// the validate command.
+type validation struct {
+	Path  string     `json:"path"`
+	Valid bool       `json:"valid"`
+	Error *jsonError `json:"error,omitempty"`
+}
+
+// decodeProjects validates and decodes a stream of JSON encoded projects.
+// Projects may be separated by whitespaces, as in JSON Lines. The stream may
+// also hold the records of the jsonl output format, from which the projects
+// are rebuilt.
+func decodeProjects(r io.Reader) ([]*src.Project, error) {
+	var prjs []*src.Project
+	var jp *jsonlProject // project being rebuilt from jsonl records
+
+	// addProject validates and decodes a JSON encoded project
+	addProject := func(bs []byte) error {
+		prj, err := manager.DecodeProject(bytes.NewReader(bs))
+		if err != nil {
+			return fmt.Errorf("project #%d: %v", len(prjs)+1, err)
+		}
+		prjs = append(prjs, prj)
+		return nil
+	}
+
+	// flush adds the project rebuilt from jsonl records, if any
+	flush := func() error {
+		if jp == nil {
+			return nil
+		}
+		bs, err := jp.project()
+		jp = nil
+		if err != nil {
+			return fmt.Errorf("project #%d: %v", len(prjs)+1, err)
+		}
+		return addProject(bs)
+	}
+
+	dec := json.NewDecoder(r)
+	for i := 1; ; i++ {
+		var raw json.RawMessage
+		if err := dec.Decode(&raw); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("value #%d: malformed JSON: %v", i, err)
+		}
+
+		kind, rec, err := jsonlRecord(raw)
+		if err != nil {
+			return nil, fmt.Errorf("value #%d: %v", i, err)
+		}
+
+		switch kind {
+		case "":
+			if jp != nil {
+				return nil, fmt.Errorf("value #%d: expected a jsonl record, found a project", i)
+			}
+			err = addProject(raw)
+		case "project":
+			if err = flush(); err == nil {
+				jp = &jsonlProject{fields: rec, files: make(map[string][]json.RawMessage)}
+			}
+		default:
+			if jp == nil {
+				return nil, fmt.Errorf("value #%d: %s record found before the project record", i, kind)
+			}
+			err = jp.add(kind, rec)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if err := flush(); err != nil {
+		return nil, err
+	}
+
+	if len(prjs) == 0 {
+		return nil, errors.New("no project found")
+	}
+	return prjs, nil
+}
+
+// jsonlRecord returns the kind and the fields of a jsonl record, or an empty
+// kind if raw is not a record.
+func jsonlRecord(raw json.RawMessage) (string, map[string]json.RawMessage, error) {
+	var rec map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &rec); err != nil {
+		return "", nil, errors.New("expected a JSON object")
+	}
+
+	kindRaw, ok := rec["record"]
+	if !ok {
+		return "", nil, nil
+	}
+	var kind string
+	if err := json.Unmarshal(kindRaw, &kind); err != nil || len(kind) == 0 {
+		return "", nil, errors.New("malformed record kind")
+	}
+	delete(rec, "record")
+	return kind, rec, nil
+}
+
+// jsonlProject is a project being rebuilt from the records written by
+// encodeJSONL.
+type jsonlProject struct {
+	fields   map[string]json.RawMessage   // project record
+	packages []map[string]json.RawMessage // package records, in order
+	files    map[string][]json.RawMessage // source files by package path
+}
+
+// add adds a package, file or extra section record. Extra sections, such as
+// the diagnostics, are not part of the project and are skipped.
+func (jp *jsonlProject) add(kind string, rec map[string]json.RawMessage) error {
+	switch kind {
+	case "package":
+		jp.packages = append(jp.packages, rec)
+	case "file":
+		var pkg string
+		if err := json.Unmarshal(rec["package"], &pkg); err != nil {
+			return errors.New("file record without package path")
+		}
+		delete(rec, "package")
+
+		bs, err := json.Marshal(rec)
+		if err != nil {
+			return err
+		}
+		jp.files[pkg] = append(jp.files[pkg], bs)
+	default:
+		log.Debug("skipping the ", kind, " record")
+	}
+	return nil
+}
+
+// project returns the JSON encoded project.
+func (jp *jsonlProject) project() ([]byte, error) {
+	pkgs := make([]json.RawMessage, 0, len(jp.packages))
+	for _, rec := range jp.packages {
+		var path string
+		if err := json.Unmarshal(rec["path"], &path); err != nil {
+			return nil, errors.New("package record without path")
+		}
+
+		if files, ok := jp.files[path]; ok {
+			bs, err := json.Marshal(files)
+			if err != nil {
+				return nil, err
+			}
+			rec["source_files"] = bs
+			delete(jp.files, path)
+		}
+
+		bs, err := json.Marshal(rec)
+		if err != nil {
+			return nil, err
+		}
+		pkgs = append(pkgs, bs)
+	}
+
+	for path := range jp.files {
+		return nil, fmt.Errorf("file records found for the unknown package %s", path)
+	}
+
+	bs, err := json.Marshal(pkgs)
+	if err != nil {
+		return nil, err
+	}
+	jp.fields["packages"] = bs
+	return json.Marshal(jp.fields)
+}
+
+// readProjects decodes the projects saved into the file at path, "-" meaning
+// stdin, in any of the output formats.
+func readProjects(path string) ([]*src.Project, error) {
+	var r io.Reader = os.Stdin
+	if path != "-" {
+		f, err := os.Open(path)
+		if err != nil {
+			log.Debug(err)
+			return nil, fmt.Errorf("unable to open %s", path)
+		}
+		defer f.Close()
+		r = f
+	}
+
+	br := bufio.NewReader(r)
+	magic, _ := br.Peek(2)
+	switch {
+	case len(magic) == 2 && magic[0] == 0x1f && magic[1] == 0x8b:
+		gr, err := gzip.NewReader(br)
+		if err != nil {
+			log.Debug(err)
+			return nil, fmt.Errorf("unable to uncompress %s", path)
+		}
+		defer gr.Close()
+		return decodeProjects(gr)
+	case len(magic) > 0 && magic[0] >= 0xa0 && magic[0] <= 0xbf:
+		// CBOR map
+		h := new(codec.CborHandle)
+		h.MapType = reflect.TypeOf(map[string]interface{}(nil))
+		return decodeBinary(br, formatCBOR, h)
+	case len(magic) > 0 && (magic[0] >= 0x80 && magic[0] <= 0x8f || magic[0] == 0xde || magic[0] == 0xdf):
+		// MessagePack map
+		h := new(codec.MsgpackHandle)
+		h.MapType = reflect.TypeOf(map[string]interface{}(nil))
+		h.RawToString = true
+		return decodeBinary(br, formatMsgpack, h)
+	}
+
+	return decodeProjects(br)
+}
+
+// decodeBinary validates and decodes a project encoded by encodeBinary in
+// the given format.
+func decodeBinary(r io.Reader, format string, h codec.Handle) ([]*src.Project, error) {
+	var v interface{}
+	if err := codec.NewDecoder(r, h).Decode(&v); err != nil {
+		return nil, fmt.Errorf("malformed %s: %v", format, err)
+	}
+
+	bs, err := json.Marshal(v)
+	if err != nil {
+		log.Debug(err)
+		return nil, fmt.Errorf("unable to convert the %s into JSON", format)
+	}
+
+	prj, err := manager.DecodeProject(bytes.NewReader(bs))
+	if err != nil {
+		return nil, err
+	}
+	return []*src.Project{prj}, nil
+}
+
+// decodeProjectFile decodes the single project saved into the file at path,
+// "-" meaning stdin.
+func decodeProjectFile(path string) (*src.Project, error) {
+	prjs, err := readProjects(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(prjs) > 1 {
+		return nil, fmt.Errorf("expected a single project, found %d", len(prjs))
+	}
+	return prjs[0], nil
+}
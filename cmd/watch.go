@@ -0,0 +1,258 @@
+// Copyright 2014-2015 The DevMine authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cmd
+
+import (
+	"context"
+	"errors"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/DevMine/srcanlzr/src"
+	"gopkg.in/fsnotify.v1"
+
+	"github.com/DevMine/srctool/log"
+	"github.com/DevMine/srctool/manager"
+)
+
+// defaultDebounce is how long the watch mode waits for the file system to
+// settle down before parsing again.
+const defaultDebounce = 500 * time.Millisecond
+
+// watchOptions holds the options of the watch mode.
+type watchOptions struct {
+	// debounce is how long to wait after the last change before parsing
+	// again.
+	debounce time.Duration
+
+	// ignored lists the files and directories whose changes are ignored,
+	// typically the files written by srctool itself. Empty paths are
+	// skipped.
+	ignored []string
+}
+
+// watchProject parses the project located at projectPath, then watches it and
+// parses it again every time a source file changes, until interrupted. Only
+// the parsers handling the changed files are run again: the outputs of the
+// other ones are reused. Each merged project is passed to emit.
+//
+// Parsing failures do not stop the watch: the previous output of a failed
+// parser is kept until it succeeds again.
+func watchProject(m *manager.Manager, projectPath string, opts manager.ParseOptions, wopts watchOptions, emit func(*src.Project) error) error {
+	root, err := filepath.Abs(projectPath)
+	if err != nil {
+		return err
+	}
+
+	if wopts.debounce <= 0 {
+		wopts.debounce = defaultDebounce
+	}
+
+	var ignored []string
+	for _, path := range wopts.ignored {
+		if len(path) == 0 {
+			continue
+		}
+		if path, err = filepath.Abs(path); err != nil {
+			return err
+		}
+		ignored = append(ignored, path)
+	}
+
+	parsers, err := m.List()
+	if err != nil {
+		return err
+	}
+	if len(parsers) == 0 {
+		return manager.ErrNoParsers
+	}
+	if opts.Diagnostics == nil {
+		opts.Diagnostics = new(manager.Diagnostics)
+	}
+
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		log.Debug(err)
+		return errors.New("unable to watch the project")
+	}
+	defer w.Close()
+
+	if err = watchTree(w, root, ignored); err != nil {
+		return err
+	}
+
+	if opts.Servers == nil {
+		opts.Servers = manager.NewServerPool(opts.LogDir)
+		defer opts.Servers.Close()
+	}
+
+	outputs := make(map[string]manager.Result)
+	reparse := func(parsers []manager.Parser) {
+		for _, p := range parsers {
+			opts.Diagnostics.Reset(p.Name)
+		}
+
+		results, err := manager.Run(context.Background(), root, parsers, opts)
+		if err != nil {
+			log.Fail("some parsers failed, keeping their previous output")
+		}
+		for _, res := range results {
+			outputs[res.Parser] = res
+		}
+
+		if len(outputs) == 0 {
+			log.Fail("no parser output available yet")
+			return
+		}
+
+		prj, err := manager.MergeResults(cachedResults(outputs), opts.Strategy)
+		if err == nil {
+			err = emit(prj)
+		}
+		if err != nil {
+			log.Fail(err)
+			return
+		}
+		log.Success("project parsed, waiting for changes")
+	}
+
+	log.Info("parsing ", projectPath)
+	reparse(parsers)
+
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	defer signal.Stop(interrupt)
+
+	changed := make(map[string]bool)
+	var settled <-chan time.Time
+
+	for {
+		select {
+		case ev := <-w.Events:
+			if isIgnored(ev.Name, root, ignored) {
+				continue
+			}
+			log.Debug("watch: ", ev)
+
+			if ev.Op&fsnotify.Create != 0 {
+				if fi, err := os.Stat(ev.Name); err == nil && fi.IsDir() {
+					if err = watchTree(w, ev.Name, ignored); err != nil {
+						log.Fail(err)
+					}
+				}
+			}
+
+			changed[ev.Name] = ev.Op&(fsnotify.Remove|fsnotify.Rename) != 0
+			settled = time.After(wopts.debounce)
+		case err := <-w.Errors:
+			log.Fail("watch: ", err)
+		case <-settled:
+			settled = nil
+
+			ps := affectedParsers(parsers, changed)
+			changed = make(map[string]bool)
+			if len(ps) == 0 {
+				continue
+			}
+
+			names := make([]string, 0, len(ps))
+			for _, p := range ps {
+				names = append(names, p.Language())
+			}
+			log.Info("changes detected, parsing again with: ", strings.Join(names, ", "))
+			reparse(ps)
+		case <-interrupt:
+			log.Info("stopped watching ", projectPath)
+			return nil
+		}
+	}
+}
+
+// watchTree adds dir and all its subdirectories to the watcher, except the
+// hidden and ignored ones.
+func watchTree(w *fsnotify.Watcher, dir string, ignored []string) error {
+	return filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			// the directory may have been removed in the meantime
+			log.Debug(err)
+			return nil
+		}
+		if !fi.IsDir() {
+			return nil
+		}
+
+		if path != dir && (strings.HasPrefix(fi.Name(), ".") || isIgnored(path, "", ignored)) {
+			return filepath.SkipDir
+		}
+
+		if err := w.Add(path); err != nil {
+			log.Debug(err)
+			return errors.New("unable to watch " + path)
+		}
+		return nil
+	})
+}
+
+// isIgnored tells whether changes of the file at path must be ignored: hidden
+// files, such as editor swap files or the temporary files of srctool, and
+// files inside the ignored paths. Hidden components are only looked for below
+// root.
+func isIgnored(path, root string, ignored []string) bool {
+	for _, ign := range ignored {
+		if path == ign || strings.HasPrefix(path, ign+string(filepath.Separator)) {
+			return true
+		}
+	}
+
+	if len(root) == 0 {
+		return false
+	}
+	rel, err := filepath.Rel(root, path)
+	if err != nil {
+		return false
+	}
+	for _, elem := range strings.Split(rel, string(filepath.Separator)) {
+		if strings.HasPrefix(elem, ".") && elem != "." && elem != ".." {
+			return true
+		}
+	}
+	return false
+}
+
+// affectedParsers returns the parsers that handle at least one of the changed
+// files. A removed or renamed path may be a directory holding files of any
+// language, hence all parsers are affected by it unless it has an extension.
+func affectedParsers(parsers []manager.Parser, changed map[string]bool) []manager.Parser {
+	var ps []manager.Parser
+	for _, p := range parsers {
+		for path, removed := range changed {
+			if p.Handles(path) || (removed && len(filepath.Ext(path)) == 0) {
+				ps = append(ps, p)
+				break
+			}
+		}
+	}
+	return ps
+}
+
+// cachedResults returns the cached outputs of the parsers, sorted by parser
+// name.
+func cachedResults(outputs map[string]manager.Result) []manager.Result {
+	names := make([]string, 0, len(outputs))
+	for name := range outputs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	results := make([]manager.Result, 0, len(names))
+	for _, name := range names {
+		results = append(results, outputs[name])
+	}
+	return results
+}
@@ -0,0 +1,302 @@
+// Copyright 2014-2015 The DevMine authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/codegangsta/cli"
+
+	"github.com/DevMine/srctool/log"
+	"github.com/DevMine/srctool/manager"
+)
+
+// workerRequestTimeout is the timeout of the requests of a worker to the
+// coordinator, except for the upload of the results.
+const workerRequestTimeout = 30 * time.Second
+
+// Worker command pulls parse tasks from a coordinator, given by the
+// "coordinator" option, until all tasks are finished. Before pulling tasks,
+// it installs the parsers of the lockfile of the coordinator, replacing the
+// installed ones whose version differs, and only runs these parsers.
+// While parsing a project, it sends heartbeats to keep its lease. The
+// results are uploaded to the coordinator and failures are reported to it.
+func Worker(c *cli.Context) {
+	base := strings.TrimRight(c.String("coordinator"), "/")
+	if len(base) == 0 {
+		fatal("missing --coordinator option")
+	}
+
+	name := c.String("name")
+	if len(name) == 0 {
+		host, err := os.Hostname()
+		if err != nil {
+			host = "worker"
+		}
+		name = fmt.Sprintf("%s-%d", host, os.Getpid())
+	}
+
+	ms, err := manager.ParseMergeStrategy(c.String("on-conflict"))
+	if err != nil {
+		fatal(err)
+	}
+
+	cfg, err := loadConfig(c, ".")
+	if err != nil {
+		fatal(err)
+	}
+	m := newManager(c, cfg)
+
+	wc := &workerClient{base: base, name: name}
+
+	lf, err := wc.lockfile()
+	if err != nil {
+		fatal(err)
+	}
+	if err = lockLockfileParsers(c, cfg, m, lf); err != nil {
+		fatal(err)
+	}
+	defer unlockParsers()
+
+	opts := manager.ParseOptions{Strategy: ms, Parsers: lf.names(), Servers: manager.NewServerPool("")}
+	defer opts.Servers.Close()
+
+	poll := c.Duration("poll")
+	if poll <= 0 {
+		poll = time.Second
+	}
+
+	log.Info("worker ", name, " pulling tasks from ", base)
+
+	var done, failed int
+	for {
+		l, status, err := wc.lease()
+		if err != nil {
+			log.Fail(err)
+			time.Sleep(poll)
+			continue
+		}
+
+		switch status {
+		case http.StatusGone:
+			log.Success(fmt.Sprintf("all tasks finished, %d done and %d failed by this worker", done, failed))
+			return
+		case http.StatusNoContent:
+			time.Sleep(poll)
+			continue
+		}
+
+		if err = runTask(m, wc, l, opts); err != nil {
+			log.Fail(fmt.Sprintf("task %s (%s): %v", l.Task.ID, l.Task.Project, err))
+			failed++
+			continue
+		}
+		log.Success(fmt.Sprintf("task %s (%s) done", l.Task.ID, l.Task.Project))
+		done++
+	}
+}
+
+// runTask parses the project of a leased task and uploads the result, while
+// sending heartbeats. Failures are reported to the coordinator.
+func runTask(m *manager.Manager, wc *workerClient, l lease, opts manager.ParseOptions) error {
+	log.Info(fmt.Sprintf("parsing %s (task %s, attempt %d)", l.Task.Project, l.Task.ID, l.Task.Attempts))
+
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		interval := time.Duration(l.Heartbeat) * time.Millisecond
+		if interval <= 0 {
+			interval = time.Second
+		}
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := wc.heartbeat(l); err != nil {
+					log.Fail("heartbeat of task ", l.Task.ID, ": ", err)
+				}
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	out, err := parseTask(m, l.Task.Project, opts)
+	if err != nil {
+		if ferr := wc.fail(l, err); ferr != nil {
+			log.Fail("unable to report the failure of task ", l.Task.ID, ": ", ferr)
+		}
+		return err
+	}
+
+	return wc.upload(l, out)
+}
+
+// parseTask parses a project, cloning it first if it is a remote git
+// repository, and returns the encoded result.
+func parseTask(m *manager.Manager, project string, opts manager.ParseOptions) (*bytes.Buffer, error) {
+	projectPath := project
+	if isRemoteProject(project) {
+		tmp, err := ioutil.TempDir("", "srctool-worker-")
+		if err != nil {
+			log.Debug(err)
+			return nil, errors.New("unable to create a temporary directory")
+		}
+		defer os.RemoveAll(tmp)
+
+		projectPath = filepath.Join(tmp, "project")
+		if _, err = git(tmp, "clone", "--quiet", "--depth", "1", project, projectPath); err != nil {
+			return nil, err
+		}
+	}
+
+	if fi, err := os.Stat(projectPath); err != nil || !fi.IsDir() {
+		return nil, errors.New(projectPath + " is not a directory")
+	}
+
+	opts.Diagnostics = new(manager.Diagnostics)
+	prj, err := m.Parse(context.Background(), projectPath, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	out := new(bytes.Buffer)
+	doc := document{Project: prj, Diagnostics: opts.Diagnostics.Sorted()}
+	if err = encodeDocument(out, formatJSON, doc); err != nil {
+		log.Debug(err)
+		return nil, errors.New("unable to encode the result")
+	}
+	return out, nil
+}
+
+// isRemoteProject tells whether a project is a git repository URL rather
+// than a path.
+func isRemoteProject(project string) bool {
+	return strings.Contains(project, "://") || strings.HasPrefix(project, "git@")
+}
+
+// workerClient is the HTTP client of a worker.
+type workerClient struct {
+	base string
+	name string
+}
+
+// do sends a request to the coordinator. Responses with an error status are
+// turned into errors, except for the statuses listed in accepted.
+func (wc *workerClient) do(method, path string, body io.Reader, timeout time.Duration, accepted ...int) (*http.Response, error) {
+	req, err := http.NewRequest(method, wc.base+path, body)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := (&http.Client{Timeout: timeout}).Do(req)
+	if err != nil {
+		log.Debug(err)
+		return nil, errors.New("unable to reach the coordinator")
+	}
+
+	if resp.StatusCode < 300 {
+		return resp, nil
+	}
+	for _, status := range accepted {
+		if resp.StatusCode == status {
+			return resp, nil
+		}
+	}
+
+	defer resp.Body.Close()
+	var msg struct {
+		Error string `json:"error"`
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&msg); err != nil || len(msg.Error) == 0 {
+		msg.Error = resp.Status
+	}
+	return nil, fmt.Errorf("coordinator: %s", msg.Error)
+}
+
+// lockfile fetches the lockfile of the coordinator.
+func (wc *workerClient) lockfile() (lockfile, error) {
+	var lf lockfile
+
+	resp, err := wc.do("GET", "/lockfile", nil, workerRequestTimeout)
+	if err != nil {
+		return lf, err
+	}
+	defer resp.Body.Close()
+
+	if err = json.NewDecoder(resp.Body).Decode(&lf); err != nil {
+		log.Debug(err)
+		return lf, errors.New("malformed lockfile received from the coordinator")
+	}
+	return lf, nil
+}
+
+// lease asks for a task. The returned status tells whether a task was leased
+// (200), none is available for now (204) or all are finished (410).
+func (wc *workerClient) lease() (lease, int, error) {
+	var l lease
+
+	resp, err := wc.do("POST", "/lease?worker="+url.QueryEscape(wc.name), nil, workerRequestTimeout, http.StatusGone)
+	if err != nil {
+		return l, 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return l, resp.StatusCode, nil
+	}
+
+	if err = json.NewDecoder(resp.Body).Decode(&l); err != nil {
+		log.Debug(err)
+		return l, 0, errors.New("malformed lease received from the coordinator")
+	}
+	return l, resp.StatusCode, nil
+}
+
+// taskPath returns the path of an action on a leased task.
+func (wc *workerClient) taskPath(l lease, action string) string {
+	return fmt.Sprintf("/tasks/%s/%s?lease=%s", url.QueryEscape(l.Task.ID), action, url.QueryEscape(l.Lease))
+}
+
+// heartbeat extends the lease of a task.
+func (wc *workerClient) heartbeat(l lease) error {
+	resp, err := wc.do("POST", wc.taskPath(l, "heartbeat"), nil, workerRequestTimeout)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// fail reports the failure of a task.
+func (wc *workerClient) fail(l lease, taskErr error) error {
+	resp, err := wc.do("POST", wc.taskPath(l, "fail"), strings.NewReader(taskErr.Error()), workerRequestTimeout)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// upload uploads the result of a task.
+func (wc *workerClient) upload(l lease, out io.Reader) error {
+	resp, err := wc.do("PUT", wc.taskPath(l, "result"), out, 0)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
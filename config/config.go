@@ -10,21 +10,26 @@ import (
 	"errors"
 	"fmt"
 	"io/ioutil"
-	"net/url"
 	"os"
 	"path/filepath"
 	"runtime"
+	"time"
 
 	"github.com/DevMine/srctool/log"
 )
 
 // Configuration constants
 const (
-	ConfigFolder     = "srctool"      // Configuration folder name
-	DataFolder       = "srctool"      // Data folder name
-	ParsersFolder    = "parsers"      // Parsers folder name
-	ConfigFileName   = "srctool.conf" // Configuration file name
-	ChecksumFileName = "MD5SUM"       // Checksum file name
+	ConfigFolder     = "srctool"       // Configuration folder name
+	DataFolder       = "srctool"       // Data folder name
+	ParsersFolder    = "parsers"       // Parsers folder name
+	JobsFolder       = "jobs"          // Parse jobs folder name
+	CacheFolder      = "cache"         // Download cache folder name
+	ConfigFileName   = "srctool.conf"  // Configuration file name
+	ChecksumFileName = "MD5SUM"        // Checksum file name
+	MetadataFileName = "parser.json"   // Parser metadata file name
+	LogFileName      = "srctool.log"   // Log file name
+	LockFileName     = ".srctool.lock" // Parsers directory lock file name
 
 	// DefaultConfigDir is the default configuration directoy when
 	// $XDG_CONFIG_HOME is not set.
@@ -45,41 +50,108 @@ const defaultConfigFile = `{
 }`
 
 // Config holds the configuration of srctool.
+//
+// The values come from several layers, each one overriding the previous ones:
+// the built-in defaults, the system configuration file, the configuration
+// file of the user, the project configuration file, the SRCTOOL_*
+// environment variables and the command line options. The keys, their type
+// and their valid values are declared by Schema.
 type Config struct {
-	DownloadServerURL string `json:"download_server_url"`
+	DownloadServerURL string
+	DownloadTimeout   time.Duration
+	LockTimeout       time.Duration
+	DataPath          string // use DataDir, empty for the default
+	ParsersPath       string // use ParsersDir, empty for the default
+	CachePath         string // use CacheDir, empty for the default
+
+	origins map[string]Origin // origin of the values by key
+	loaded  map[string]string // values once loaded, to save the changes only
+	changed map[string]bool   // keys set by Set
+	unset   map[string]bool   // keys unset by Unset
 }
 
-// New creates a new Config initialized with the values defined in the
-// configuration file located in $XDG_CONFIG_HOME/srctool/srctool.conf.
-// If $XDG_CONFIG_HOME is not set, it uses the directory "$HOME/.config/" as
-// config home. If some files or directories do not already exist, it creates
-// them automatically.
+// New creates a new Config initialized with the values of all the
+// configuration layers, the project configuration file being looked up from
+// the working directory. The configuration file of the user is located in
+// $XDG_CONFIG_HOME/srctool/srctool.conf. If $XDG_CONFIG_HOME is not set, it
+// uses the directory "$HOME/.config/" as config home. If some files or
+// directories do not already exist, it creates them automatically.
 func New() (*Config, error) {
+	return Load(".", nil)
+}
+
+// Load is like New, but the project configuration file is looked up from dir
+// and its parents, and the values of flags, given by key, override the
+// values of the other layers. Unknown keys are reported to the log as
+// warnings and invalid values make it fail.
+func Load(dir string, flags map[string]string) (*Config, error) {
 	if err := createConfigDir(); err != nil {
 		return nil, err
 	}
 
-	if err := createDataDir(); err != nil {
+	cfg, problems := load(dir, flags)
+	for _, p := range problems {
+		if !p.Warning {
+			return nil, p
+		}
+		log.Warn(p)
+	}
+
+	if err := createDataDir(cfg.ParsersDir()); err != nil {
 		return nil, err
 	}
 
-	bs, err := ioutil.ReadFile(filepath.Join(ConfigDir(), ConfigFileName))
-	if err != nil {
-		log.Debug("config:", err)
-		return nil, errors.New("cannot read configuration file")
+	cfg.loaded = cfg.snapshot()
+	return cfg, nil
+}
+
+// Resolve is like Load, but it neither creates the missing files and
+// directories nor reports the problems of the configuration, the invalid
+// values being ignored.
+func Resolve(dir string, flags map[string]string) *Config {
+	cfg, _ := load(dir, flags)
+	return cfg
+}
+
+// Validate reads the configuration layers as Load and returns all the
+// problems found.
+func Validate(dir string, flags map[string]string) []Problem {
+	_, problems := load(dir, flags)
+	return problems
+}
+
+// DataDir returns the data directory: the data_dir setting or, by default,
+// the data directory of srctool given by the package DataDir function.
+func (c *Config) DataDir() string {
+	if len(c.DataPath) > 0 {
+		return c.DataPath
 	}
+	return DataDir()
+}
 
-	cfg := new(Config)
-	if err = json.Unmarshal(bs, &cfg); err != nil {
-		log.Debug("config:", err)
-		return nil, errors.New("malformed configuration file")
+// ParsersDir returns the directory where the parsers are installed: the
+// parsers_dir setting or, by default, the parsers folder of the data
+// directory.
+func (c *Config) ParsersDir() string {
+	if len(c.ParsersPath) > 0 {
+		return c.ParsersPath
 	}
+	return filepath.Join(c.DataDir(), ParsersFolder)
+}
 
-	if err = cfg.verify(); err != nil {
-		return nil, fmt.Errorf("config: %v", err)
+// CacheDir returns the directory where the parsers are downloaded: the
+// cache_dir setting or, by default, the cache folder of the data directory.
+func (c *Config) CacheDir() string {
+	if len(c.CachePath) > 0 {
+		return c.CachePath
 	}
+	return filepath.Join(c.DataDir(), CacheFolder)
+}
 
-	return cfg, nil
+// JobsDir returns the directory where the parse jobs of the HTTP server are
+// stored, in the data directory.
+func (c *Config) JobsDir() string {
+	return filepath.Join(c.DataDir(), JobsFolder)
 }
 
 // createConfigDir creates the configuration directory if it does not already
@@ -107,10 +179,10 @@ func createConfigDir() error {
 	return nil
 }
 
-// createDataDir creates the data directory if it does not already exists.
-func createDataDir() error {
+// createDataDir creates the parsers directory at path if it does not
+// already exists.
+func createDataDir(path string) error {
 	var err error
-	path := filepath.Join(DataDir(), ParsersFolder)
 
 	if _, err = os.Stat(path); os.IsNotExist(err) {
 		log.Info(fmt.Sprintf("data dir '%s' does not exist", path))
@@ -146,36 +218,61 @@ func createConfigFile() error {
 	return nil
 }
 
-// Save saves the Config on the disk.
-func (c Config) Save() error {
-	bs, err := json.MarshalIndent(c, "", "    ")
+// Save saves the values changed since the Config was loaded into the
+// configuration file of the user and removes the unset keys from it. The
+// other values of the file are left untouched.
+func (c *Config) Save() error {
+	configPath := filepath.Join(ConfigDir(), ConfigFileName)
+
+	fi, err := os.Stat(configPath)
 	if err != nil {
 		log.Debug(err)
 		return errors.New("unable to save config file")
 	}
 
-	configPath := filepath.Join(ConfigDir(), ConfigFileName)
-
-	fi, err := os.Stat(configPath)
+	values := make(map[string]interface{})
+	bs, err := ioutil.ReadFile(configPath)
+	if err == nil {
+		err = json.Unmarshal(bs, &values)
+	}
 	if err != nil {
 		log.Debug(err)
 		return errors.New("unable to save config file")
 	}
 
-	if err = ioutil.WriteFile(configPath, bs, fi.Mode()); err != nil {
+	if c.origins == nil {
+		c.origins = make(map[string]Origin)
+	}
+	for _, s := range Schema {
+		value := s.get(c)
+		if value == c.loaded[s.Key] && !c.changed[s.Key] {
+			continue
+		}
+
+		values[s.Key] = value
+		if n, ok := s.field(c).(*int); ok {
+			values[s.Key] = *n
+		}
+		c.origins[s.Key] = Origin{Layer: LayerUser, Path: configPath}
+	}
+	for key := range c.unset {
+		delete(values, key)
+	}
+
+	bs, err = json.MarshalIndent(values, "", "    ")
+	if err != nil {
 		log.Debug(err)
 		return errors.New("unable to save config file")
 	}
 
-	return nil
-}
-
-// verify the correctness of the config values
-func (c Config) verify() error {
-	if _, err := url.Parse(c.DownloadServerURL); err != nil {
-		return errors.New(fmt.Sprint("config:", err))
+	if err = ioutil.WriteFile(configPath, bs, fi.Mode()); err != nil {
+		log.Debug(err)
+		return errors.New("unable to save config file")
 	}
 
+	c.loaded = c.snapshot()
+	c.changed = make(map[string]bool)
+	c.unset = make(map[string]bool)
 	return nil
 }
 
@@ -189,7 +286,7 @@ func ConfigDir() string {
 	return filepath.Join(configHome, ConfigFolder)
 }
 
-// DataDir returns the data directory of srctool.
+// DataDir returns the default data directory of srctool.
 func DataDir() string {
 	dataHome := filepath.Join(os.Getenv("HOME"), DefaultDataDir)
 	if xdg := os.Getenv("XDG_DATA_HOME"); len(xdg) > 0 {
@@ -199,21 +296,6 @@ func DataDir() string {
 	return filepath.Join(dataHome, DataFolder)
 }
 
-// ConfigFilePath returns the path of the configuration file.
-func ConfigFilePath() string {
-	return filepath.Join(DataDir(), ConfigFileName)
-}
-
-// ParsersDir returns the path of the parsers directory.
-func ParsersDir() string {
-	return filepath.Join(DataDir(), ParsersFolder)
-}
-
-// ParserPath return the local path of a parser.
-func ParserPath(parserName string) string {
-	return filepath.Join(ParsersDir(), parserName)
-}
-
 // RemoteChecksumsPath returns the path of the remotes checksums file.
 func RemoteChecksumsPath(serverURL string) string {
 	url := serverURL
@@ -224,16 +306,6 @@ func RemoteChecksumsPath(serverURL string) string {
 	return url + "MD5SUMS"
 }
 
-// LocalChecksumPath returns the path of the checksum file for a given parser.
-func LocalChecksumPath(parserName string) string {
-	return filepath.Join(ParserPath(parserName), "MD5SUM")
-}
-
-// TempPath returns the temporary path of the compressed parser.
-func TempPath(parserName string) string {
-	return filepath.Join(os.TempDir(), parserName+archExt)
-}
-
 // RemoteParserPath returns the remote parser path.
 func RemoteParserPath(parserName string) string {
 	return filepath.Join(runtime.GOOS, runtime.GOARCH, parserName+archExt)
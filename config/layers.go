@@ -0,0 +1,285 @@
+// Copyright 2014-2015 The DevMine authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/DevMine/srctool/log"
+)
+
+// Configuration layers, from the lowest to the highest priority.
+const (
+	LayerDefault = "default" // built-in defaults
+	LayerSystem  = "system"  // SystemConfigFile
+	LayerUser    = "user"    // the configuration file of the user
+	LayerProject = "project" // ProjectConfigFileName, looked up from the project
+	LayerEnv     = "env"     // SRCTOOL_* environment variables
+	LayerFlag    = "flag"    // command line options
+)
+
+const (
+	// SystemConfigFile is the path of the system-wide configuration file.
+	SystemConfigFile = "/etc/srctool/srctool.conf"
+
+	// ProjectConfigFileName is the name of the project configuration file,
+	// looked up from the project directory up to the root.
+	ProjectConfigFileName = ".srctool.json"
+
+	// EnvPrefix is the prefix of the environment variables overriding the
+	// configuration values, e.g. SRCTOOL_DOWNLOAD_SERVER_URL.
+	EnvPrefix = "SRCTOOL_"
+)
+
+// Origin tells where a configuration value comes from.
+type Origin struct {
+	Layer string `json:"layer"`          // one of the Layer* constants
+	Path  string `json:"path,omitempty"` // file, variable or option name
+}
+
+func (o Origin) String() string {
+	if len(o.Path) == 0 {
+		return o.Layer
+	}
+	return o.Layer + ":" + o.Path
+}
+
+// Problem is an issue found in a configuration layer.
+type Problem struct {
+	Origin  Origin
+	Key     string // empty when the whole layer is concerned
+	Message string
+
+	// Warning is true for the problems that do not prevent the
+	// configuration from being loaded, such as unknown keys.
+	Warning bool
+}
+
+func (p Problem) Error() string {
+	if len(p.Key) == 0 {
+		return fmt.Sprintf("%s: %s", p.Origin, p.Message)
+	}
+	return fmt.Sprintf("%s: %s: %s", p.Origin, p.Key, p.Message)
+}
+
+// Keys returns the configuration keys, in the order of the schema.
+func (c *Config) Keys() []string {
+	keys := make([]string, len(Schema))
+	for i, s := range Schema {
+		keys[i] = s.Key
+	}
+	return keys
+}
+
+// Get returns the value of a configuration key, as a string.
+func (c *Config) Get(key string) (string, error) {
+	s, ok := lookupSetting(key)
+	if !ok {
+		return "", fmt.Errorf("unknown configuration key %q", key)
+	}
+	return s.get(c), nil
+}
+
+// Set checks and sets the value of a configuration key, given as a string.
+// The value is written into the configuration file of the user by Save.
+func (c *Config) Set(key, value string) error {
+	s, ok := lookupSetting(key)
+	if !ok {
+		return fmt.Errorf("unknown configuration key %q", key)
+	}
+	if err := s.set(c, value); err != nil {
+		return fmt.Errorf("%s: %v", key, err)
+	}
+	c.changed[key] = true
+	delete(c.unset, key)
+	return nil
+}
+
+// Unset removes a key from the configuration file of the user, by Save.
+// Unknown keys are accepted, so that they can be cleaned up. The value of
+// the key is left unchanged until the configuration is loaded again.
+func (c *Config) Unset(key string) {
+	c.unset[key] = true
+	delete(c.changed, key)
+}
+
+// Origin returns the origin of the value of a configuration key.
+func (c *Config) Origin(key string) Origin {
+	return c.origins[key]
+}
+
+// MarshalJSON encodes the configuration as an object holding the values by
+// key, as strings.
+func (c *Config) MarshalJSON() ([]byte, error) {
+	return json.Marshal(c.snapshot())
+}
+
+// load reads the configuration layers, the project configuration file being
+// looked up from dir, and applies the values of flags. It returns the
+// problems found, the faulty values being ignored.
+func load(dir string, flags map[string]string) (*Config, []Problem) {
+	cfg := &Config{
+		origins: make(map[string]Origin),
+		changed: make(map[string]bool),
+		unset:   make(map[string]bool),
+	}
+	for _, s := range Schema {
+		if err := s.set(cfg, s.Default); err != nil {
+			panic("config: invalid default value for " + s.Key)
+		}
+		cfg.origins[s.Key] = Origin{Layer: LayerDefault}
+	}
+
+	var problems []Problem
+	problems = append(problems, cfg.loadFile(LayerSystem, SystemConfigFile)...)
+	problems = append(problems, cfg.loadFile(LayerUser, filepath.Join(ConfigDir(), ConfigFileName))...)
+	if path := findProjectConfig(dir); len(path) > 0 {
+		problems = append(problems, cfg.loadFile(LayerProject, path)...)
+	}
+	problems = append(problems, cfg.loadEnv()...)
+
+	keys := make([]string, 0, len(flags))
+	for key := range flags {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		problems = append(problems, cfg.apply(Origin{Layer: LayerFlag}, key, flags[key], false)...)
+	}
+
+	return cfg, problems
+}
+
+// apply sets a value coming from o. Unknown keys are reported as warnings
+// if unknownOK is true, as errors otherwise. The settings that a project
+// configuration file may not set are ignored with a warning.
+func (c *Config) apply(o Origin, key, value string, unknownOK bool) []Problem {
+	s, ok := lookupSetting(key)
+	if !ok {
+		return []Problem{{Origin: o, Key: key, Message: "unknown key", Warning: unknownOK}}
+	}
+	if o.Layer == LayerProject && !s.Project {
+		return []Problem{{Origin: o, Key: key, Message: "not allowed in a project configuration file, ignored", Warning: true}}
+	}
+	if err := s.set(c, value); err != nil {
+		return []Problem{{Origin: o, Key: key, Message: err.Error()}}
+	}
+	c.origins[key] = o
+	return nil
+}
+
+// loadFile applies the values of the configuration file at path, if it
+// exists, as coming from the given layer.
+func (c *Config) loadFile(layer, path string) []Problem {
+	o := Origin{Layer: layer, Path: path}
+
+	bs, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		log.Debug("config:", err)
+		return []Problem{{Origin: o, Message: "cannot read configuration file"}}
+	}
+
+	var values map[string]json.RawMessage
+	if err = json.Unmarshal(bs, &values); err != nil {
+		return []Problem{{Origin: o, Message: fmt.Sprintf("malformed configuration file: %v", err)}}
+	}
+
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var problems []Problem
+	for _, key := range keys {
+		value, err := rawString(values[key])
+		if err != nil {
+			problems = append(problems, Problem{Origin: o, Key: key, Message: err.Error()})
+			continue
+		}
+		problems = append(problems, c.apply(o, key, value, true)...)
+	}
+	return problems
+}
+
+// rawString returns a JSON string, number or boolean as a string.
+func rawString(raw json.RawMessage) (string, error) {
+	raw = bytes.TrimSpace(raw)
+	if len(raw) == 0 {
+		return "", fmt.Errorf("missing value")
+	}
+
+	switch raw[0] {
+	case '"':
+		var s string
+		if err := json.Unmarshal(raw, &s); err != nil {
+			return "", err
+		}
+		return s, nil
+	case '{', '[', 'n':
+		return "", fmt.Errorf("expected a string, a number or a boolean, found %s", raw)
+	}
+	return string(raw), nil
+}
+
+// loadEnv applies the values of the SRCTOOL_* environment variables.
+func (c *Config) loadEnv() []Problem {
+	var problems []Problem
+	for _, kv := range os.Environ() {
+		i := strings.Index(kv, "=")
+		if i < 0 || !strings.HasPrefix(kv[:i], EnvPrefix) {
+			continue
+		}
+
+		name, value := kv[:i], kv[i+1:]
+		key := strings.ToLower(strings.TrimPrefix(name, EnvPrefix))
+		problems = append(problems, c.apply(Origin{Layer: LayerEnv, Path: name}, key, value, true)...)
+	}
+	return problems
+}
+
+// findProjectConfig looks for a project configuration file in dir and its
+// parents. It returns an empty string if there is none.
+func findProjectConfig(dir string) string {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		log.Debug("config:", err)
+		return ""
+	}
+	if fi, err := os.Stat(dir); err == nil && !fi.IsDir() {
+		dir = filepath.Dir(dir)
+	}
+
+	for {
+		path := filepath.Join(dir, ProjectConfigFileName)
+		if _, err := os.Stat(path); err == nil {
+			return path
+		}
+
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return ""
+		}
+		dir = parent
+	}
+}
+
+// snapshot returns the current values of the configuration by key.
+func (c *Config) snapshot() map[string]string {
+	values := make(map[string]string)
+	for _, s := range Schema {
+		values[s.Key] = s.get(c)
+	}
+	return values
+}
@@ -0,0 +1,207 @@
+// Copyright 2014-2015 The DevMine authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/DevMine/srctool/log"
+)
+
+// lockPollInterval is the interval between two attempts to lock the parsers
+// directory.
+const lockPollInterval = 100 * time.Millisecond
+
+// Lock is an advisory lock on the parsers directory, preventing several
+// srctool processes from changing the parsers at the same time or while others
+// run them.
+//
+// The lock is held on the lock file of the parsers directory with flock(2), so
+// the system releases it when the process exits, even if it crashes. The
+// holder of an exclusive lock records itself into the lock file, which tells
+// the other processes who they are waiting for and reveals the holders that
+// did not release the lock properly.
+type Lock struct {
+	f         *os.File
+	exclusive bool
+}
+
+// lockHolder is the record of the holder of an exclusive lock.
+type lockHolder struct {
+	PID     int       `json:"pid"`
+	Host    string    `json:"host"`
+	Command string    `json:"command"`
+	Time    time.Time `json:"time"`
+}
+
+func (h *lockHolder) String() string {
+	return fmt.Sprintf("process %d on %s (srctool %s) since %s", h.PID, h.Host, h.Command, h.Time.Format(time.RFC3339))
+}
+
+// alive tells whether the holder may still be running: processes of other
+// hosts cannot be checked and are assumed to be.
+func (h *lockHolder) alive() bool {
+	if host, _ := os.Hostname(); host != h.Host {
+		return true
+	}
+	err := syscall.Kill(h.PID, 0)
+	return err == nil || err == syscall.EPERM
+}
+
+// LockError is returned when the parsers directory is still locked by other
+// processes once the lock timeout has expired.
+type LockError struct {
+	Dir    string
+	Holder string        // holder of the lock, empty if unknown
+	Waited time.Duration // duration waited for the lock
+}
+
+func (e *LockError) Error() string {
+	holder := e.Holder
+	if len(holder) == 0 {
+		holder = "another srctool process"
+	}
+	return fmt.Sprintf("parsers directory %s is locked by %s, gave up after %s (see the lock_timeout setting)", e.Dir, holder, e.Waited)
+}
+
+// Code returns the error code of the lock errors.
+func (e *LockError) Code() string {
+	return "locked"
+}
+
+// Timeout returns true: the lock could not be acquired in time.
+func (e *LockError) Timeout() bool {
+	return true
+}
+
+// LockParsers locks the parsers directory for the given command: exclusively
+// for the commands changing the parsers, in shared mode for the ones running
+// them. If other processes hold a conflicting lock, it waits for up to the
+// lock_timeout setting, then fails with a *LockError.
+//
+// The parsers directory is locked rather than the data directory, as several
+// configurations may share a parsers directory.
+func (c *Config) LockParsers(command string, exclusive bool) (*Lock, error) {
+	dir := c.ParsersDir()
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	f, err := os.OpenFile(filepath.Join(dir, LockFileName), os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	how := syscall.LOCK_SH
+	if exclusive {
+		how = syscall.LOCK_EX
+	}
+
+	deadline := time.Now().Add(c.LockTimeout)
+	waiting := false
+	for {
+		err = syscall.Flock(int(f.Fd()), how|syscall.LOCK_NB)
+		if err == nil {
+			break
+		} else if err != syscall.EWOULDBLOCK && err != syscall.EINTR {
+			f.Close()
+			return nil, fmt.Errorf("unable to lock the parsers directory %s: %v", dir, err)
+		}
+
+		var holder string
+		if h := readLockHolder(f); h != nil && h.alive() {
+			holder = h.String()
+		}
+
+		wait := deadline.Sub(time.Now())
+		if wait <= 0 {
+			f.Close()
+			return nil, &LockError{Dir: dir, Holder: holder, Waited: c.LockTimeout}
+		}
+		if !waiting {
+			if len(holder) == 0 {
+				holder = "other srctool processes"
+			}
+			log.Info("waiting for ", holder, " to release the parsers directory")
+			waiting = true
+		}
+		if wait > lockPollInterval {
+			wait = lockPollInterval
+		}
+		time.Sleep(wait)
+	}
+
+	l := &Lock{f: f, exclusive: exclusive}
+
+	// holding the lock, any record left is the one of a holder that exited
+	// without releasing it
+	if h := readLockHolder(f); h != nil {
+		log.Warn(h, " did not release the lock of the parsers directory, it probably crashed: the parsers it was changing may be broken, reinstall them if needed")
+		if err = f.Truncate(0); err != nil {
+			log.Debug("config:", err)
+		}
+	}
+
+	if exclusive {
+		if err = l.record(command); err != nil {
+			l.Unlock()
+			return nil, err
+		}
+	}
+	return l, nil
+}
+
+// record writes the holder of an exclusive lock into the lock file.
+func (l *Lock) record(command string) error {
+	host, _ := os.Hostname()
+	bs, err := json.Marshal(lockHolder{PID: os.Getpid(), Host: host, Command: command, Time: time.Now()})
+	if err != nil {
+		return err
+	}
+
+	if err = l.f.Truncate(0); err != nil {
+		return err
+	}
+	if _, err = l.f.WriteAt(bs, 0); err != nil {
+		return err
+	}
+	return l.f.Sync()
+}
+
+// Unlock releases the lock.
+func (l *Lock) Unlock() error {
+	if l.exclusive {
+		if err := l.f.Truncate(0); err != nil {
+			log.Debug("config:", err)
+		}
+	}
+	if err := syscall.Flock(int(l.f.Fd()), syscall.LOCK_UN); err != nil {
+		log.Debug("config:", err)
+	}
+	return l.f.Close()
+}
+
+// readLockHolder returns the holder recorded into the lock file, nil if there
+// is none.
+func readLockHolder(f *os.File) *lockHolder {
+	bs, err := ioutil.ReadAll(io.NewSectionReader(f, 0, 1<<16))
+	if err != nil || len(bs) == 0 {
+		return nil
+	}
+
+	var h lockHolder
+	if err = json.Unmarshal(bs, &h); err != nil || h.PID == 0 {
+		log.Debug("config: malformed lock file ", f.Name())
+		return nil
+	}
+	return &h
+}
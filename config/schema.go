@@ -0,0 +1,178 @@
+// Copyright 2014-2015 The DevMine authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package config
+
+import (
+	"fmt"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// Setting types.
+const (
+	StringType   = "string"
+	URLType      = "url"      // absolute http or https URL
+	PathType     = "path"     // absolute path, empty for the default
+	DurationType = "duration" // e.g. "90s" or "1h30m"
+	IntType      = "int"
+)
+
+// Setting describes a configuration key.
+type Setting struct {
+	Key         string
+	Type        string
+	Default     string
+	Description string
+
+	// Project is true for the settings that a project configuration file may
+	// set. The others, such as the directories and the download server, would
+	// let a parsed repository run programs of its choice, so they are left to
+	// the system, user, env and flag layers.
+	Project bool
+
+	// Min and Max bound the values of the int and duration settings, when
+	// Max is greater than Min. Durations are given in nanoseconds.
+	Min, Max int64
+
+	// field returns a pointer to the field holding the value: a *string for
+	// the string, URL and path settings, a *time.Duration or an *int.
+	field func(c *Config) interface{}
+}
+
+// Schema declares the configuration keys.
+var Schema = []Setting{
+	{
+		Key:         "download_server_url",
+		Type:        URLType,
+		Default:     "http://dl.devmine.ch/parsers",
+		Description: "URL of the server the parsers are downloaded from",
+		field:       func(c *Config) interface{} { return &c.DownloadServerURL },
+	},
+	{
+		Key:         "download_timeout",
+		Type:        DurationType,
+		Default:     "10m",
+		Description: "maximum duration of a request to the download server, 0 for none",
+		Min:         0,
+		Max:         int64(24 * time.Hour),
+		Project:     true,
+		field:       func(c *Config) interface{} { return &c.DownloadTimeout },
+	},
+	{
+		Key:         "lock_timeout",
+		Type:        DurationType,
+		Default:     "1m",
+		Description: "maximum duration to wait for other srctool processes to release the parsers directory, 0 for none",
+		Min:         0,
+		Max:         int64(24 * time.Hour),
+		Project:     true,
+		field:       func(c *Config) interface{} { return &c.LockTimeout },
+	},
+	{
+		Key:         "data_dir",
+		Type:        PathType,
+		Description: "directory holding the data of srctool, $XDG_DATA_HOME/srctool by default",
+		field:       func(c *Config) interface{} { return &c.DataPath },
+	},
+	{
+		Key:         "parsers_dir",
+		Type:        PathType,
+		Description: "directory where the parsers are installed, data_dir/parsers by default",
+		field:       func(c *Config) interface{} { return &c.ParsersPath },
+	},
+	{
+		Key:         "cache_dir",
+		Type:        PathType,
+		Description: "directory where the parsers are downloaded, data_dir/cache by default",
+		field:       func(c *Config) interface{} { return &c.CachePath },
+	},
+}
+
+// lookupSetting returns the setting of a key.
+func lookupSetting(key string) (Setting, bool) {
+	for _, s := range Schema {
+		if s.Key == key {
+			return s, true
+		}
+	}
+	return Setting{}, false
+}
+
+// set parses value according to the type of the setting, checks it and
+// assigns it to the field of c.
+func (s Setting) set(c *Config, value string) error {
+	switch f := s.field(c).(type) {
+	case *string:
+		switch s.Type {
+		case URLType:
+			if err := checkURL(value); err != nil {
+				return err
+			}
+		case PathType:
+			if len(value) > 0 && !filepath.IsAbs(value) {
+				return fmt.Errorf("invalid path %q, expected an absolute path", value)
+			}
+		}
+		*f = value
+	case *time.Duration:
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return fmt.Errorf("invalid duration %q, expected a number followed by a unit, e.g. 30s or 5m", value)
+		}
+		if err = s.checkRange(int64(d), time.Duration(s.Min).String(), time.Duration(s.Max).String()); err != nil {
+			return err
+		}
+		*f = d
+	case *int:
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("invalid integer %q", value)
+		}
+		if err = s.checkRange(int64(n), strconv.FormatInt(s.Min, 10), strconv.FormatInt(s.Max, 10)); err != nil {
+			return err
+		}
+		*f = n
+	}
+	return nil
+}
+
+// get returns the value of the field of c as a string.
+func (s Setting) get(c *Config) string {
+	switch f := s.field(c).(type) {
+	case *string:
+		return *f
+	case *time.Duration:
+		return f.String()
+	case *int:
+		return strconv.Itoa(*f)
+	}
+	return ""
+}
+
+// checkRange checks that v is within the bounds of the setting, given as min
+// and max in error messages.
+func (s Setting) checkRange(v int64, min, max string) error {
+	if s.Max > s.Min && (v < s.Min || v > s.Max) {
+		return fmt.Errorf("out of range, expected a value between %s and %s", min, max)
+	}
+	return nil
+}
+
+// checkURL checks that rawurl is an absolute http or https URL.
+func checkURL(rawurl string) error {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return fmt.Errorf("invalid URL %q", rawurl)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("invalid URL %q, expected an http or https URL", rawurl)
+	}
+	if len(u.Host) == 0 {
+		return fmt.Errorf("invalid URL %q, missing host", rawurl)
+	}
+	return nil
+}
@@ -6,58 +6,304 @@
 //
 // Everything is logged into stderr in order to keep stdout empty. This is
 // required because the final JSON must be output into stdout by default.
+// In JSON mode, fatal errors are also output into stdout, in JSON.
+//
+// Messages below the log level are dropped. The others are written into
+// stderr as text or as JSON objects, one per line, and into the log file
+// opened by OpenFile, if any. Programs embedding srctool can replace all this
+// by their own Logger:
+//
+//	log.SetLogger(log.LoggerFunc(func(e log.Entry) {
+//		mylogger.Print(e.Label, e.Message, e.Fields)
+//	}))
+//
+// Messages may carry fields, such as the parser or the project concerned:
+//
+//	log.Fields{"parser": "parser-go", "duration": d}.Info("parsing done")
 package log
 
 import (
+	"encoding/json"
 	"fmt"
 	"os"
-	"syscall"
+	"sync"
+	"time"
+)
 
-	"github.com/gilliek/go-xterm256/xterm256"
-	"golang.org/x/crypto/ssh/terminal"
+// Level is the severity of a log message.
+type Level int
+
+// Log levels, from the most to the least verbose.
+const (
+	DebugLevel Level = iota // debug messages and above
+	InfoLevel               // success and info messages and above
+	WarnLevel               // warnings and errors
+	ErrorLevel              // errors only
 )
 
-var debugMode = false
+// ParseLevel returns the level named s: "debug", "info", "warn" or "error".
+func ParseLevel(s string) (Level, error) {
+	switch s {
+	case "debug":
+		return DebugLevel, nil
+	case "info":
+		return InfoLevel, nil
+	case "warn":
+		return WarnLevel, nil
+	case "error":
+		return ErrorLevel, nil
+	}
+	return InfoLevel, fmt.Errorf("invalid log level %q, expected debug, info, warn or error", s)
+}
+
+func (l Level) String() string {
+	switch l {
+	case DebugLevel:
+		return "debug"
+	case WarnLevel:
+		return "warn"
+	case ErrorLevel:
+		return "error"
+	}
+	return "info"
+}
+
+// Format is the format of the log messages written into stderr and into the
+// log file.
+type Format int
+
+// Log formats.
+const (
+	TextFormat Format = iota // "[label  ] message (key=value ...)"
+	JSONFormat               // one JSON object per line
+)
+
+// ParseFormat returns the format named s: "text" or "json".
+func ParseFormat(s string) (Format, error) {
+	switch s {
+	case "text":
+		return TextFormat, nil
+	case "json":
+		return JSONFormat, nil
+	}
+	return TextFormat, fmt.Errorf("invalid log format %q, expected text or json", s)
+}
+
+// Fields are the named values attached to a log message, such as "parser",
+// "project" or "duration".
+type Fields map[string]interface{}
+
+// Entry is a log message.
+type Entry struct {
+	Time    time.Time
+	Level   Level
+	Label   string // "debug", "info", "success", "warning", "error" or "fatal"
+	Message string
+	Fields  Fields // nil when the message has none
+}
+
+// Logger receives the log messages that are not below the log level.
+type Logger interface {
+	Log(e Entry)
+}
 
-// SetDebugMode allows to enable/disable debug mode.
+// LoggerFunc is a function used as a Logger.
+type LoggerFunc func(e Entry)
+
+// Log calls f(e).
+func (f LoggerFunc) Log(e Entry) {
+	f(e)
+}
+
+var (
+	mu        sync.Mutex
+	level     = InfoLevel
+	jsonMode  = false
+	logger    Logger
+	defFields Fields
+)
+
+// SetDebugMode allows to enable/disable debug mode. It is a shorthand for
+// SetLevel(DebugLevel) and SetLevel(InfoLevel).
 func SetDebugMode(val bool) {
-	debugMode = val
+	if val {
+		SetLevel(DebugLevel)
+	} else {
+		SetLevel(InfoLevel)
+	}
+}
+
+// SetLevel sets the log level.
+func SetLevel(l Level) {
+	mu.Lock()
+	level = l
+	mu.Unlock()
+}
+
+// SetJSONMode allows to enable/disable JSON mode.
+func SetJSONMode(val bool) {
+	mu.Lock()
+	jsonMode = val
+	mu.Unlock()
+}
+
+// SetLogger replaces the default logger by l. A nil l restores the default
+// logger.
+func SetLogger(l Logger) {
+	mu.Lock()
+	logger = l
+	mu.Unlock()
+}
+
+// SetFields sets the fields attached to every message, such as the command
+// being run.
+func SetFields(f Fields) {
+	mu.Lock()
+	defFields = f
+	mu.Unlock()
 }
 
 // Success prints success messages.
 func Success(a ...interface{}) {
-	write(xterm256.Green, "success", fmt.Sprint(a...))
+	Fields(nil).Success(a...)
 }
 
 // Info prints info messages.
 func Info(a ...interface{}) {
-	write(xterm256.Blue, "info", fmt.Sprint(a...))
+	Fields(nil).Info(a...)
 }
 
-// Debug prints debug messages only if the debug mode is enabled.
+// Debug prints debug messages only if the log level is DebugLevel.
 func Debug(a ...interface{}) {
-	if debugMode {
-		write(xterm256.White, "debug", fmt.Sprint(a...))
-	}
+	Fields(nil).Debug(a...)
+}
+
+// Warn prints warning messages.
+func Warn(a ...interface{}) {
+	Fields(nil).Warn(a...)
 }
 
 // Fail prints error messages without exiting the program.
 func Fail(a ...interface{}) {
-	write(xterm256.Red, "error", fmt.Sprint(a...))
+	Fields(nil).Fail(a...)
 }
 
-// Fatal prints error messages, then exits the program with status code 1.
+// Fatal prints error messages, then exits the program. The status code is
+// given by the first argument having an ExitCode() int method, 1 by default.
+// In JSON mode, the error is also printed into stdout as a JSON object of the
+// form {"error": {"code": "...", "message": "..."}}, the code being given by
+// the first argument having a Code() string method, "error" by default.
 func Fatal(a ...interface{}) {
-	write(xterm256.Red, "fatal", fmt.Sprint(a...))
-	os.Exit(1)
+	Fields(nil).Fatal(a...)
+}
+
+// Success prints success messages with the fields f.
+func (f Fields) Success(a ...interface{}) {
+	f.log(InfoLevel, "success", fmt.Sprint(a...))
+}
+
+// Info prints info messages with the fields f.
+func (f Fields) Info(a ...interface{}) {
+	f.log(InfoLevel, "info", fmt.Sprint(a...))
+}
+
+// Debug prints debug messages with the fields f only if the log level is
+// DebugLevel.
+func (f Fields) Debug(a ...interface{}) {
+	f.log(DebugLevel, "debug", fmt.Sprint(a...))
+}
+
+// Warn prints warning messages with the fields f.
+func (f Fields) Warn(a ...interface{}) {
+	f.log(WarnLevel, "warning", fmt.Sprint(a...))
+}
+
+// Fail prints error messages with the fields f without exiting the program.
+func (f Fields) Fail(a ...interface{}) {
+	f.log(ErrorLevel, "error", fmt.Sprint(a...))
+}
+
+// Fatal prints error messages with the fields f, then exits the program, as
+// the Fatal function.
+func (f Fields) Fatal(a ...interface{}) {
+	msg := fmt.Sprint(a...)
+	f.log(ErrorLevel, "fatal", msg)
+
+	mu.Lock()
+	jm := jsonMode
+	mu.Unlock()
+	if jm {
+		writeJSONError(errorCode(a), msg)
+	}
+	os.Exit(exitCode(a))
 }
 
-// write is the low level routine for printing log messages with color c and label l.
-func write(c xterm256.Color, l, msg string) {
-	label := l
-	if terminal.IsTerminal(syscall.Stderr) {
-		label = xterm256.Sprint(c, l)
+// log sends a message to the logger, unless it is below the log level. The
+// default fields are added to the fields of the message.
+func (f Fields) log(l Level, label, msg string) {
+	mu.Lock()
+	lvl, lg, def := level, logger, defFields
+	mu.Unlock()
+
+	if l < lvl {
+		return
+	}
+
+	e := Entry{Time: time.Now(), Level: l, Label: label, Message: msg, Fields: f}
+	if len(def) > 0 {
+		e.Fields = make(Fields, len(def)+len(f))
+		for k, v := range def {
+			e.Fields[k] = v
+		}
+		for k, v := range f {
+			e.Fields[k] = v
+		}
 	}
 
-	fmt.Fprintf(os.Stderr, "[%-7s] %s\n", label, msg)
+	if lg != nil {
+		lg.Log(e)
+		return
+	}
+	write(e, def)
+}
+
+// errorCode returns the code of the first argument having one.
+func errorCode(a []interface{}) string {
+	for _, v := range a {
+		if c, ok := v.(interface {
+			Code() string
+		}); ok {
+			return c.Code()
+		}
+	}
+	return "error"
+}
+
+// exitCode returns the exit code of the first argument having one.
+func exitCode(a []interface{}) int {
+	for _, v := range a {
+		if c, ok := v.(interface {
+			ExitCode() int
+		}); ok {
+			return c.ExitCode()
+		}
+	}
+	return 1
+}
+
+// writeJSONError prints an error into stdout in JSON.
+func writeJSONError(code, msg string) {
+	var v struct {
+		Error struct {
+			Code    string `json:"code"`
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	v.Error.Code, v.Error.Message = code, msg
+
+	bs, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return
+	}
+	fmt.Println(string(bs))
 }
@@ -0,0 +1,271 @@
+// Copyright 2014-2015 The DevMine authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package log
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/gilliek/go-xterm256/xterm256"
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+// Rotation settings of the log file.
+const (
+	maxFileSize       = 10 << 20 // size beyond which the log file is rotated
+	maxFileBackups    = 3        // number of rotated log files kept
+	maxRotateFailures = 3        // failed rotations in a row before giving up
+)
+
+var (
+	outMu  sync.Mutex // serializes the writes of the default logger
+	format = TextFormat
+	file   *rotatingFile
+)
+
+// labelColors are the colors of the labels printed into a terminal.
+var labelColors = map[string]xterm256.Color{
+	"debug":   xterm256.White,
+	"info":    xterm256.Blue,
+	"success": xterm256.Green,
+	"warning": xterm256.Yellow,
+	"error":   xterm256.Red,
+	"fatal":   xterm256.Red,
+}
+
+// SetFormat sets the format of the messages written by the default logger.
+func SetFormat(f Format) {
+	outMu.Lock()
+	format = f
+	outMu.Unlock()
+}
+
+// OpenFile makes the default logger write the messages into the file at path
+// too, in addition to stderr. The file is rotated when it grows beyond 10 MB,
+// the 3 previous files being kept as path.1, path.2 and path.3.
+func OpenFile(path string) error {
+	rf, err := openRotatingFile(path)
+	if err != nil {
+		return err
+	}
+
+	outMu.Lock()
+	defer outMu.Unlock()
+	if file != nil {
+		file.Close()
+	}
+	file = rf
+	return nil
+}
+
+// CloseFile closes the log file opened by OpenFile, if any.
+func CloseFile() error {
+	outMu.Lock()
+	defer outMu.Unlock()
+
+	if file == nil {
+		return nil
+	}
+	err := file.Close()
+	file = nil
+	return err
+}
+
+// write is the default logger: it writes a message into stderr and into the
+// log file. In text format, the default fields def are left out.
+func write(e Entry, def Fields) {
+	outMu.Lock()
+	defer outMu.Unlock()
+
+	if format == JSONFormat {
+		line := formatJSON(e)
+		os.Stderr.Write(line)
+		if file != nil {
+			file.Write(line)
+		}
+		return
+	}
+
+	label := e.Label
+	if terminal.IsTerminal(syscall.Stderr) {
+		label = xterm256.Sprint(labelColors[e.Label], e.Label)
+	}
+	fmt.Fprint(os.Stderr, formatText(label, e, def))
+	if file != nil {
+		fmt.Fprint(file, e.Time.Format(time.RFC3339)+" "+formatText(e.Label, e, def))
+	}
+}
+
+// formatText formats a message as "[label  ] message (key=value ...)".
+func formatText(label string, e Entry, def Fields) string {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "[%-7s] %s", label, e.Message)
+
+	sep := " ("
+	for _, k := range sortedKeys(e.Fields) {
+		if _, ok := def[k]; ok {
+			continue
+		}
+		fmt.Fprintf(&buf, "%s%s=%v", sep, k, e.Fields[k])
+		sep = " "
+	}
+	if sep == " " {
+		buf.WriteString(")")
+	}
+	buf.WriteString("\n")
+	return buf.String()
+}
+
+// formatJSON formats a message as a JSON object on a single line. The fields
+// are added to the "time", "level" and "msg" keys, durations being written in
+// seconds.
+func formatJSON(e Entry) []byte {
+	obj := make(map[string]interface{}, len(e.Fields)+3)
+	for k, v := range e.Fields {
+		switch v := v.(type) {
+		case time.Duration:
+			obj[k] = v.Seconds()
+		case error:
+			obj[k] = v.Error()
+		default:
+			obj[k] = v
+		}
+	}
+	obj["time"] = e.Time.Format(time.RFC3339Nano)
+	obj["level"] = e.Label
+	obj["msg"] = e.Message
+
+	bs, err := json.Marshal(obj)
+	if err != nil {
+		// some field cannot be marshaled: fall back on their text form
+		for k, v := range obj {
+			obj[k] = fmt.Sprint(v)
+		}
+		bs, _ = json.Marshal(obj)
+	}
+	return append(bs, '\n')
+}
+
+// sortedKeys returns the keys of f in alphabetical order.
+func sortedKeys(f Fields) []string {
+	keys := make([]string, 0, len(f))
+	for k := range f {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// rotatingFile is a log file renamed once it grows beyond maxFileSize.
+//
+// Several srctool processes may write into the same log file. The rotation
+// is done under an exclusive lock of the current file, and the processes
+// finding that the file was already rotated by another one reopen it instead
+// of rotating it again.
+type rotatingFile struct {
+	path string
+	f    *os.File
+	size int64
+
+	// failures is the number of failed rotations in a row. After a failure,
+	// the next rotation is attempted once the file grew by a tenth of
+	// maxFileSize, until maxRotateFailures is reached.
+	failures int
+	retryAt  int64
+}
+
+// openRotatingFile opens the log file at path in append mode, creating it if
+// needed.
+func openRotatingFile(path string) (*rotatingFile, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &rotatingFile{path: path, f: f, size: fi.Size()}, nil
+}
+
+// Write writes p into the log file, rotating it first if it would grow beyond
+// maxFileSize. If the rotation fails, the current file keeps growing.
+func (rf *rotatingFile) Write(p []byte) (int, error) {
+	limit := int64(maxFileSize)
+	if rf.retryAt > 0 {
+		limit = rf.retryAt
+	}
+
+	if rf.size > 0 && rf.size+int64(len(p)) > limit && rf.failures < maxRotateFailures {
+		if err := rf.rotate(); err != nil {
+			rf.failures++
+			rf.retryAt = rf.size + maxFileSize/10
+		} else {
+			rf.failures, rf.retryAt = 0, 0
+		}
+	}
+
+	n, err := rf.f.Write(p)
+	rf.size += int64(n)
+	return n, err
+}
+
+// rotate renames path.N into path.N+1, dropping the oldest file, and path
+// into path.1, then starts a new file. If another process already rotated the
+// file, the new file is only reopened.
+func (rf *rotatingFile) rotate() error {
+	old := rf.f
+	if err := syscall.Flock(int(old.Fd()), syscall.LOCK_EX); err != nil {
+		return err
+	}
+	defer func() {
+		// closing the old file released the lock
+		if rf.f == old {
+			syscall.Flock(int(old.Fd()), syscall.LOCK_UN)
+		}
+	}()
+
+	cur, err := old.Stat()
+	if err != nil {
+		return err
+	}
+	if fi, err := os.Stat(rf.path); err == nil && !os.SameFile(fi, cur) {
+		return rf.reopen()
+	}
+
+	for i := maxFileBackups - 1; i > 0; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", rf.path, i), fmt.Sprintf("%s.%d", rf.path, i+1))
+	}
+	if err = os.Rename(rf.path, rf.path+".1"); err != nil {
+		return err
+	}
+	return rf.reopen()
+}
+
+// reopen opens the file at path and closes the current one. The current file
+// is kept if the new one cannot be opened.
+func (rf *rotatingFile) reopen() error {
+	nf, err := openRotatingFile(rf.path)
+	if err != nil {
+		return err
+	}
+
+	rf.f.Close()
+	rf.f, rf.size = nf.f, nf.size
+	return nil
+}
+
+// Close closes the log file.
+func (rf *rotatingFile) Close() error {
+	return rf.f.Close()
+}
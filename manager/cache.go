@@ -0,0 +1,298 @@
+// Copyright 2014-2015 The DevMine authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package manager
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/DevMine/srcanlzr/src"
+
+	"github.com/DevMine/srctool/log"
+)
+
+// ParseCache caches the results of the parsers between the parsings of
+// successive versions of a project, such as the revisions of a repository.
+// The input files of each parser are keyed by the hash of their content:
+//
+//   - a parser whose input files are all unchanged is not run, its previous
+//     result is reused;
+//   - a parser accepting a list of files is only run on the files that
+//     changed, the results of the other files being taken from the cache.
+//
+// Only the result of the last parsing of each parser is kept. A ParseCache is
+// safe for concurrent use, but is meant for the parsings of a single project
+// path.
+type ParseCache struct {
+	mu      sync.Mutex
+	parsers map[string]*parserCache
+}
+
+// parserCache is the cached result of a parser. The results are kept
+// encoded, as merging the projects modifies them.
+type parserCache struct {
+	key   string                 // hash of the input files of the parser
+	name  string                 // name of the project
+	prj   []byte                 // result of the parser
+	files map[string]*cachedFile // source files, by path relative to the project
+}
+
+// cachedFile is a source file of a cached result.
+type cachedFile struct {
+	hash string
+	pkg  src.Package // package of the file, without its source files
+	sf   []byte
+}
+
+// NewParseCache creates an empty parse cache.
+func NewParseCache() *ParseCache {
+	return &ParseCache{parsers: make(map[string]*parserCache)}
+}
+
+// routine runs parser p on the project located at projectPath, reusing the
+// cached results when its input files did not change, and caches the new
+// result. Parsers whose input files are unknown are always run.
+func (pc *ParseCache) routine(ctx context.Context, p Parser, projectPath string, opts ParseOptions, c chan Result) {
+	if p.Extensions() == nil {
+		parserRoutine(ctx, p, projectPath, opts, c)
+		return
+	}
+
+	absPath, err := filepath.Abs(projectPath)
+	if err != nil {
+		c <- Result{Parser: p.Name, Err: err}
+		return
+	}
+
+	files, err := parserFiles(p, absPath)
+	if err != nil {
+		c <- Result{Parser: p.Name, Err: err}
+		return
+	}
+
+	hashes, err := hashFiles(absPath, files)
+	if err != nil {
+		c <- Result{Parser: p.Name, Err: err}
+		return
+	}
+	key := inputKey(files, hashes)
+
+	fields := log.Fields{"parser": p.Name, "project": projectPath}
+
+	pc.mu.Lock()
+	entry := pc.parsers[p.Name]
+	pc.mu.Unlock()
+
+	if entry != nil && entry.key == key {
+		var prj src.Project
+		if err = json.Unmarshal(entry.prj, &prj); err == nil {
+			fields.Info("input files of the ", p.Name, " parser unchanged, reusing its previous result")
+			c <- Result{Parser: p.Name, prj: &prj}
+			return
+		}
+		log.Debug("manager: cached result of ", p.Name, ": ", err)
+	}
+
+	var changed []string
+	if entry != nil && p.Meta.FileList {
+		changed = entry.changed(files, hashes)
+	}
+
+	var res Result
+	if len(changed) > 0 && 2*len(changed) <= len(files) {
+		// reparsing the project when most files changed spares
+		// merging and lets the parser be sharded
+		fields.Info(fmt.Sprintf("%d file(s) changed, reusing the results of the %s parser for the %d other(s)", len(changed), p.Name, len(files)-len(changed)))
+		res = pc.parseChanged(ctx, p, absPath, changed, files, hashes, entry, opts)
+	} else {
+		res = runParser(ctx, p, projectPath, opts)
+	}
+	if res.prj != nil {
+		pc.store(p.Name, key, absPath, hashes, res.prj)
+	}
+	c <- res
+}
+
+// runParser runs parser p on the project located at projectPath and returns
+// its result, decoded when valid. Invalid outputs are returned as is, to be
+// reported by MergeResults.
+func runParser(ctx context.Context, p Parser, projectPath string, opts ParseOptions) Result {
+	c := make(chan Result, 1)
+	parserRoutine(ctx, p, projectPath, opts, c)
+
+	res := <-c
+	if res.Err != nil || res.prj != nil {
+		return res
+	}
+
+	prj, err := decodeProjectJSON(res.out.Bytes())
+	if err != nil {
+		return res
+	}
+	return Result{Parser: p.Name, prj: prj}
+}
+
+// parseChanged runs parser p on the changed files of the project located at
+// projectPath and merges its result with the cached results of the other
+// files.
+func (pc *ParseCache) parseChanged(ctx context.Context, p Parser, projectPath string, changed, files []string, hashes map[string]string, entry *parserCache, opts ParseOptions) Result {
+	prj, err := parseShard(ctx, p, projectPath, shard{name: "changed files", files: changed}, 0, opts)
+	if err != nil {
+		return Result{Parser: p.Name, Err: err}
+	}
+
+	cached, err := entry.project(files, hashes)
+	if err != nil {
+		log.Debug("manager: cached result of ", p.Name, ": ", err)
+		return runParser(ctx, p, projectPath, opts)
+	}
+
+	prj, err = src.MergeAll(cached, prj)
+	if err != nil {
+		log.Debug(err)
+		return Result{Parser: p.Name, Err: fmt.Errorf("unable to merge the cached results of the %s parser", p.Name)}
+	}
+	return Result{Parser: p.Name, prj: prj}
+}
+
+// store caches the result of parser p. Source files whose path is not one
+// of the hashed input files are not cached: parsing changes touching them
+// reparses the project.
+func (pc *ParseCache) store(name, key, projectPath string, hashes map[string]string, prj *src.Project) {
+	bs, err := json.Marshal(prj)
+	if err != nil {
+		log.Debug("manager: unable to cache the result of ", name, ": ", err)
+		return
+	}
+
+	entry := &parserCache{key: key, name: prj.Name, prj: bs, files: make(map[string]*cachedFile)}
+	for _, pkg := range prj.Packages {
+		if pkg == nil {
+			continue
+		}
+
+		header := src.Package{Doc: pkg.Doc, Name: pkg.Name, Path: pkg.Path}
+		for _, sf := range pkg.SourceFiles {
+			if sf == nil {
+				continue
+			}
+
+			rel := sf.Path
+			if filepath.IsAbs(rel) {
+				if rel, err = filepath.Rel(projectPath, rel); err != nil {
+					continue
+				}
+			}
+			rel = filepath.Clean(rel)
+
+			hash, ok := hashes[rel]
+			if !ok {
+				continue
+			}
+
+			bs, err := json.Marshal(sf)
+			if err != nil {
+				log.Debug("manager: unable to cache ", sf.Path, ": ", err)
+				continue
+			}
+			entry.files[rel] = &cachedFile{hash: hash, pkg: header, sf: bs}
+		}
+	}
+
+	pc.mu.Lock()
+	pc.parsers[name] = entry
+	pc.mu.Unlock()
+}
+
+// changed returns the files whose content is not the cached one.
+func (entry *parserCache) changed(files []string, hashes map[string]string) []string {
+	var changed []string
+	for _, f := range files {
+		if cf, ok := entry.files[f]; !ok || cf.hash != hashes[f] {
+			changed = append(changed, f)
+		}
+	}
+	return changed
+}
+
+// project builds a project from the cached source files of files whose
+// content did not change.
+func (entry *parserCache) project(files []string, hashes map[string]string) (*src.Project, error) {
+	prj := &src.Project{Name: entry.name}
+
+	pkgs := make(map[string]*src.Package)
+	langs := make(map[string]bool)
+	for _, f := range files {
+		cf, ok := entry.files[f]
+		if !ok || cf.hash != hashes[f] {
+			continue
+		}
+
+		sf := new(src.SourceFile)
+		if err := json.Unmarshal(cf.sf, sf); err != nil {
+			return nil, err
+		}
+
+		pkg, ok := pkgs[cf.pkg.Path]
+		if !ok {
+			pkg = &src.Package{Doc: cf.pkg.Doc, Name: cf.pkg.Name, Path: cf.pkg.Path}
+			pkgs[pkg.Path] = pkg
+			prj.Packages = append(prj.Packages, pkg)
+		}
+		pkg.SourceFiles = append(pkg.SourceFiles, sf)
+		pkg.LoC += sf.LoC
+		prj.LoC += sf.LoC
+
+		if sf.Language != nil && !langs[sf.Language.Lang] {
+			langs[sf.Language.Lang] = true
+			prj.Languages = append(prj.Languages, sf.Language)
+		}
+	}
+	return prj, nil
+}
+
+// hashFiles returns the SHA-1 hash of the content of files, relative to
+// projectPath.
+func hashFiles(projectPath string, files []string) (map[string]string, error) {
+	hashes := make(map[string]string, len(files))
+	for _, f := range files {
+		path := filepath.Join(projectPath, f)
+
+		r, err := os.Open(path)
+		if err != nil {
+			return nil, &FileError{Op: "read", Path: path, Err: err}
+		}
+
+		h := sha1.New()
+		_, err = io.Copy(h, r)
+		r.Close()
+		if err != nil {
+			return nil, &FileError{Op: "read", Path: path, Err: err}
+		}
+		hashes[f] = hex.EncodeToString(h.Sum(nil))
+	}
+	return hashes, nil
+}
+
+// inputKey returns a key identifying a set of files and their content.
+func inputKey(files []string, hashes map[string]string) string {
+	sorted := make([]string, len(files))
+	copy(sorted, files)
+	sort.Strings(sorted)
+
+	h := sha1.New()
+	for _, f := range sorted {
+		fmt.Fprintf(h, "%s %s\n", hashes[f], f)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
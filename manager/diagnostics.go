@@ -0,0 +1,217 @@
+// Copyright 2014-2015 The DevMine authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package manager
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/DevMine/srctool/log"
+)
+
+// Diagnostic is a structured message emitted by a parser on its standard
+// error output. Parsers emit diagnostics as JSON objects, one per line.
+type Diagnostic struct {
+	Parser   string `json:"parser"`
+	File     string `json:"file"`
+	Line     int    `json:"line"`
+	Severity string `json:"severity"`
+	Message  string `json:"message"`
+}
+
+// String returns a human readable representation of the diagnostic.
+func (d Diagnostic) String() string {
+	loc := d.File
+	if d.Line > 0 {
+		loc = fmt.Sprintf("%s:%d", d.File, d.Line)
+	}
+	if len(loc) > 0 {
+		return fmt.Sprintf("%s: %s: %s", loc, d.Severity, d.Message)
+	}
+	return fmt.Sprintf("%s: %s", d.Severity, d.Message)
+}
+
+// Diagnostics collects the diagnostics of all parsers. It is safe for
+// concurrent use. The zero value is an empty collection.
+type Diagnostics struct {
+	mu   sync.Mutex
+	list []Diagnostic
+}
+
+// Add adds a diagnostic to the collection.
+func (ds *Diagnostics) Add(d Diagnostic) {
+	ds.mu.Lock()
+	ds.list = append(ds.list, d)
+	ds.mu.Unlock()
+}
+
+// Reset drops the diagnostics of a parser, before it is run again.
+func (ds *Diagnostics) Reset(parserName string) {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+
+	list := ds.list[:0]
+	for _, d := range ds.list {
+		if d.Parser != parserName {
+			list = append(list, d)
+		}
+	}
+	ds.list = list
+}
+
+// Drain removes the collected diagnostics and returns them.
+func (ds *Diagnostics) Drain() []Diagnostic {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+
+	list := ds.list
+	ds.list = nil
+	return list
+}
+
+// Sorted returns the collected diagnostics sorted by parser, file and line,
+// so that the order does not depend on which parser finishes first.
+func (ds *Diagnostics) Sorted() []Diagnostic {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+
+	list := make([]Diagnostic, len(ds.list))
+	copy(list, ds.list)
+	sort.Stable(byLocation(list))
+	return list
+}
+
+type byLocation []Diagnostic
+
+func (ds byLocation) Len() int      { return len(ds) }
+func (ds byLocation) Swap(i, j int) { ds[i], ds[j] = ds[j], ds[i] }
+func (ds byLocation) Less(i, j int) bool {
+	if ds[i].Parser != ds[j].Parser {
+		return ds[i].Parser < ds[j].Parser
+	}
+	if ds[i].File != ds[j].File {
+		return ds[i].File < ds[j].File
+	}
+	return ds[i].Line < ds[j].Line
+}
+
+// lineWriter is an io.Writer that calls fn for each line written to it.
+type lineWriter struct {
+	buf []byte
+	fn  func(line string)
+}
+
+func (w *lineWriter) Write(p []byte) (int, error) {
+	w.buf = append(w.buf, p...)
+	for {
+		i := bytes.IndexByte(w.buf, '\n')
+		if i < 0 {
+			break
+		}
+		w.fn(string(w.buf[:i]))
+		w.buf = w.buf[i+1:]
+	}
+	return len(p), nil
+}
+
+// flush calls fn with the last line if it was not terminated by a newline.
+func (w *lineWriter) flush() {
+	if len(w.buf) > 0 {
+		w.fn(string(w.buf))
+		w.buf = nil
+	}
+}
+
+// parserStderr captures the standard error output of a parser.
+// Each line is streamed to the log, prefixed by the parser name, and JSON
+// diagnostics are collected into diags. When logFile is not empty, the raw
+// output is also saved into it.
+type parserStderr struct {
+	lw  *lineWriter
+	log *os.File
+	w   io.Writer
+}
+
+func newParserStderr(parserName, logFile string, diags *Diagnostics) (*parserStderr, error) {
+	ps := &parserStderr{
+		lw: &lineWriter{fn: func(line string) {
+			handleStderrLine(parserName, line, diags)
+		}},
+	}
+	ps.w = ps.lw
+
+	if len(logFile) > 0 {
+		if err := os.MkdirAll(filepath.Dir(logFile), 0755); err != nil {
+			return nil, &FileError{Op: "create the parsers log directory", Path: filepath.Dir(logFile), Err: err}
+		}
+
+		f, err := os.Create(logFile)
+		if err != nil {
+			return nil, &FileError{Op: "create the log file", Path: logFile, Err: err}
+		}
+		ps.log = f
+		ps.w = io.MultiWriter(f, ps.lw)
+	}
+
+	return ps, nil
+}
+
+// parserLogFile returns the path of the log file named name into logDir, or
+// an empty string if logDir is empty.
+func parserLogFile(logDir, name string) string {
+	if len(logDir) == 0 {
+		return ""
+	}
+	return filepath.Join(logDir, name+".log")
+}
+
+func (ps *parserStderr) Write(p []byte) (int, error) {
+	return ps.w.Write(p)
+}
+
+// Close flushes the pending output and closes the log file, if any.
+func (ps *parserStderr) Close() error {
+	ps.lw.flush()
+	if ps.log != nil {
+		return ps.log.Close()
+	}
+	return nil
+}
+
+// handleStderrLine logs a line of the standard error output of a parser and
+// records it as a diagnostic if it is one.
+func handleStderrLine(parserName, line string, diags *Diagnostics) {
+	line = strings.TrimSpace(line)
+	if len(line) == 0 {
+		return
+	}
+
+	if line[0] == '{' {
+		var d Diagnostic
+		if err := json.Unmarshal([]byte(line), &d); err == nil && len(d.Message) > 0 {
+			d.Parser = parserName
+			if len(d.Severity) == 0 {
+				d.Severity = "error"
+			}
+			diags.Add(d)
+
+			if d.Severity == "error" || d.Severity == "fatal" {
+				log.Fail(parserName, ": ", d)
+			} else {
+				log.Info(parserName, ": ", d)
+			}
+			return
+		}
+	}
+
+	log.Fail(parserName, ": ", line)
+}
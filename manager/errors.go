@@ -0,0 +1,178 @@
+// Copyright 2014-2015 The DevMine authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package manager
+
+import (
+	"fmt"
+)
+
+// Every error type of this package has a Code method returning a short
+// identifier of the kind of error, such as "not_installed" or "network", for
+// the programs reporting errors in a machine-readable way. The codes are part
+// of the API and do not change.
+
+var (
+	// ErrNoParsers is returned when parsing with no parser installed, or
+	// none of the requested ones.
+	ErrNoParsers error = &codeError{code: "no_parsers", msg: "no parser installed"}
+
+	// ErrNoOutput is returned when no parser produced a valid output.
+	ErrNoOutput error = &codeError{code: "no_output", msg: "no parser produced a valid output"}
+)
+
+// codeError is an error identified by its code.
+type codeError struct {
+	code string
+	msg  string
+}
+
+func (e *codeError) Error() string { return e.msg }
+func (e *codeError) Code() string  { return e.code }
+
+// NotInstalledError is returned when a parser is not installed.
+type NotInstalledError struct {
+	Parser string
+}
+
+func (e *NotInstalledError) Error() string {
+	return e.Parser + " is not installed"
+}
+
+// Code returns "not_installed".
+func (e *NotInstalledError) Code() string { return "not_installed" }
+
+// AlreadyInstalledError is returned when installing a parser that is already
+// installed.
+type AlreadyInstalledError struct {
+	Parser string
+}
+
+func (e *AlreadyInstalledError) Error() string {
+	return e.Parser + " already installed, if you want to update it, use the 'update' command"
+}
+
+// Code returns "already_installed".
+func (e *AlreadyInstalledError) Code() string { return "already_installed" }
+
+// NotAvailableError is returned when the download server does not provide a
+// parser for the current OS and architecture.
+type NotAvailableError struct {
+	Parser string
+}
+
+func (e *NotAvailableError) Error() string {
+	return fmt.Sprintf("no MD5 sum found for file %s", e.Parser)
+}
+
+// Code returns "not_available".
+func (e *NotAvailableError) Code() string { return "not_available" }
+
+// NetworkError is returned when the download server cannot be reached or
+// answers with an error.
+type NetworkError struct {
+	Op  string // e.g. "download parser-go"
+	URL string
+	Err error
+}
+
+func (e *NetworkError) Error() string {
+	return fmt.Sprintf("failed to %s: %v", e.Op, e.Err)
+}
+
+// Code returns "network".
+func (e *NetworkError) Code() string { return "network" }
+
+// ChecksumError is returned when a downloaded parser does not match the MD5
+// sum published by the download server.
+type ChecksumError struct {
+	Parser   string
+	Expected string
+	Actual   string
+}
+
+func (e *ChecksumError) Error() string {
+	return "MD5 sum mismatch for " + e.Parser
+}
+
+// Code returns "checksum".
+func (e *ChecksumError) Code() string { return "checksum" }
+
+// FileError is returned when a file or a directory cannot be read or
+// written.
+type FileError struct {
+	Op   string // e.g. "read"
+	Path string
+	Err  error
+}
+
+func (e *FileError) Error() string {
+	return fmt.Sprintf("unable to %s %s: %v", e.Op, e.Path, e.Err)
+}
+
+// Code returns "file".
+func (e *FileError) Code() string { return "file" }
+
+// MetadataError is returned when the metadata of a parser is malformed.
+type MetadataError struct {
+	Parser string
+	Err    error
+}
+
+func (e *MetadataError) Error() string {
+	return fmt.Sprintf("malformed metadata for the %s parser: %v", e.Parser, e.Err)
+}
+
+// Code returns "metadata".
+func (e *MetadataError) Code() string { return "metadata" }
+
+// ParserError is returned when a parser fails or produces no output.
+type ParserError struct {
+	Parser string
+	Err    error
+}
+
+func (e *ParserError) Error() string {
+	return fmt.Sprintf("the %s parser failed: %v", e.Parser, e.Err)
+}
+
+// Code returns "parser".
+func (e *ParserError) Code() string { return "parser" }
+
+// OutputError is returned when the output of a parser is not a valid
+// project.
+type OutputError struct {
+	Parser string
+	Err    error
+}
+
+func (e *OutputError) Error() string {
+	return fmt.Sprintf("output of the %s parser rejected: %v", e.Parser, e.Err)
+}
+
+// Code returns "invalid_output".
+func (e *OutputError) Code() string { return "invalid_output" }
+
+// ConflictError is returned by the "error" merge strategy when several
+// outputs claim the same language or file, and by the "prefer" strategy when
+// none of these outputs is listed.
+type ConflictError struct {
+	Kind    string // "language" or "file"
+	Name    string
+	Parsers [2]string
+
+	// Unlisted tells that the prefer strategy lists none of the parsers.
+	Unlisted bool
+}
+
+func (e *ConflictError) Error() string {
+	msg := fmt.Sprintf("%s %s claimed by both the %s and %s parsers", e.Kind, e.Name, e.Parsers[0], e.Parsers[1])
+	if e.Unlisted {
+		msg += ", list one of them in the prefer strategy"
+	}
+	return msg
+}
+
+// Code returns "conflict".
+func (e *ConflictError) Code() string { return "conflict" }
@@ -0,0 +1,177 @@
+// Copyright 2014-2015 The DevMine authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package manager manages the language parsers and runs them on projects.
+//
+// It is the library behind the srctool command line tool and can be embedded
+// into other Go programs:
+//
+//	m := manager.New(manager.Options{})
+//	if err := m.Install(ctx, "go"); err != nil {
+//		// handle err
+//	}
+//	prj, err := m.Parse(ctx, "/path/to/project", manager.ParseOptions{})
+//
+// Functions of this package never exit the program: errors are returned and
+// can be inspected through their type.
+package manager
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/DevMine/srctool/config"
+)
+
+// parserPrefix is the prefix of the parser names.
+const parserPrefix = "parser-"
+
+// DefaultServerURL is the URL of the default download server.
+const DefaultServerURL = "http://dl.devmine.ch/parsers"
+
+// Options configures a Manager. The zero value uses the srctool defaults.
+type Options struct {
+	// ParsersDir is the directory where the parsers are installed. It
+	// defaults to the parsers directory of the srctool configuration.
+	ParsersDir string
+
+	// TempDir is the directory where the parser archives are downloaded,
+	// each download using a file of its own. It defaults to the temporary
+	// directory of the system.
+	TempDir string
+
+	// ServerURL is the URL of the download server. It defaults to
+	// DefaultServerURL.
+	ServerURL string
+
+	// HTTPClient is the client used to reach the download server. It
+	// defaults to http.DefaultClient.
+	HTTPClient *http.Client
+
+	// Progress, if not nil, is called while downloading a parser with the
+	// number of bytes downloaded so far and the size of the archive. It is
+	// called once with done equal to total when the download completes.
+	Progress func(parserName string, done, total int64)
+}
+
+// Manager installs, updates and removes parsers and runs them on projects.
+// It is safe for concurrent use, except for the concurrent installation or
+// removal of the same parser.
+type Manager struct {
+	parsersDir string
+	tempDir    string
+	serverURL  string
+	client     *http.Client
+	progress   func(parserName string, done, total int64)
+}
+
+// New creates a Manager configured by opts.
+func New(opts Options) *Manager {
+	m := &Manager{
+		parsersDir: opts.ParsersDir,
+		tempDir:    opts.TempDir,
+		serverURL:  opts.ServerURL,
+		client:     opts.HTTPClient,
+		progress:   opts.Progress,
+	}
+
+	if len(m.parsersDir) == 0 {
+		m.parsersDir = config.Resolve(".", nil).ParsersDir()
+	}
+	if len(m.tempDir) == 0 {
+		m.tempDir = os.TempDir()
+	}
+	if len(m.serverURL) == 0 {
+		m.serverURL = DefaultServerURL
+	}
+	if m.client == nil {
+		m.client = http.DefaultClient
+	}
+	return m
+}
+
+// ParsersDir returns the directory where the parsers are installed.
+func (m *Manager) ParsersDir() string {
+	return m.parsersDir
+}
+
+// ParserName returns the name of the parser of a language, e.g. "parser-go"
+// for "go". Parser names are returned unchanged.
+func ParserName(lang string) string {
+	if strings.HasPrefix(lang, parserPrefix) {
+		return lang
+	}
+	return parserPrefix + lang
+}
+
+// parserDir returns the installation directory of a parser.
+func (m *Manager) parserDir(parserName string) string {
+	return filepath.Join(m.parsersDir, parserName)
+}
+
+// checksumPath returns the path of the checksum file of a parser.
+func (m *Manager) checksumPath(parserName string) string {
+	return filepath.Join(m.parserDir(parserName), config.ChecksumFileName)
+}
+
+// Install downloads and installs a parser, given by its language or its
+// name. It returns an *AlreadyInstalledError if the parser is already
+// installed.
+func (m *Manager) Install(ctx context.Context, lang string) error {
+	parserName := ParserName(lang)
+	if m.isInstalled(parserName) {
+		return &AlreadyInstalledError{Parser: parserName}
+	}
+	return m.install(ctx, parserName)
+}
+
+// Update replaces an installed parser, given by its language or its name, by
+// the version of the download server. It tells whether the parser was
+// updated: it is not when the latest version is already installed. It
+// returns a *NotInstalledError if the parser is not installed.
+func (m *Manager) Update(ctx context.Context, lang string) (bool, error) {
+	p, err := m.Installed(lang)
+	if err != nil {
+		return false, err
+	}
+
+	localSum, err := p.Checksum()
+	if err != nil {
+		return false, err
+	}
+
+	remoteSum, err := m.remoteChecksum(ctx, p.Name)
+	if err != nil {
+		return false, err
+	}
+
+	if localSum == remoteSum {
+		return false, nil
+	}
+
+	if err = m.Remove(p.Name); err != nil {
+		return false, err
+	}
+	if err = m.install(ctx, p.Name); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// Remove removes an installed parser, given by its language or its name. It
+// returns a *NotInstalledError if the parser is not installed.
+func (m *Manager) Remove(lang string) error {
+	p, err := m.Installed(lang)
+	if err != nil {
+		return err
+	}
+
+	if err = os.RemoveAll(p.Dir); err != nil {
+		return &FileError{Op: "remove", Path: p.Dir, Err: err}
+	}
+	return nil
+}
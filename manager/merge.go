@@ -0,0 +1,266 @@
+// Copyright 2014-2015 The DevMine authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package manager
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/DevMine/srcanlzr/src"
+
+	"github.com/DevMine/srctool/log"
+)
+
+// Merge modes, telling what to do when several parsers claim the same
+// language or the same file.
+const (
+	MergeKeep   = "keep"   // keep the results of all parsers
+	MergePrefer = "prefer" // keep the results of the preferred parser(s)
+	MergeError  = "error"  // abort the merge
+)
+
+// MergeStrategy defines how conflicts between parsers are handled. The zero
+// value keeps the results of all parsers.
+type MergeStrategy struct {
+	mode string
+
+	// prefer lists the parsers to prefer, by decreasing priority, when mode
+	// is MergePrefer.
+	prefer []string
+}
+
+// ParseMergeStrategy parses a merge strategy of the form "keep", "error" or
+// "prefer:name1,name2,...", where names are the names of the merged outputs
+// (the language of the parser or the path of a saved parse result).
+func ParseMergeStrategy(s string) (MergeStrategy, error) {
+	switch {
+	case s == "" || s == MergeKeep:
+		return MergeStrategy{mode: MergeKeep}, nil
+	case s == MergeError:
+		return MergeStrategy{mode: MergeError}, nil
+	case strings.HasPrefix(s, MergePrefer+":"):
+		var prefer []string
+		for _, p := range strings.Split(strings.TrimPrefix(s, MergePrefer+":"), ",") {
+			if p = strings.TrimSpace(p); len(p) > 0 {
+				prefer = append(prefer, p)
+			}
+		}
+		if len(prefer) == 0 {
+			return MergeStrategy{}, errors.New("no parser given to the prefer merge strategy")
+		}
+		return MergeStrategy{mode: MergePrefer, prefer: prefer}, nil
+	}
+
+	return MergeStrategy{}, fmt.Errorf("invalid merge strategy '%s', expected keep, error or prefer:<name>", s)
+}
+
+// priority returns the priority of a parser, the lower the better.
+// Parsers that are not explicitly preferred have the lowest priority.
+func (ms MergeStrategy) priority(parser string) int {
+	for i, p := range ms.prefer {
+		if p == parser {
+			return i
+		}
+	}
+	return len(ms.prefer)
+}
+
+// Output is the decoded output of a parser.
+type Output struct {
+	// Parser is the name of the output: the language of the parser or the
+	// path of a saved parse result.
+	Parser string
+
+	Project *src.Project
+}
+
+type byParser []Output
+
+func (ps byParser) Len() int           { return len(ps) }
+func (ps byParser) Swap(i, j int)      { ps[i], ps[j] = ps[j], ps[i] }
+func (ps byParser) Less(i, j int) bool { return ps[i].Parser < ps[j].Parser }
+
+// Merge merges the outputs of several parsers into a single project.
+// Outputs are sorted by parser name before being merged so that identical
+// inputs always produce identical outputs.
+func Merge(outs []Output, ms MergeStrategy) (*src.Project, error) {
+	sort.Sort(byParser(outs))
+
+	if err := resolveConflicts(outs, ms); err != nil {
+		return nil, err
+	}
+
+	prjs := make([]*src.Project, 0, len(outs))
+	for _, out := range outs {
+		prjs = append(prjs, out.Project)
+	}
+
+	prj, err := src.MergeAll(prjs...)
+	if err != nil {
+		log.Debug(err)
+		return nil, errors.New("failed to merge all JSON")
+	}
+	return prj, nil
+}
+
+// resolveConflicts looks for languages and files claimed by more than one
+// parser and handles them according to the merge strategy.
+func resolveConflicts(outs []Output, ms MergeStrategy) error {
+	if ms.mode != MergeError && ms.mode != MergePrefer {
+		return nil
+	}
+
+	langOwner := make(map[string]string)
+	fileOwner := make(map[string]string)
+
+	// Parsers are visited by priority, so that the first claim of a language
+	// or a file is the one of the preferred parser. Conflicts between parsers
+	// of the same priority, none of them being listed, cannot be resolved
+	// and abort the merge as with the error strategy.
+	order := make([]int, len(outs))
+	for i := range order {
+		order[i] = i
+	}
+	sort.Stable(byPriority{order, outs, ms})
+
+	for _, i := range order {
+		out := outs[i]
+		if out.Project == nil {
+			continue
+		}
+
+		dropLangs := make(map[string]struct{})
+		for _, lang := range projectLanguages(out.Project) {
+			owner, ok := langOwner[lang]
+			if !ok {
+				langOwner[lang] = out.Parser
+				continue
+			}
+			if ms.mode == MergeError {
+				return &ConflictError{Kind: "language", Name: lang, Parsers: [2]string{owner, out.Parser}}
+			}
+			if ms.priority(owner) == ms.priority(out.Parser) {
+				return &ConflictError{Kind: "language", Name: lang, Parsers: [2]string{owner, out.Parser}, Unlisted: true}
+			}
+			log.Debug("merge: preferring ", owner, " over ", out.Parser, " for language ", lang)
+			dropLangs[lang] = struct{}{}
+		}
+
+		dropFiles := make(map[string]struct{})
+		for _, path := range projectFiles(out.Project) {
+			owner, ok := fileOwner[path]
+			if !ok {
+				fileOwner[path] = out.Parser
+				continue
+			}
+			if ms.mode == MergeError {
+				return &ConflictError{Kind: "file", Name: path, Parsers: [2]string{owner, out.Parser}}
+			}
+			if ms.priority(owner) == ms.priority(out.Parser) {
+				return &ConflictError{Kind: "file", Name: path, Parsers: [2]string{owner, out.Parser}, Unlisted: true}
+			}
+			log.Debug("merge: preferring ", owner, " over ", out.Parser, " for file ", path)
+			dropFiles[path] = struct{}{}
+		}
+
+		dropClaims(out.Project, dropLangs, dropFiles)
+	}
+
+	return nil
+}
+
+type byPriority struct {
+	order []int
+	outs  []Output
+	ms    MergeStrategy
+}
+
+func (bp byPriority) Len() int      { return len(bp.order) }
+func (bp byPriority) Swap(i, j int) { bp.order[i], bp.order[j] = bp.order[j], bp.order[i] }
+func (bp byPriority) Less(i, j int) bool {
+	return bp.ms.priority(bp.outs[bp.order[i]].Parser) < bp.ms.priority(bp.outs[bp.order[j]].Parser)
+}
+
+// projectLanguages returns the languages of a project.
+func projectLanguages(prj *src.Project) []string {
+	var langs []string
+	for _, lang := range prj.Languages {
+		if lang != nil {
+			langs = append(langs, lang.Lang)
+		}
+	}
+	return langs
+}
+
+// projectFiles returns the path of all source files of a project.
+func projectFiles(prj *src.Project) []string {
+	var paths []string
+	for _, pkg := range prj.Packages {
+		if pkg == nil {
+			continue
+		}
+		for _, sf := range pkg.SourceFiles {
+			if sf != nil {
+				paths = append(paths, sf.Path)
+			}
+		}
+	}
+	return paths
+}
+
+// dropClaims removes the given languages and files from a project, as well
+// as the source files written in one of these languages.
+func dropClaims(prj *src.Project, langs, files map[string]struct{}) {
+	if len(langs) == 0 && len(files) == 0 {
+		return
+	}
+
+	var keptLangs []*src.Language
+	for _, lang := range prj.Languages {
+		if lang == nil {
+			continue
+		}
+		if _, ok := langs[lang.Lang]; !ok {
+			keptLangs = append(keptLangs, lang)
+		}
+	}
+	prj.Languages = keptLangs
+
+	var keptPkgs []*src.Package
+	for _, pkg := range prj.Packages {
+		if pkg == nil {
+			continue
+		}
+
+		var keptFiles []*src.SourceFile
+		for _, sf := range pkg.SourceFiles {
+			if sf == nil {
+				continue
+			}
+
+			_, drop := files[sf.Path]
+			if sf.Language != nil {
+				if _, ok := langs[sf.Language.Lang]; ok {
+					drop = true
+				}
+			}
+
+			if drop {
+				pkg.LoC -= sf.LoC
+				prj.LoC -= sf.LoC
+				continue
+			}
+			keptFiles = append(keptFiles, sf)
+		}
+
+		if len(keptFiles) > 0 {
+			pkg.SourceFiles = keptFiles
+			keptPkgs = append(keptPkgs, pkg)
+		}
+	}
+	prj.Packages = keptPkgs
+}
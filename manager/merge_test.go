@@ -0,0 +1,281 @@
+// Copyright 2014-2015 The DevMine authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package manager
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/DevMine/srcanlzr/src"
+)
+
+func TestParseMergeStrategy(t *testing.T) {
+	tests := []struct {
+		s      string
+		mode   string
+		prefer []string
+	}{
+		{"", MergeKeep, nil},
+		{"keep", MergeKeep, nil},
+		{"error", MergeError, nil},
+		{"prefer:go", MergePrefer, []string{"go"}},
+		{"prefer:go,java", MergePrefer, []string{"go", "java"}},
+		{"prefer: go , java ,", MergePrefer, []string{"go", "java"}},
+		{"prefer:,,c", MergePrefer, []string{"c"}},
+		{"prefer:/path/to/a.json", MergePrefer, []string{"/path/to/a.json"}},
+	}
+
+	for _, tt := range tests {
+		ms, err := ParseMergeStrategy(tt.s)
+		if err != nil {
+			t.Errorf("ParseMergeStrategy(%q): unexpected error: %v", tt.s, err)
+			continue
+		}
+		if ms.mode != tt.mode || !reflect.DeepEqual(ms.prefer, tt.prefer) {
+			t.Errorf("ParseMergeStrategy(%q) = %s %q, want %s %q", tt.s, ms.mode, ms.prefer, tt.mode, tt.prefer)
+		}
+	}
+}
+
+func TestParseMergeStrategyErrors(t *testing.T) {
+	tests := []struct {
+		s   string
+		err string
+	}{
+		{"prefer:", "no parser given to the prefer merge strategy"},
+		{"prefer: , ", "no parser given to the prefer merge strategy"},
+		{"prefer", "invalid merge strategy 'prefer'"},
+		{"Keep", "invalid merge strategy 'Keep'"},
+		{"keep:go", "invalid merge strategy 'keep:go'"},
+		{"first", "invalid merge strategy 'first'"},
+	}
+
+	for _, tt := range tests {
+		_, err := ParseMergeStrategy(tt.s)
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("ParseMergeStrategy(%q): error %v, want %q", tt.s, err, tt.err)
+		}
+	}
+}
+
+func TestMergeStrategyPriority(t *testing.T) {
+	ms, err := ParseMergeStrategy("prefer:go,java")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		parser   string
+		priority int
+	}{
+		{"go", 0},
+		{"java", 1},
+		{"c", 2},
+		{"ruby", 2},
+	}
+
+	for _, tt := range tests {
+		if p := ms.priority(tt.parser); p != tt.priority {
+			t.Errorf("priority(%q) = %d, want %d", tt.parser, p, tt.priority)
+		}
+	}
+}
+
+// testFile is a source file of a test output.
+type testFile struct {
+	path string
+	lang string
+	loc  int64
+}
+
+// testOutput builds the output of a parser from its source files, grouped in
+// packages by directory.
+func testOutput(parser string, files ...testFile) Output {
+	prj := &src.Project{Name: "p"}
+
+	pkgs := make(map[string]*src.Package)
+	langs := make(map[string]bool)
+	for _, f := range files {
+		lang := &src.Language{Lang: f.lang}
+		if !langs[f.lang] {
+			langs[f.lang] = true
+			prj.Languages = append(prj.Languages, lang)
+		}
+
+		dir := filepath.Dir(f.path)
+		pkg, ok := pkgs[dir]
+		if !ok {
+			pkg = &src.Package{Name: filepath.Base(dir), Path: dir}
+			pkgs[dir] = pkg
+			prj.Packages = append(prj.Packages, pkg)
+		}
+		pkg.SourceFiles = append(pkg.SourceFiles, &src.SourceFile{Path: f.path, Language: lang, LoC: f.loc})
+		pkg.LoC += f.loc
+		prj.LoC += f.loc
+	}
+	return Output{Parser: parser, Project: prj}
+}
+
+func TestMerge(t *testing.T) {
+	// a and b both claim util.h, a and c both claim the c language
+	a := func() Output {
+		return testOutput("a", testFile{"main.c", "c", 10}, testFile{"inc/util.h", "c", 5})
+	}
+	b := func() Output {
+		return testOutput("b", testFile{"inc/util.h", "cpp", 7}, testFile{"lib.cpp", "cpp", 20})
+	}
+	c := func() Output {
+		return testOutput("c", testFile{"other.c", "c", 3})
+	}
+
+	tests := []struct {
+		strategy string
+		outs     func() []Output
+		langs    []string
+		files    []string // path:loc of the merged source files
+		loc      int64
+		err      error
+	}{
+		{
+			strategy: "keep",
+			outs:     func() []Output { return []Output{a(), b(), c()} },
+			langs:    []string{"c", "cpp"},
+			files:    []string{"inc/util.h:5", "inc/util.h:7", "lib.cpp:20", "main.c:10", "other.c:3"},
+			loc:      45,
+		},
+		{
+			strategy: "error",
+			outs:     func() []Output { return []Output{b(), a()} },
+			err:      &ConflictError{Kind: "file", Name: "inc/util.h", Parsers: [2]string{"a", "b"}},
+		},
+		{
+			strategy: "error",
+			outs:     func() []Output { return []Output{c(), a()} },
+			err:      &ConflictError{Kind: "language", Name: "c", Parsers: [2]string{"a", "c"}},
+		},
+		{
+			strategy: "error",
+			outs:     func() []Output { return []Output{b(), c()} },
+			langs:    []string{"c", "cpp"},
+			files:    []string{"inc/util.h:7", "lib.cpp:20", "other.c:3"},
+			loc:      30,
+		},
+		{
+			// the files of b claimed by a and the c language of c are
+			// dropped
+			strategy: "prefer:a",
+			outs:     func() []Output { return []Output{c(), b(), a()} },
+			langs:    []string{"c", "cpp"},
+			files:    []string{"inc/util.h:5", "lib.cpp:20", "main.c:10"},
+			loc:      35,
+		},
+		{
+			strategy: "prefer:b,a",
+			outs:     func() []Output { return []Output{a(), b()} },
+			langs:    []string{"c", "cpp"},
+			files:    []string{"inc/util.h:7", "lib.cpp:20", "main.c:10"},
+			loc:      37,
+		},
+		{
+			// a is preferred over b and c, but nothing tells which of b
+			// and c to keep
+			strategy: "prefer:a",
+			outs: func() []Output {
+				return []Output{testOutput("b", testFile{"x.go", "go", 1}), testOutput("c", testFile{"y.go", "go", 2})}
+			},
+			err: &ConflictError{Kind: "language", Name: "go", Parsers: [2]string{"b", "c"}, Unlisted: true},
+		},
+		{
+			strategy: "prefer:c",
+			outs:     func() []Output { return []Output{b(), a()} },
+			err:      &ConflictError{Kind: "file", Name: "inc/util.h", Parsers: [2]string{"a", "b"}, Unlisted: true},
+		},
+	}
+
+	for _, tt := range tests {
+		ms, err := ParseMergeStrategy(tt.strategy)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		prj, err := Merge(tt.outs(), ms)
+		if !reflect.DeepEqual(err, tt.err) {
+			t.Errorf("%s: error %v, want %v", tt.strategy, err, tt.err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+
+		var langs, files []string
+		for _, lang := range prj.Languages {
+			langs = append(langs, lang.Lang)
+		}
+		for _, pkg := range prj.Packages {
+			for _, sf := range pkg.SourceFiles {
+				files = append(files, fmt.Sprintf("%s:%d", sf.Path, sf.LoC))
+			}
+		}
+		sort.Strings(langs)
+		sort.Strings(files)
+
+		if !reflect.DeepEqual(langs, tt.langs) {
+			t.Errorf("%s: languages %q, want %q", tt.strategy, langs, tt.langs)
+		}
+		if !reflect.DeepEqual(files, tt.files) {
+			t.Errorf("%s: files %q, want %q", tt.strategy, files, tt.files)
+		}
+		if prj.LoC != tt.loc {
+			t.Errorf("%s: %d LoC, want %d", tt.strategy, prj.LoC, tt.loc)
+		}
+	}
+}
+
+func TestMergeDeterministic(t *testing.T) {
+	outs := func() []Output {
+		return []Output{
+			testOutput("a", testFile{"main.c", "c", 10}, testFile{"inc/util.h", "c", 5}),
+			testOutput("b", testFile{"inc/util.h", "cpp", 7}, testFile{"lib.cpp", "cpp", 20}),
+			testOutput("c", testFile{"main.go", "go", 4}),
+		}
+	}
+
+	for _, strategy := range []string{"keep", "prefer:b"} {
+		ms, err := ParseMergeStrategy(strategy)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var want []byte
+		for _, perm := range [][]int{{0, 1, 2}, {2, 1, 0}, {1, 2, 0}} {
+			in := outs()
+			shuffled := make([]Output, len(in))
+			for i, j := range perm {
+				shuffled[i] = in[j]
+			}
+
+			prj, err := Merge(shuffled, ms)
+			if err != nil {
+				t.Fatalf("%s: unexpected error: %v", strategy, err)
+			}
+			bs, err := json.Marshal(prj)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if want == nil {
+				want = bs
+			} else if !bytes.Equal(bs, want) {
+				t.Errorf("%s: merging in order %v gives\n%s\nwant\n%s", strategy, perm, bs, want)
+			}
+		}
+	}
+}
@@ -0,0 +1,241 @@
+// Copyright 2014-2015 The DevMine authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package manager
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/DevMine/srcanlzr/src"
+
+	"github.com/DevMine/srctool/log"
+)
+
+// ParseOptions holds the options of a parsing. The zero value runs all
+// installed parsers and keeps all their results.
+type ParseOptions struct {
+	// Strategy tells how conflicts between parsers are handled.
+	Strategy MergeStrategy
+
+	// LogDir is the directory where the standard error output of each
+	// parser is saved. Nothing is saved when empty.
+	LogDir string
+
+	// Shard tells how projects are split for the parsers accepting a list
+	// of files.
+	Shard ShardOptions
+
+	// Parsers restricts the parsing to these parsers, given by their
+	// language or their name, when not empty.
+	Parsers []string
+
+	// Servers holds the parsers running in server mode. When nil, the
+	// servers are started for a single parsing.
+	Servers *ServerPool
+
+	// Diagnostics collects the diagnostics emitted by the parsers. They are
+	// dropped when nil.
+	Diagnostics *Diagnostics
+
+	// Cache holds the results of the previous parsings of the project, to
+	// be reused for the unchanged files. Nothing is cached when nil.
+	Cache *ParseCache
+}
+
+// Parse runs the installed parsers on the project located at projectPath,
+// validates their outputs and merges them into a single project. It fails if
+// a parser fails. Invalid outputs are reported to the log and left out of
+// the result, ErrNoOutput being returned if no output is valid. If ctx is
+// done, the running parsers are killed and ctx.Err() is returned.
+func (m *Manager) Parse(ctx context.Context, projectPath string, opts ParseOptions) (*src.Project, error) {
+	parsers, err := m.List()
+	if err != nil {
+		return nil, err
+	}
+	if len(opts.Parsers) > 0 {
+		parsers = SelectParsers(parsers, opts.Parsers)
+	}
+	if len(parsers) == 0 {
+		return nil, ErrNoParsers
+	}
+
+	results, err := Run(ctx, projectPath, parsers, opts)
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return MergeResults(results, opts.Strategy)
+}
+
+// Result is the raw output of a parser or, for the parsers run in shards,
+// the already validated and merged project.
+type Result struct {
+	// Parser is the name of the parser.
+	Parser string
+
+	// Err is the error of the parser, if it failed.
+	Err error
+
+	out *bytes.Buffer
+	prj *src.Project
+}
+
+// Run runs the given parsers concurrently on the project located at
+// projectPath and returns their raw outputs, to be merged by MergeResults.
+// Parsers supporting the server mode are sent a request through
+// opts.Servers or, when nil, through servers started for this run only. When
+// some parsers fail, the outputs of the others are returned along with the
+// last error.
+func Run(ctx context.Context, projectPath string, parsers []Parser, opts ParseOptions) ([]Result, error) {
+	if opts.Diagnostics == nil {
+		opts.Diagnostics = new(Diagnostics)
+	}
+	if opts.Shard.Mode != ShardNone {
+		var err error
+		if opts.Shard, err = ParseShardOptions(opts.Shard.Mode, opts.Shard.Size, opts.Shard.Jobs); err != nil {
+			return nil, err
+		}
+	}
+	if opts.Servers == nil {
+		opts.Servers = NewServerPool(opts.LogDir)
+		defer opts.Servers.Close()
+	}
+
+	c := make(chan Result)
+	for _, p := range parsers {
+		if opts.Cache != nil {
+			go opts.Cache.routine(ctx, p, projectPath, opts, c)
+			continue
+		}
+		go parserRoutine(ctx, p, projectPath, opts, c)
+	}
+
+	var results []Result
+	var parseErr error
+
+	start := time.Now()
+	for totalWaits := len(parsers); totalWaits > 0; totalWaits-- {
+		select {
+		case res := <-c:
+			fields := log.Fields{"parser": res.Parser, "project": projectPath, "duration": time.Since(start)}
+			if res.Err != nil {
+				fields.Fail(res.Err)
+				parseErr = res.Err
+				continue
+			}
+			fields.Info(res.Parser, " done")
+			results = append(results, res)
+		}
+	}
+
+	close(c)
+
+	return results, parseErr
+}
+
+// MergeResults validates the raw outputs of the parsers and merges them into
+// a single project. Invalid outputs are reported to the log and rejected.
+func MergeResults(results []Result, ms MergeStrategy) (*src.Project, error) {
+	var outs []Output
+	for _, res := range results {
+		if res.prj != nil {
+			outs = append(outs, Output{Parser: Language(res.Parser), Project: res.prj})
+			continue
+		}
+		if res.out == nil {
+			continue
+		}
+
+		prj, err := decodeProjectJSON(res.out.Bytes())
+		if err != nil {
+			log.Fail(&OutputError{Parser: res.Parser, Err: err})
+			continue
+		}
+
+		outs = append(outs, Output{Parser: Language(res.Parser), Project: prj})
+	}
+
+	if len(outs) == 0 {
+		return nil, ErrNoOutput
+	}
+
+	log.Info("merging JSON outputs")
+	return Merge(outs, ms)
+}
+
+// parserRoutine runs a language parser on a project, in shards, through its
+// server or as a command depending on the parser and the options.
+func parserRoutine(ctx context.Context, p Parser, projectPath string, opts ParseOptions, c chan Result) {
+	if p.Meta.FileList && opts.Shard.Mode != ShardNone {
+		shardRoutine(ctx, p, projectPath, opts, c)
+		return
+	}
+	if p.Meta.Server {
+		serverRoutine(ctx, opts.Servers, p, projectPath, opts.Diagnostics, c)
+		return
+	}
+	cmdRoutine(ctx, p, projectPath, opts.LogDir, opts.Diagnostics, c)
+}
+
+// cmdRoutine runs a language parser on a project. The standard error output
+// of the parser is saved into logDir, if not empty, and its diagnostics are
+// collected into diags.
+func cmdRoutine(ctx context.Context, p Parser, projectPath, logDir string, diags *Diagnostics, c chan Result) {
+	out, err := runParserCmd(ctx, p, projectPath, nil, parserLogFile(logDir, p.Name), diags)
+	if err != nil {
+		c <- Result{Parser: p.Name, Err: err}
+		return
+	}
+	c <- Result{Parser: p.Name, out: out}
+}
+
+// runParserCmd runs a language parser on a project and returns its output.
+// When files is not nil, the parser is asked to parse these files only: they
+// are written on its standard input, one per line, relative to the project
+// path. The standard error output of the parser is saved into logFile, if not
+// empty, and its diagnostics are collected into diags. The parser is killed
+// if ctx is done before it exits.
+func runParserCmd(ctx context.Context, p Parser, projectPath string, files []string, logFile string, diags *Diagnostics) (*bytes.Buffer, error) {
+	outBuf := new(bytes.Buffer)
+
+	errOut, err := newParserStderr(p.Name, logFile, diags)
+	if err != nil {
+		return nil, err
+	}
+
+	cmd := exec.CommandContext(ctx, p.Bin(), projectPath)
+	if files != nil {
+		cmd = exec.CommandContext(ctx, p.Bin(), fileListFlag, projectPath)
+		cmd.Stdin = strings.NewReader(strings.Join(files, "\n") + "\n")
+	}
+	cmd.Stdout = outBuf
+	cmd.Stderr = errOut
+
+	log.Debug("command: ", strings.Join(cmd.Args, " "))
+
+	err = cmd.Run()
+	if cerr := errOut.Close(); cerr != nil {
+		log.Debug(cerr)
+	}
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	if err != nil {
+		return nil, &ParserError{Parser: p.Name, Err: err}
+	}
+
+	if outBuf.Len() == 0 {
+		return nil, &ParserError{Parser: p.Name, Err: errors.New("no output produced")}
+	}
+
+	return outBuf, nil
+}
@@ -0,0 +1,242 @@
+// Copyright 2014-2015 The DevMine authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package manager
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/DevMine/srctool/config"
+	"github.com/DevMine/srctool/log"
+)
+
+// ParserMeta holds the metadata of a parser, declared in the optional
+// parser.json file of the parser directory.
+type ParserMeta struct {
+	// Extensions lists the extensions of the files handled by the parser,
+	// including the leading dot.
+	Extensions []string `json:"extensions"`
+
+	// Server tells whether the parser can run as a long-running server,
+	// receiving parse requests in JSON-RPC over its standard input.
+	Server bool `json:"server"`
+
+	// FileList tells whether the parser accepts a list of files to parse,
+	// which allows to split large projects into shards.
+	FileList bool `json:"file_list"`
+
+	// Options are parser specific options, sent along with each parse
+	// request in server mode.
+	Options map[string]interface{} `json:"options"`
+}
+
+// defaultExtensions maps the languages to the extensions of their source
+// files, for the parsers that do not declare them.
+var defaultExtensions = map[string][]string{
+	"c":          {".c", ".h"},
+	"cpp":        {".cpp", ".cc", ".cxx", ".hpp", ".hh", ".hxx", ".h"},
+	"csharp":     {".cs"},
+	"go":         {".go"},
+	"haskell":    {".hs"},
+	"java":       {".java"},
+	"javascript": {".js"},
+	"objc":       {".m", ".h"},
+	"perl":       {".pl", ".pm"},
+	"php":        {".php"},
+	"python":     {".py"},
+	"ruby":       {".rb"},
+	"rust":       {".rs"},
+	"scala":      {".scala"},
+	"swift":      {".swift"},
+}
+
+// Parser is an installed parser.
+type Parser struct {
+	Name string // directory name, e.g. "parser-go"
+	Dir  string
+	Meta ParserMeta
+}
+
+// Bin returns the path of the parser executable.
+func (p Parser) Bin() string {
+	return filepath.Join(p.Dir, "parser")
+}
+
+// Language returns the language of the parser.
+func (p Parser) Language() string {
+	return Language(p.Name)
+}
+
+// Extensions returns the extensions of the files handled by the parser, or
+// nil if they are unknown.
+func (p Parser) Extensions() []string {
+	if len(p.Meta.Extensions) > 0 {
+		return p.Meta.Extensions
+	}
+	return defaultExtensions[p.Language()]
+}
+
+// Handles tells whether the parser handles the file at path. Parsers whose
+// extensions are unknown are assumed to handle every file.
+func (p Parser) Handles(path string) bool {
+	exts := p.Extensions()
+	if exts == nil {
+		return true
+	}
+
+	ext := strings.ToLower(filepath.Ext(path))
+	for _, e := range exts {
+		if ext == e {
+			return true
+		}
+	}
+	return false
+}
+
+// Checksum returns the MD5 sum of the archive the parser was installed from.
+func (p Parser) Checksum() (string, error) {
+	path := filepath.Join(p.Dir, config.ChecksumFileName)
+	bs, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", &FileError{Op: "read", Path: path, Err: err}
+	}
+	return strings.TrimSpace(string(bs)), nil
+}
+
+// Language returns the language of a parser given by its name or the name of
+// its archive, e.g. "go" for "parser-go.zip".
+func Language(parserName string) string {
+	name := strings.TrimSuffix(parserName, filepath.Ext(parserName))
+	return strings.TrimPrefix(name, parserPrefix)
+}
+
+// List returns the installed parsers along with their metadata, sorted by
+// name.
+func (m *Manager) List() ([]Parser, error) {
+	fis, err := ioutil.ReadDir(m.parsersDir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, &FileError{Op: "read", Path: m.parsersDir, Err: err}
+	}
+
+	var parsers []Parser
+	for _, fi := range fis {
+		if !fi.IsDir() {
+			continue
+		}
+
+		if marched, err := filepath.Match(parserPrefix+"*", fi.Name()); err != nil {
+			log.Debug(err)
+			continue
+		} else if !marched {
+			continue
+		}
+
+		p, err := m.parser(fi.Name())
+		if err != nil {
+			return nil, err
+		}
+		parsers = append(parsers, p)
+	}
+	return parsers, nil
+}
+
+// Installed returns an installed parser, given by its language or its name.
+// It returns a *NotInstalledError if the parser is not installed.
+func (m *Manager) Installed(lang string) (Parser, error) {
+	parserName := ParserName(lang)
+	if !m.isInstalled(parserName) {
+		return Parser{}, &NotInstalledError{Parser: parserName}
+	}
+	return m.parser(parserName)
+}
+
+// isInstalled tells whether a parser is installed.
+func (m *Manager) isInstalled(parserName string) bool {
+	fi, err := os.Stat(m.parserDir(parserName))
+	if err != nil {
+		log.Debug(err)
+		return false
+	}
+	return fi.IsDir()
+}
+
+// parser returns the installed parser named parserName along with its
+// metadata.
+func (m *Manager) parser(parserName string) (Parser, error) {
+	p := Parser{Name: parserName, Dir: m.parserDir(parserName)}
+
+	path := filepath.Join(p.Dir, config.MetadataFileName)
+	bs, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return p, nil
+	} else if err != nil {
+		return p, &FileError{Op: "read", Path: path, Err: err}
+	}
+
+	if err = json.Unmarshal(bs, &p.Meta); err != nil {
+		log.Debug(err)
+		return p, &MetadataError{Parser: parserName, Err: err}
+	}
+	return p, nil
+}
+
+// parserFiles returns the files of the project at projectPath handled by
+// parser p, relative to the project path. Hidden files and directories are
+// skipped. It returns nil if the extensions handled by the parser are
+// unknown.
+func parserFiles(p Parser, projectPath string) ([]string, error) {
+	if p.Extensions() == nil {
+		return nil, nil
+	}
+
+	var files []string
+	err := filepath.Walk(projectPath, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if path != projectPath && strings.HasPrefix(fi.Name(), ".") {
+			if fi.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		if fi.Mode().IsRegular() && p.Handles(path) {
+			rel, err := filepath.Rel(projectPath, path)
+			if err != nil {
+				return err
+			}
+			files = append(files, rel)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, &FileError{Op: "list the files of", Path: projectPath, Err: err}
+	}
+	return files, nil
+}
+
+// SelectParsers returns the parsers whose name or language is listed in
+// names.
+func SelectParsers(parsers []Parser, names []string) []Parser {
+	wanted := make(map[string]bool)
+	for _, name := range names {
+		wanted[ParserName(name)] = true
+	}
+
+	var selected []Parser
+	for _, p := range parsers {
+		if wanted[p.Name] {
+			selected = append(selected, p)
+		}
+	}
+	return selected
+}
@@ -0,0 +1,325 @@
+// Copyright 2014-2015 The DevMine authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package manager
+
+import (
+	"archive/zip"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mitchellh/ioprogress"
+
+	"github.com/DevMine/srctool/config"
+	"github.com/DevMine/srctool/log"
+)
+
+// RemoteParser is a parser provided by the download server.
+type RemoteParser struct {
+	Name     string // e.g. "parser-go"
+	Checksum string // MD5 sum of the archive
+}
+
+// Language returns the language of the parser.
+func (rp RemoteParser) Language() string {
+	return Language(rp.Name)
+}
+
+// ListRemote returns the parsers provided by the download server for the
+// current OS and architecture.
+func (m *Manager) ListRemote(ctx context.Context) ([]RemoteParser, error) {
+	md5sums, err := m.fetchChecksums(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var parsers []RemoteParser
+	for _, line := range strings.Split(md5sums, "\n") {
+		tmp := strings.Split(line, " ")
+		if len(tmp) != 2 {
+			continue
+		}
+
+		path, archive := filepath.Split(tmp[1])
+		if isSupported(path) {
+			parsers = append(parsers, RemoteParser{Name: removeExt(archive), Checksum: tmp[0]})
+		}
+	}
+	return parsers, nil
+}
+
+// isSupported checks whether the current OS and architecture are supported.
+func isSupported(path string) bool {
+	suppPath := filepath.Join(runtime.GOOS, runtime.GOARCH) + string(filepath.Separator)
+	return path == suppPath
+}
+
+// removeExt removes the extension of a given file name.
+func removeExt(fileName string) string {
+	ext := filepath.Ext(fileName)
+	return fileName[0 : len(fileName)-len(ext)]
+}
+
+// get sends a GET request to the download server. Responses with an error
+// status are turned into a *NetworkError.
+func (m *Manager) get(ctx context.Context, op, url string) (*http.Response, error) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, &NetworkError{Op: op, URL: url, Err: err}
+	}
+
+	resp, err := m.client.Do(req.WithContext(ctx))
+	if err != nil {
+		log.Debug(err)
+		return nil, &NetworkError{Op: op, URL: url, Err: err}
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, &NetworkError{Op: op, URL: url, Err: fmt.Errorf("server answered %s", resp.Status)}
+	}
+	return resp, nil
+}
+
+// fetchChecksums fetches the MD5SUMS file of the download server.
+func (m *Manager) fetchChecksums(ctx context.Context) (string, error) {
+	url := config.RemoteChecksumsPath(m.serverURL)
+
+	resp, err := m.get(ctx, "fetch the MD5SUMS file", url)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	bs, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		log.Debug(err)
+		return "", &NetworkError{Op: "download the MD5SUMS file", URL: url, Err: err}
+	}
+
+	return string(bs), nil
+}
+
+// remoteChecksum returns the MD5 sum of the archive of a parser published
+// by the download server.
+func (m *Manager) remoteChecksum(ctx context.Context, parserName string) (string, error) {
+	checksums, err := m.fetchChecksums(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	for _, line := range strings.Split(checksums, "\n") {
+		tmp := strings.Split(line, " ")
+		if len(tmp) != 2 {
+			continue
+		}
+
+		sum, remotePath := tmp[0], tmp[1]
+
+		if remotePath == config.RemoteParserPath(parserName) {
+			return sum, nil
+		}
+	}
+
+	return "", &NotAvailableError{Parser: parserName}
+}
+
+// install downloads, verifies and uncompresses a parser, then records the
+// MD5 sum of its archive into the parser directory.
+func (m *Manager) install(ctx context.Context, parserName string) error {
+	archive, err := m.download(ctx, parserName)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := os.Remove(archive); err != nil {
+			log.Debug(err)
+		}
+	}()
+
+	if err := uncompressParser(archive, m.parsersDir); err != nil {
+		log.Debug(err)
+		return &FileError{Op: "uncompress", Path: archive, Err: err}
+	}
+
+	md5sum, err := checksum(archive)
+	if err != nil {
+		return err
+	}
+
+	if err := ioutil.WriteFile(m.checksumPath(parserName), []byte(md5sum), 0644); err != nil {
+		log.Debug(err)
+		return &FileError{Op: "write", Path: m.checksumPath(parserName), Err: err}
+	}
+
+	log.Fields{"parser": parserName}.Debug(parserName, " installed into ", m.parserDir(parserName))
+	return nil
+}
+
+// download downloads the archive of a parser into a new file of the
+// temporary directory and verifies its MD5 sum. It returns the path of the
+// archive, to be removed by the caller. The archive is removed on failure.
+func (m *Manager) download(ctx context.Context, parserName string) (_ string, err error) {
+	url := config.ParserURI(m.serverURL, parserName)
+	op := "download " + parserName
+
+	resp, err := m.get(ctx, op, url)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	contentLen := resp.Header.Get("Content-Length")
+	size, err := strconv.ParseInt(contentLen, 10, 64)
+	if err != nil {
+		log.Debug(err)
+		return "", &NetworkError{Op: op, URL: url, Err: fmt.Errorf("malformed or missing Content-Length header")}
+	}
+
+	if err = os.MkdirAll(m.tempDir, 0755); err != nil {
+		return "", &FileError{Op: "create", Path: m.tempDir, Err: err}
+	}
+
+	// a unique name, so that concurrent downloads do not collide
+	out, err := ioutil.TempFile(m.tempDir, parserName+"-")
+	if err != nil {
+		return "", &FileError{Op: "create a file in", Path: m.tempDir, Err: err}
+	}
+	archive := out.Name()
+	defer func() {
+		out.Close()
+		if err != nil {
+			os.Remove(archive)
+		}
+	}()
+
+	var r io.Reader = resp.Body
+	if m.progress != nil {
+		r = &ioprogress.Reader{
+			Reader:       resp.Body,
+			Size:         size,
+			DrawInterval: time.Millisecond,
+			DrawFunc: func(progress, total int64) error {
+				// the end of the download is notified below, once
+				if progress >= 0 && progress < total {
+					m.progress(parserName, progress, total)
+				}
+				return nil
+			},
+		}
+	}
+
+	if _, err = io.Copy(out, r); err != nil {
+		log.Debug(err)
+		return "", &NetworkError{Op: op, URL: url, Err: err}
+	}
+	if m.progress != nil {
+		m.progress(parserName, size, size)
+	}
+	log.Debug(parserName, " successfully downloaded")
+
+	expectedSum, err := m.remoteChecksum(ctx, parserName)
+	if err != nil {
+		return "", err
+	}
+
+	md5sum, err := checksum(archive)
+	if err != nil {
+		return "", err
+	}
+
+	log.Debug("expected MD5 sum:", expectedSum)
+	log.Debug("MD5 sum found:", md5sum)
+
+	if md5sum != expectedSum {
+		return "", &ChecksumError{Parser: parserName, Expected: expectedSum, Actual: md5sum}
+	}
+	return archive, nil
+}
+
+// uncompressParser uncompresses the archive of a parser into the target
+// directory. Archives holding absolute paths or paths escaping the target
+// directory are rejected before anything is extracted.
+func uncompressParser(archive, target string) error {
+	r, err := zip.OpenReader(archive)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	for _, f := range r.File {
+		name := filepath.Clean(filepath.FromSlash(f.Name))
+		if filepath.IsAbs(name) || name == ".." || strings.HasPrefix(name, ".."+string(filepath.Separator)) {
+			return fmt.Errorf("invalid path in archive: %s", f.Name)
+		}
+	}
+
+	for _, f := range r.File {
+		path := filepath.Join(target, filepath.FromSlash(f.Name))
+
+		// create target file or directory
+		if f.FileInfo().IsDir() {
+			if err := os.MkdirAll(path, f.Mode()); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if err := extractZipFile(f, path); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// extractZipFile writes the content of a file of a zip archive at path.
+func extractZipFile(f *zip.File, path string) error {
+	rc, err := f.Open()
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	out, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	if err = out.Chmod(f.Mode()); err != nil {
+		return err
+	}
+
+	// unzip file content
+	_, err = io.Copy(out, rc)
+	return err
+}
+
+// checksum computes the MD5 checksum of the file at path.
+func checksum(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", &FileError{Op: "open", Path: path, Err: err}
+	}
+	defer f.Close()
+
+	h := md5.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", &FileError{Op: "read", Path: path, Err: err}
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
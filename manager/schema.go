@@ -0,0 +1,267 @@
+// Copyright 2014-2015 The DevMine authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package manager
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/DevMine/srcanlzr/src"
+)
+
+// SchemaVersion is the version of the project schema, the src.Project model
+// of srcanlzr, that srctool validates and writes. Documents may declare the
+// version they follow in a "schema_version" field, those declaring none
+// being assumed to follow this one.
+const SchemaVersion = 1
+
+// maxSchemaErrors is the maximum number of schema errors reported for a
+// single document.
+const maxSchemaErrors = 20
+
+// jsonKind is the kind of a JSON value.
+type jsonKind string
+
+// JSON value kinds.
+const (
+	kindAny    jsonKind = "any"
+	kindObject jsonKind = "object"
+	kindArray  jsonKind = "array"
+	kindString jsonKind = "string"
+	kindNumber jsonKind = "number"
+	kindBool   jsonKind = "boolean"
+	kindNull   jsonKind = "null"
+)
+
+// schema describes the expected structure of a JSON value.
+type schema struct {
+	kind jsonKind
+
+	// fields of an object, unknown fields are allowed
+	fields map[string]field
+
+	// elements of an array
+	elem *schema
+}
+
+type field struct {
+	required bool
+	schema   *schema
+}
+
+func object(fields map[string]field) *schema { return &schema{kind: kindObject, fields: fields} }
+func arrayOf(elem *schema) *schema           { return &schema{kind: kindArray, elem: elem} }
+func required(s *schema) field               { return field{required: true, schema: s} }
+func optional(s *schema) field               { return field{schema: s} }
+
+var (
+	stringSchema = &schema{kind: kindString}
+	numberSchema = &schema{kind: kindNumber}
+
+	// declSchema is the schema of declarations (functions, classes, ...).
+	declSchema = object(map[string]field{
+		"name": optional(stringSchema),
+		"loc":  optional(numberSchema),
+	})
+
+	languageSchema = object(map[string]field{
+		"language":  required(stringSchema),
+		"paradigms": optional(arrayOf(stringSchema)),
+	})
+
+	sourceFileSchema = object(map[string]field{
+		"path":            required(stringSchema),
+		"language":        optional(languageSchema),
+		"imports":         optional(arrayOf(stringSchema)),
+		"type_specifiers": optional(arrayOf(declSchema)),
+		"structs":         optional(arrayOf(declSchema)),
+		"constants":       optional(arrayOf(declSchema)),
+		"variables":       optional(arrayOf(declSchema)),
+		"functions":       optional(arrayOf(declSchema)),
+		"interfaces":      optional(arrayOf(declSchema)),
+		"classes":         optional(arrayOf(declSchema)),
+		"enums":           optional(arrayOf(declSchema)),
+		"traits":          optional(arrayOf(declSchema)),
+		"loc":             optional(numberSchema),
+	})
+
+	packageSchema = object(map[string]field{
+		"doc":          optional(arrayOf(stringSchema)),
+		"name":         required(stringSchema),
+		"path":         required(stringSchema),
+		"source_files": optional(arrayOf(sourceFileSchema)),
+		"loc":          optional(numberSchema),
+	})
+
+	// projectSchema is the schema of the src.Project model of srcanlzr.
+	projectSchema = object(map[string]field{
+		"schema_version": optional(numberSchema),
+		"name":           required(stringSchema),
+		"repository":     optional(object(nil)),
+		"languages":      optional(arrayOf(languageSchema)),
+		"packages":       optional(arrayOf(packageSchema)),
+		"loc":            optional(numberSchema),
+	})
+)
+
+// SchemaError is a schema violation at a given JSON path.
+type SchemaError struct {
+	Path   string
+	Reason string
+}
+
+func (e SchemaError) Error() string {
+	return e.Path + ": " + e.Reason
+}
+
+// SchemaErrors is the list of schema violations found in a document.
+type SchemaErrors []SchemaError
+
+func (es SchemaErrors) Error() string {
+	msgs := make([]string, len(es))
+	for i, e := range es {
+		msgs[i] = e.Error()
+	}
+	return "invalid project: " + strings.Join(msgs, "; ")
+}
+
+// validate checks v, a generic JSON value, against the schema s and appends
+// the violations to errs.
+func (s *schema) validate(path string, v interface{}, errs *SchemaErrors) {
+	if len(*errs) >= maxSchemaErrors {
+		return
+	}
+
+	kind := kindOf(v)
+	if s.kind == kindAny {
+		return
+	}
+
+	// Go encodes nil slices, maps and pointers as null.
+	if kind == kindNull && (s.kind == kindObject || s.kind == kindArray) {
+		return
+	}
+
+	if kind != s.kind {
+		*errs = append(*errs, SchemaError{path, fmt.Sprintf("expected %s, found %s", s.kind, kind)})
+		return
+	}
+
+	switch v := v.(type) {
+	case map[string]interface{}:
+		names := make([]string, 0, len(s.fields))
+		for name := range s.fields {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		for _, name := range names {
+			f := s.fields[name]
+			fv, ok := v[name]
+			if !ok {
+				if f.required {
+					*errs = append(*errs, SchemaError{path, fmt.Sprintf("missing required field \"%s\"", name)})
+				}
+				continue
+			}
+			f.schema.validate(path+"."+name, fv, errs)
+		}
+	case []interface{}:
+		for i, e := range v {
+			s.elem.validate(fmt.Sprintf("%s[%d]", path, i), e, errs)
+		}
+	}
+}
+
+// kindOf returns the kind of a generic JSON value.
+func kindOf(v interface{}) jsonKind {
+	switch v.(type) {
+	case map[string]interface{}:
+		return kindObject
+	case []interface{}:
+		return kindArray
+	case string:
+		return kindString
+	case json.Number, float64:
+		return kindNumber
+	case bool:
+		return kindBool
+	case nil:
+		return kindNull
+	}
+	return kindAny
+}
+
+// DecodeProject validates the JSON representation of a project against the
+// project schema and decodes it. The returned error, a SchemaErrors when the
+// document does not match the schema, tells precisely where the document is
+// invalid.
+func DecodeProject(r io.Reader) (*src.Project, error) {
+	bs, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read the JSON: %v", err)
+	}
+	return decodeProjectJSON(bs)
+}
+
+// decodeProjectJSON validates and decodes a JSON encoded project.
+func decodeProjectJSON(bs []byte) (*src.Project, error) {
+	dec := json.NewDecoder(bytes.NewReader(bs))
+	dec.UseNumber()
+
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		return nil, fmt.Errorf("malformed JSON: %v", err)
+	}
+
+	// the structure of the other versions is unknown
+	if err := checkSchemaVersion(v); err != nil {
+		return nil, err
+	}
+
+	var errs SchemaErrors
+	projectSchema.validate("$", v, &errs)
+	if len(errs) > 0 {
+		return nil, errs
+	}
+
+	prj, err := src.Decode(bytes.NewReader(bs))
+	if err != nil {
+		return nil, fmt.Errorf("unable to decode the project: %v", err)
+	}
+	return prj, nil
+}
+
+// checkSchemaVersion checks that v, a generic JSON value, does not declare a
+// schema version other than SchemaVersion.
+func checkSchemaVersion(v interface{}) error {
+	obj, ok := v.(map[string]interface{})
+	if !ok {
+		return nil
+	}
+	declared, ok := obj["schema_version"]
+	if !ok {
+		return nil
+	}
+
+	if n, ok := declared.(json.Number); ok && n.String() == strconv.Itoa(SchemaVersion) {
+		return nil
+	}
+
+	version := fmt.Sprint(declared)
+	if s, ok := declared.(string); ok {
+		version = strconv.Quote(s)
+	}
+	return SchemaErrors{{
+		Path:   "$.schema_version",
+		Reason: fmt.Sprintf("unsupported schema version %s, srctool supports version %d only", version, SchemaVersion),
+	}}
+}
@@ -0,0 +1,150 @@
+// Copyright 2014-2015 The DevMine authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package manager
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestDecodeProject(t *testing.T) {
+	tests := []string{
+		`{"name": "p"}`,
+		`{"name": "p", "languages": null, "packages": null}`,
+		`{"name": "p", "schema_version": 1}`,
+		`{"name": "p", "unknown": {"fields": "are allowed"}}`,
+		`{"name": "p", "repository": {"url": "git://example.com/p"}}`,
+		`{
+			"name": "p",
+			"languages": [{"language": "go", "paradigms": ["compiled"]}],
+			"packages": [{
+				"name": "main",
+				"path": "cmd/p",
+				"doc": ["Command p."],
+				"source_files": [{
+					"path": "cmd/p/main.go",
+					"language": {"language": "go"},
+					"imports": ["fmt"],
+					"functions": [{"name": "main", "loc": 3}],
+					"loc": 10
+				}],
+				"loc": 10
+			}],
+			"loc": 10
+		}`,
+	}
+
+	for _, doc := range tests {
+		prj, err := DecodeProject(strings.NewReader(doc))
+		if err != nil {
+			t.Errorf("DecodeProject(%s): unexpected error: %v", doc, err)
+			continue
+		}
+		if prj.Name != "p" {
+			t.Errorf("DecodeProject(%s): name %q, want \"p\"", doc, prj.Name)
+		}
+	}
+}
+
+func TestDecodeProjectSchemaErrors(t *testing.T) {
+	tests := []struct {
+		doc  string
+		errs SchemaErrors
+	}{
+		{
+			`{}`,
+			SchemaErrors{{"$", `missing required field "name"`}},
+		},
+		{
+			`[]`,
+			SchemaErrors{{"$", "expected object, found array"}},
+		},
+		{
+			`{"name": 42}`,
+			SchemaErrors{{"$.name", "expected string, found number"}},
+		},
+		{
+			`{"name": "p", "loc": "10"}`,
+			SchemaErrors{{"$.loc", "expected number, found string"}},
+		},
+		{
+			`{"name": "p", "packages": {}}`,
+			SchemaErrors{{"$.packages", "expected array, found object"}},
+		},
+		{
+			`{"name": "p", "languages": [{"paradigms": [true]}]}`,
+			SchemaErrors{
+				{"$.languages[0]", `missing required field "language"`},
+				{"$.languages[0].paradigms[0]", "expected string, found boolean"},
+			},
+		},
+		{
+			`{"name": "p", "packages": [{"name": "a", "path": "a"}, {"name": "b"}]}`,
+			SchemaErrors{{"$.packages[1]", `missing required field "path"`}},
+		},
+		{
+			`{"name": "p", "packages": [{"name": "a", "path": "a", "source_files": [{"path": "a.go", "loc": "1"}]}]}`,
+			SchemaErrors{{"$.packages[0].source_files[0].loc", "expected number, found string"}},
+		},
+		{
+			`{"name": "p", "packages": [{"name": "a", "path": "a", "source_files": [{"path": "a.go", "functions": [{"name": 1}]}]}]}`,
+			SchemaErrors{{"$.packages[0].source_files[0].functions[0].name", "expected string, found number"}},
+		},
+		{
+			`{"name": "p", "schema_version": 2}`,
+			SchemaErrors{{"$.schema_version", "unsupported schema version 2, srctool supports version 1 only"}},
+		},
+		{
+			`{"name": "p", "schema_version": "1"}`,
+			SchemaErrors{{"$.schema_version", `unsupported schema version "1", srctool supports version 1 only`}},
+		},
+		{
+			// the structure of other versions is unknown: only the
+			// version is reported
+			`{"schema_version": 3, "packages": 1}`,
+			SchemaErrors{{"$.schema_version", "unsupported schema version 3, srctool supports version 1 only"}},
+		},
+	}
+
+	for _, tt := range tests {
+		_, err := DecodeProject(strings.NewReader(tt.doc))
+		errs, ok := err.(SchemaErrors)
+		if !ok {
+			t.Errorf("DecodeProject(%s): error %v, want schema errors", tt.doc, err)
+			continue
+		}
+		if !reflect.DeepEqual(errs, tt.errs) {
+			t.Errorf("DecodeProject(%s): errors %v, want %v", tt.doc, errs, tt.errs)
+		}
+	}
+}
+
+func TestDecodeProjectMalformed(t *testing.T) {
+	for _, doc := range []string{``, `{`, `{"name": "p",}`, `nul`} {
+		_, err := DecodeProject(strings.NewReader(doc))
+		if err == nil || !strings.HasPrefix(err.Error(), "malformed JSON") {
+			t.Errorf("DecodeProject(%q): error %v, want malformed JSON", doc, err)
+		}
+	}
+}
+
+func TestDecodeProjectMaxErrors(t *testing.T) {
+	pkgs := make([]string, maxSchemaErrors+10)
+	for i := range pkgs {
+		pkgs[i] = "{}"
+	}
+	doc := fmt.Sprintf(`{"name": "p", "packages": [%s]}`, strings.Join(pkgs, ","))
+
+	_, err := DecodeProject(strings.NewReader(doc))
+	errs, ok := err.(SchemaErrors)
+	if !ok {
+		t.Fatalf("error %v, want schema errors", err)
+	}
+	if len(errs) != maxSchemaErrors {
+		t.Errorf("%d errors reported, want %d", len(errs), maxSchemaErrors)
+	}
+}
@@ -0,0 +1,403 @@
+// Copyright 2014-2015 The DevMine authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package manager
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os/exec"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/DevMine/srctool/log"
+)
+
+// Parsers declaring "server": true in their metadata are started once with
+// the serverFlag argument and kept running. They receive JSON-RPC 2.0
+// requests on their standard input and write the responses on their
+// standard output, one JSON object per request.
+//
+// The "parse" method takes the path of the project, the list of the files
+// handled by the parser, relative to the project path, and the parser options
+// declared in its metadata. Its result is the project, as output by the
+// parser when run as a command. The "shutdown" notification asks the parser
+// to exit.
+const serverFlag = "--server"
+
+// serverShutdownTimeout is how long a parser server has to exit once asked
+// to shut down before being killed.
+const serverShutdownTimeout = 5 * time.Second
+
+// serverRequestTimeout is how long a parser server has to answer a request
+// before being considered hung and killed, whatever the deadline of the
+// parsing.
+const serverRequestTimeout = time.Hour
+
+// errNoResponse is returned by call when the server does not answer within
+// serverRequestTimeout.
+var errNoResponse = fmt.Errorf("no response within %s", serverRequestTimeout)
+
+// rpcRequest is a JSON-RPC 2.0 request. Notifications have no id.
+type rpcRequest struct {
+	Version string      `json:"jsonrpc"`
+	ID      *uint64     `json:"id,omitempty"`
+	Method  string      `json:"method"`
+	Params  interface{} `json:"params,omitempty"`
+}
+
+// rpcResponse is a JSON-RPC 2.0 response.
+type rpcResponse struct {
+	Version string          `json:"jsonrpc"`
+	ID      *uint64         `json:"id"`
+	Result  json.RawMessage `json:"result"`
+	Error   *rpcError       `json:"error"`
+}
+
+// rpcError is the error of a JSON-RPC 2.0 response.
+type rpcError struct {
+	Code    int             `json:"code"`
+	Message string          `json:"message"`
+	Data    json.RawMessage `json:"data,omitempty"`
+}
+
+func (e *rpcError) Error() string {
+	return fmt.Sprintf("%s (code %d)", e.Message, e.Code)
+}
+
+// parseParams are the parameters of the "parse" method.
+type parseParams struct {
+	Path    string                 `json:"path"`
+	Files   []string               `json:"files,omitempty"`
+	Options map[string]interface{} `json:"options,omitempty"`
+}
+
+// parserServer is a parser running in server mode. Requests are sent one at
+// a time.
+type parserServer struct {
+	mu sync.Mutex
+
+	p      Parser
+	logDir string
+
+	cmd       *exec.Cmd
+	stdin     io.WriteCloser
+	responses chan rpcResponse // responses read from the standard output
+	stderr    *parserStderr
+	exited    chan struct{}
+
+	// diags collects the diagnostics of the server between two requests.
+	diags  *Diagnostics
+	nextID uint64
+}
+
+// start starts the parser process.
+func (s *parserServer) start() error {
+	s.diags = new(Diagnostics)
+
+	stderr, err := newParserStderr(s.p.Name, parserLogFile(s.logDir, s.p.Name), s.diags)
+	if err != nil {
+		return err
+	}
+
+	cmd := exec.Command(s.p.Bin(), serverFlag)
+	cmd.Stderr = stderr
+
+	// the parser is run in a process group of its own, so that killing it
+	// also kills the processes it started, which would keep its standard
+	// output open
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		stderr.Close()
+		return &ParserError{Parser: s.p.Name, Err: fmt.Errorf("unable to start the server: %v", err)}
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		stderr.Close()
+		return &ParserError{Parser: s.p.Name, Err: fmt.Errorf("unable to start the server: %v", err)}
+	}
+
+	log.Debug("command: ", s.p.Bin(), " ", serverFlag)
+
+	if err = cmd.Start(); err != nil {
+		stderr.Close()
+		return &ParserError{Parser: s.p.Name, Err: fmt.Errorf("unable to start the server: %v", err)}
+	}
+
+	s.cmd, s.stdin, s.stderr = cmd, stdin, stderr
+	s.responses = make(chan rpcResponse, 1)
+	s.exited = make(chan struct{})
+
+	go s.read(cmd, stdout, stderr, s.responses, s.exited)
+
+	return nil
+}
+
+// read reads the responses of the parser process from its standard output
+// until it is closed, then waits for the process to exit, closes its
+// standard error output and closes exited.
+// As Wait closes the standard output, it is only called once everything was
+// read. Responses that no request waits for are dropped, and malformed
+// output gets the process killed.
+func (s *parserServer) read(cmd *exec.Cmd, stdout io.Reader, stderr *parserStderr, responses chan rpcResponse, exited chan struct{}) {
+	dec := json.NewDecoder(stdout)
+	for {
+		var resp rpcResponse
+		if err := dec.Decode(&resp); err != nil {
+			if err != io.EOF {
+				log.Debug(s.p.Name, " server: malformed response: ", err)
+				killGroup(cmd)
+			}
+			break
+		}
+
+		select {
+		case responses <- resp:
+		default:
+			log.Debug(s.p.Name, " server: dropping an unexpected response")
+		}
+	}
+
+	if err := cmd.Wait(); err != nil {
+		log.Debug(s.p.Name, " server: ", err)
+	}
+	stderr.Close()
+	close(exited)
+}
+
+// running tells whether the parser process is running.
+func (s *parserServer) running() bool {
+	if s.cmd == nil {
+		return false
+	}
+	select {
+	case <-s.exited:
+		return false
+	default:
+		return true
+	}
+}
+
+// parse sends a parse request for the given files of the project at
+// projectPath and returns the output of the parser. The diagnostics emitted
+// meanwhile are added to diags.
+// If the parser is not running, because it crashed during an earlier
+// request for instance, it is restarted. If it crashes during the request,
+// it is restarted and the request is sent again, once. If ctx is done before
+// the response, the parser process is killed.
+func (s *parserServer) parse(ctx context.Context, projectPath string, files []string, diags *Diagnostics) (*bytes.Buffer, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	params := parseParams{Path: projectPath, Files: files, Options: s.p.Meta.Options}
+
+	var out json.RawMessage
+	var err error
+	for attempt := 0; attempt < 2; attempt++ {
+		if !s.running() {
+			if s.cmd != nil {
+				log.Fail("the ", s.p.Name, " parser server exited, restarting it")
+			}
+			if err = s.start(); err != nil {
+				return nil, err
+			}
+		}
+
+		out, err = s.call(ctx, "parse", params)
+		for _, d := range s.diags.Drain() {
+			diags.Add(d)
+		}
+		if ctx.Err() != nil {
+			s.kill()
+			return nil, ctx.Err()
+		}
+
+		if _, ok := err.(*rpcError); ok || err == nil {
+			break
+		}
+		if err == errNoResponse {
+			// a hung parser would hang again
+			s.kill()
+			return nil, &ParserError{Parser: s.p.Name, Err: err}
+		}
+		log.Debug(s.p.Name, " server: ", err)
+
+		// the server is in an unknown state: start from a fresh process
+		s.kill()
+	}
+
+	if err != nil {
+		if _, ok := err.(*rpcError); ok {
+			return nil, &ParserError{Parser: s.p.Name, Err: err}
+		}
+		return nil, &ParserError{Parser: s.p.Name, Err: errors.New("the server crashed")}
+	}
+
+	if len(out) == 0 || string(out) == "null" {
+		return nil, &ParserError{Parser: s.p.Name, Err: errors.New("no output produced")}
+	}
+	return bytes.NewBuffer(out), nil
+}
+
+// call sends a request and waits for its response. It returns an *rpcError
+// if the parser answered with an error and errNoResponse if it did not answer
+// within serverRequestTimeout. The parser process is killed if ctx is done
+// before the response.
+func (s *parserServer) call(ctx context.Context, method string, params interface{}) (json.RawMessage, error) {
+	// drop the responses to earlier requests that nobody waited for
+	for len(s.responses) > 0 {
+		<-s.responses
+	}
+
+	s.nextID++
+	id := s.nextID
+
+	req := rpcRequest{Version: "2.0", ID: &id, Method: method, Params: params}
+	if err := json.NewEncoder(s.stdin).Encode(req); err != nil {
+		return nil, err
+	}
+
+	timeout := time.NewTimer(serverRequestTimeout)
+	defer timeout.Stop()
+
+	var resp rpcResponse
+	select {
+	case resp = <-s.responses:
+	case <-s.exited:
+		// the response may have been read before the process exited
+		select {
+		case resp = <-s.responses:
+		default:
+			return nil, errors.New("the server exited")
+		}
+	case <-ctx.Done():
+		killGroup(s.cmd)
+		return nil, ctx.Err()
+	case <-timeout.C:
+		return nil, errNoResponse
+	}
+
+	if resp.ID == nil || *resp.ID != id {
+		return nil, errors.New("unexpected response id")
+	}
+	if resp.Error != nil {
+		return nil, resp.Error
+	}
+	return resp.Result, nil
+}
+
+// stop asks the parser process to exit and kills it if it does not within
+// serverShutdownTimeout.
+func (s *parserServer) stop() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.running() {
+		return
+	}
+
+	req := rpcRequest{Version: "2.0", Method: "shutdown"}
+	if err := json.NewEncoder(s.stdin).Encode(req); err != nil {
+		log.Debug(err)
+	}
+	s.stdin.Close()
+
+	select {
+	case <-s.exited:
+	case <-time.After(serverShutdownTimeout):
+		log.Debug(s.p.Name, " server did not exit, killing it")
+		s.kill()
+	}
+}
+
+// kill kills the parser process and waits for it to exit.
+func (s *parserServer) kill() {
+	if !s.running() {
+		return
+	}
+	killGroup(s.cmd)
+	<-s.exited
+}
+
+// killGroup kills the process group of a parser process.
+func killGroup(cmd *exec.Cmd) {
+	if err := syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL); err != nil {
+		log.Debug(err)
+	}
+}
+
+// ServerPool holds the parser servers started during a batch of parsings,
+// so that each parser is started only once. It is safe for concurrent use.
+// The servers must be stopped with Close once done.
+type ServerPool struct {
+	mu      sync.Mutex
+	logDir  string
+	servers map[string]*parserServer
+}
+
+// NewServerPool creates an empty pool. The standard error output of the
+// servers is saved into logDir, if not empty.
+func NewServerPool(logDir string) *ServerPool {
+	return &ServerPool{logDir: logDir, servers: make(map[string]*parserServer)}
+}
+
+// get returns the server of a parser. The server is started on its first
+// request.
+func (sp *ServerPool) get(p Parser) *parserServer {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+
+	s, ok := sp.servers[p.Name]
+	if !ok {
+		s = &parserServer{p: p, logDir: sp.logDir}
+		sp.servers[p.Name] = s
+	}
+	return s
+}
+
+// Close stops all servers of the pool.
+func (sp *ServerPool) Close() {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+
+	var wg sync.WaitGroup
+	for _, s := range sp.servers {
+		wg.Add(1)
+		go func(s *parserServer) {
+			defer wg.Done()
+			s.stop()
+		}(s)
+	}
+	wg.Wait()
+}
+
+// serverRoutine runs a parse request on the server of parser p.
+func serverRoutine(ctx context.Context, sp *ServerPool, p Parser, projectPath string, diags *Diagnostics, c chan Result) {
+	absPath, err := filepath.Abs(projectPath)
+	if err != nil {
+		c <- Result{Parser: p.Name, Err: err}
+		return
+	}
+
+	files, err := parserFiles(p, absPath)
+	if err != nil {
+		c <- Result{Parser: p.Name, Err: err}
+		return
+	}
+
+	out, err := sp.get(p).parse(ctx, absPath, files, diags)
+	if err != nil {
+		c <- Result{Parser: p.Name, Err: err}
+		return
+	}
+	c <- Result{Parser: p.Name, out: out}
+}
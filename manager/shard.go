@@ -0,0 +1,212 @@
+// Copyright 2014-2015 The DevMine authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package manager
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/DevMine/srcanlzr/src"
+
+	"github.com/DevMine/srctool/log"
+)
+
+// Parsers declaring "file_list": true in their metadata accept a list of files
+// to parse. When run as a command, they are given the fileListFlag argument
+// before the project path and read the files on their standard input, one
+// per line, relative to the project path.
+const fileListFlag = "--file-list"
+
+// Sharding modes.
+const (
+	ShardNone  = ""      // do not shard projects
+	ShardDir   = "dir"   // one shard per top-level directory
+	ShardFiles = "files" // shards of a fixed number of files
+)
+
+// defaultShardSize is the default number of files of a shard.
+const defaultShardSize = 1000
+
+// ShardOptions tells how projects are split into shards. The zero value does
+// not shard projects.
+type ShardOptions struct {
+	// Mode is one of the sharding modes.
+	Mode string
+
+	// Size is the number of files of a shard in the "files" mode. It
+	// defaults to 1000.
+	Size int
+
+	// Jobs is the maximum number of shards parsed in parallel by each
+	// parser. It defaults to the number of CPUs.
+	Jobs int
+}
+
+// ParseShardOptions checks the sharding options and sets the default values.
+func ParseShardOptions(mode string, size, jobs int) (ShardOptions, error) {
+	so := ShardOptions{Mode: mode, Size: size, Jobs: jobs}
+
+	switch mode {
+	case ShardNone, ShardDir, ShardFiles:
+	default:
+		return so, fmt.Errorf("unknown sharding mode '%s', expected %s or %s", mode, ShardDir, ShardFiles)
+	}
+
+	if so.Size <= 0 {
+		so.Size = defaultShardSize
+	}
+	if so.Jobs <= 0 {
+		so.Jobs = runtime.NumCPU()
+	}
+	return so, nil
+}
+
+// shard is a subset of the files of a project.
+type shard struct {
+	name  string
+	files []string
+}
+
+// splitFiles splits files into shards according to so. Files are expected
+// to be relative to the project path.
+func splitFiles(files []string, so ShardOptions) []shard {
+	sorted := make([]string, len(files))
+	copy(sorted, files)
+	sort.Strings(sorted)
+
+	var shards []shard
+	switch so.Mode {
+	case ShardDir:
+		// files at the root of the project are gathered into the "." shard
+		index := make(map[string]int)
+		for _, f := range sorted {
+			dir := "."
+			if i := strings.Index(f, string(filepath.Separator)); i > 0 {
+				dir = f[:i]
+			}
+
+			i, ok := index[dir]
+			if !ok {
+				i = len(shards)
+				index[dir] = i
+				shards = append(shards, shard{name: dir})
+			}
+			shards[i].files = append(shards[i].files, f)
+		}
+	case ShardFiles:
+		for i := 0; i < len(sorted); i += so.Size {
+			end := i + so.Size
+			if end > len(sorted) {
+				end = len(sorted)
+			}
+			sh := shard{name: sorted[i], files: sorted[i:end]}
+			if end-i > 1 {
+				sh.name += ".." + sorted[end-1]
+			}
+			shards = append(shards, sh)
+		}
+	}
+
+	return shards
+}
+
+// shardRoutine runs parser p on the project located at projectPath, split
+// into shards. The shards are parsed in parallel, at most opts.Shard.Jobs at
+// a time, validated and merged. If the project is too small to be split, the
+// parser is run normally. Parsers running in server mode parse their shards
+// one after the other. Every failing shard is reported and makes the
+// parsing fail.
+func shardRoutine(ctx context.Context, p Parser, projectPath string, opts ParseOptions, c chan Result) {
+	absPath, err := filepath.Abs(projectPath)
+	if err != nil {
+		c <- Result{Parser: p.Name, Err: err}
+		return
+	}
+
+	files, err := parserFiles(p, absPath)
+	if err != nil {
+		c <- Result{Parser: p.Name, Err: err}
+		return
+	}
+
+	shards := splitFiles(files, opts.Shard)
+	if len(shards) <= 1 {
+		if p.Meta.Server {
+			serverRoutine(ctx, opts.Servers, p, projectPath, opts.Diagnostics, c)
+		} else {
+			cmdRoutine(ctx, p, projectPath, opts.LogDir, opts.Diagnostics, c)
+		}
+		return
+	}
+
+	log.Fields{"parser": p.Name, "project": projectPath}.Info(fmt.Sprintf("parsing with the %s parser in %d shards", p.Name, len(shards)))
+
+	prjs := make([]*src.Project, len(shards))
+	errs := make([]error, len(shards))
+
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, opts.Shard.Jobs)
+	for i := range shards {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			prjs[i], errs[i] = parseShard(ctx, p, absPath, shards[i], i, opts)
+		}(i)
+	}
+	wg.Wait()
+
+	failed := 0
+	for i, err := range errs {
+		if err != nil {
+			log.Fields{"parser": p.Name, "project": projectPath}.Fail(fmt.Sprintf("%s: shard %d/%d (%s): %v", p.Name, i+1, len(shards), shards[i].name, err))
+			failed++
+		}
+	}
+	if failed > 0 {
+		c <- Result{Parser: p.Name, Err: &ParserError{Parser: p.Name, Err: fmt.Errorf("failed on %d shard(s) out of %d", failed, len(shards))}}
+		return
+	}
+
+	prj, err := src.MergeAll(prjs...)
+	if err != nil {
+		log.Debug(err)
+		c <- Result{Parser: p.Name, Err: fmt.Errorf("unable to merge the shards of the %s parser", p.Name)}
+		return
+	}
+	c <- Result{Parser: p.Name, prj: prj}
+}
+
+// parseShard runs parser p on a shard of the project located at projectPath
+// and returns the validated result. The standard error output of the parser
+// is saved into a log file named after the parser and the shard number.
+func parseShard(ctx context.Context, p Parser, projectPath string, sh shard, i int, opts ParseOptions) (*src.Project, error) {
+	var out *bytes.Buffer
+	var err error
+
+	if p.Meta.Server {
+		out, err = opts.Servers.get(p).parse(ctx, projectPath, sh.files, opts.Diagnostics)
+	} else {
+		logFile := parserLogFile(opts.LogDir, fmt.Sprintf("%s.%d", p.Name, i+1))
+		out, err = runParserCmd(ctx, p, projectPath, sh.files, logFile, opts.Diagnostics)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	prj, err := decodeProjectJSON(out.Bytes())
+	if err != nil {
+		return nil, &OutputError{Parser: p.Name, Err: err}
+	}
+	return prj, nil
+}
@@ -0,0 +1,93 @@
+// Copyright 2014-2015 The DevMine authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package manager
+
+import (
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestParseShardOptions(t *testing.T) {
+	cpus := runtime.NumCPU()
+
+	tests := []struct {
+		mode       string
+		size, jobs int
+		want       ShardOptions
+	}{
+		{ShardNone, 0, 0, ShardOptions{Mode: ShardNone, Size: defaultShardSize, Jobs: cpus}},
+		{ShardDir, 0, 0, ShardOptions{Mode: ShardDir, Size: defaultShardSize, Jobs: cpus}},
+		{ShardFiles, 50, 4, ShardOptions{Mode: ShardFiles, Size: 50, Jobs: 4}},
+		{ShardFiles, -1, -2, ShardOptions{Mode: ShardFiles, Size: defaultShardSize, Jobs: cpus}},
+		{ShardFiles, 1, 0, ShardOptions{Mode: ShardFiles, Size: 1, Jobs: cpus}},
+		{ShardDir, 0, 1, ShardOptions{Mode: ShardDir, Size: defaultShardSize, Jobs: 1}},
+	}
+
+	for _, tt := range tests {
+		so, err := ParseShardOptions(tt.mode, tt.size, tt.jobs)
+		if err != nil {
+			t.Errorf("ParseShardOptions(%q, %d, %d): unexpected error: %v", tt.mode, tt.size, tt.jobs, err)
+			continue
+		}
+		if so != tt.want {
+			t.Errorf("ParseShardOptions(%q, %d, %d) = %+v, want %+v", tt.mode, tt.size, tt.jobs, so, tt.want)
+		}
+	}
+}
+
+func TestParseShardOptionsErrors(t *testing.T) {
+	for _, mode := range []string{"file", "dirs", "DIR", " dir", "none"} {
+		_, err := ParseShardOptions(mode, 0, 0)
+		if err == nil || !strings.Contains(err.Error(), "unknown sharding mode '"+mode+"'") {
+			t.Errorf("ParseShardOptions(%q): error %v, want unknown sharding mode", mode, err)
+		}
+	}
+}
+
+func TestSplitFiles(t *testing.T) {
+	files := []string{"b/2.go", "main.go", "a/1.go", "b/1.go", "a/sub/3.go"}
+
+	tests := []struct {
+		so     ShardOptions
+		shards []shard
+	}{
+		{
+			ShardOptions{Mode: ShardDir},
+			[]shard{
+				{name: "a", files: []string{"a/1.go", "a/sub/3.go"}},
+				{name: "b", files: []string{"b/1.go", "b/2.go"}},
+				{name: ".", files: []string{"main.go"}},
+			},
+		},
+		{
+			ShardOptions{Mode: ShardFiles, Size: 2},
+			[]shard{
+				{name: "a/1.go..a/sub/3.go", files: []string{"a/1.go", "a/sub/3.go"}},
+				{name: "b/1.go..b/2.go", files: []string{"b/1.go", "b/2.go"}},
+				{name: "main.go", files: []string{"main.go"}},
+			},
+		},
+		{
+			ShardOptions{Mode: ShardFiles, Size: 10},
+			[]shard{
+				{name: "a/1.go..main.go", files: []string{"a/1.go", "a/sub/3.go", "b/1.go", "b/2.go", "main.go"}},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		shards := splitFiles(files, tt.so)
+		if len(shards) != len(tt.shards) {
+			t.Errorf("splitFiles(%+v): %d shards, want %d", tt.so, len(shards), len(tt.shards))
+			continue
+		}
+		for i := range shards {
+			if shards[i].name != tt.shards[i].name || strings.Join(shards[i].files, " ") != strings.Join(tt.shards[i].files, " ") {
+				t.Errorf("splitFiles(%+v): shard %d = %+v, want %+v", tt.so, i, shards[i], tt.shards[i])
+			}
+		}
+	}
+}
@@ -10,6 +10,7 @@ package main
 import (
 	"fmt"
 	"os"
+	"time"
 
 	"github.com/codegangsta/cli"
 
@@ -29,6 +30,37 @@ func main() {
 			Name:  "d",
 			Usage: "enable debug mode",
 		},
+		cli.BoolFlag{
+			Name:  "json",
+			Usage: "print the results and errors in JSON on stdout",
+		},
+		cli.StringFlag{
+			Name:  "data-dir",
+			Usage: "directory holding the parsers and the data of srctool (data_dir setting)",
+		},
+		cli.StringSliceFlag{
+			Name:  "set",
+			Value: &cli.StringSlice{},
+			Usage: "override a configuration value, as key=value",
+		},
+		cli.StringFlag{
+			Name:  "log-level",
+			Value: "info",
+			Usage: "minimum level of the logged messages: debug, info, warn or error",
+		},
+		cli.BoolFlag{
+			Name:  "quiet, q",
+			Usage: "only log errors",
+		},
+		cli.StringFlag{
+			Name:  "log-format",
+			Value: "text",
+			Usage: "format of the logged messages: text or json",
+		},
+		cli.BoolFlag{
+			Name:  "log-file",
+			Usage: "also log into srctool.log, in the data directory",
+		},
 	}
 	app.Commands = []cli.Command{
 		{
@@ -36,7 +68,7 @@ func main() {
 			ShortName: "i",
 			Usage:     "install one or all language parser(s)",
 			Action: func(c *cli.Context) {
-				log.SetDebugMode(c.GlobalBool("d"))
+				setupLog(c)
 				cmd.Install(c)
 			},
 		},
@@ -51,7 +83,7 @@ func main() {
 				},
 			},
 			Action: func(c *cli.Context) {
-				log.SetDebugMode(c.GlobalBool("d"))
+				setupLog(c)
 				cmd.Delete(c)
 			},
 		},
@@ -60,7 +92,7 @@ func main() {
 			ShortName: "u",
 			Usage:     "update one or all language parser(s)",
 			Action: func(c *cli.Context) {
-				log.SetDebugMode(c.GlobalBool("d"))
+				setupLog(c)
 				cmd.Update(c)
 			},
 		},
@@ -75,7 +107,7 @@ func main() {
 				},
 			},
 			Action: func(c *cli.Context) {
-				log.SetDebugMode(c.GlobalBool("d"))
+				setupLog(c)
 				cmd.List(c)
 			},
 		},
@@ -83,11 +115,307 @@ func main() {
 			Name:      "parse",
 			ShortName: "p",
 			Usage:     "parse a project",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "o",
+					Usage: "write the output into this file instead of stdout",
+				},
+				cli.StringFlag{
+					Name:  "format",
+					Value: "json",
+					Usage: "output format: json, pretty, jsonl, gzip, cbor or msgpack",
+				},
+				cli.StringFlag{
+					Name:  "parser-logs",
+					Usage: "save the error output of each parser into this directory",
+				},
+				cli.StringFlag{
+					Name:  "diagnostics",
+					Usage: "write the parsers diagnostics into this file",
+				},
+				cli.BoolFlag{
+					Name:  "inline-diagnostics",
+					Usage: "embed the parsers diagnostics into the output",
+				},
+				cli.StringFlag{
+					Name:  "on-conflict",
+					Value: "keep",
+					Usage: "what to do when parsers claim the same language or file: keep, error or prefer:<parser>[,<parser>...]",
+				},
+				cli.BoolFlag{
+					Name:  "authors",
+					Usage: "annotate the output with the authorship of files, functions and types (git only)",
+				},
+				cli.StringFlag{
+					Name:  "shard",
+					Usage: "split projects for the parsers accepting file lists: dir (per top-level directory) or files",
+				},
+				cli.IntFlag{
+					Name:  "shard-size",
+					Value: 1000,
+					Usage: "number of files per shard with --shard files",
+				},
+				cli.IntFlag{
+					Name:  "shard-jobs",
+					Usage: "maximum number of shards parsed in parallel by each parser (default: number of CPUs)",
+				},
+				cli.BoolFlag{
+					Name:  "watch",
+					Usage: "parse again every time a source file changes (requires -o)",
+				},
+				cli.DurationFlag{
+					Name:  "debounce",
+					Value: 500 * time.Millisecond,
+					Usage: "in watch mode, how long to wait after the last change before parsing again",
+				},
+			},
 			Action: func(c *cli.Context) {
-				log.SetDebugMode(c.GlobalBool("d"))
+				setupLog(c)
 				cmd.Parse(c)
 			},
 		},
+		{
+			Name:      "merge",
+			ShortName: "m",
+			Usage:     "merge saved parse results",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "o",
+					Usage: "write the output into this file instead of stdout",
+				},
+				cli.StringFlag{
+					Name:  "format",
+					Value: "json",
+					Usage: "output format: json, pretty, jsonl, gzip, cbor or msgpack",
+				},
+				cli.StringFlag{
+					Name:  "on-conflict",
+					Value: "keep",
+					Usage: "what to do when results claim the same language or file: keep, error or prefer:<file>[,<file>...]",
+				},
+			},
+			Action: func(c *cli.Context) {
+				setupLog(c)
+				cmd.Merge(c)
+			},
+		},
+		{
+			Name:  "history",
+			Usage: "parse a range of revisions of a git repository",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "range",
+					Value: "HEAD",
+					Usage: "git revision range, e.g. v1.0..v2.0",
+				},
+				cli.StringFlag{
+					Name:  "step",
+					Value: "tags",
+					Usage: "revisions to parse: tags, commits or every N commits",
+				},
+				cli.StringFlag{
+					Name:  "o",
+					Usage: "output directory",
+				},
+				cli.StringFlag{
+					Name:  "format",
+					Value: "json",
+					Usage: "output format: json, pretty, jsonl, gzip, cbor or msgpack",
+				},
+				cli.StringFlag{
+					Name:  "on-conflict",
+					Value: "keep",
+					Usage: "what to do when parsers claim the same language or file: keep, error or prefer:<parser>[,<parser>...]",
+				},
+			},
+			Action: func(c *cli.Context) {
+				setupLog(c)
+				cmd.History(c)
+			},
+		},
+		{
+			Name:  "validate",
+			Usage: "validate saved parse results",
+			Action: func(c *cli.Context) {
+				setupLog(c)
+				cmd.Validate(c)
+			},
+		},
+		{
+			Name:  "stats",
+			Usage: "print statistics of a project or of a saved parse result",
+			Flags: []cli.Flag{
+				cli.BoolFlag{
+					Name:  "json",
+					Usage: "print the statistics in JSON",
+				},
+			},
+			Action: func(c *cli.Context) {
+				setupLog(c)
+				cmd.Stats(c)
+			},
+		},
+		{
+			Name:  "diff",
+			Usage: "compare two saved parse results",
+			Flags: []cli.Flag{
+				cli.BoolFlag{
+					Name:  "json",
+					Usage: "print the differences in JSON",
+				},
+			},
+			Action: func(c *cli.Context) {
+				setupLog(c)
+				cmd.Diff(c)
+			},
+		},
+		{
+			Name:      "query",
+			ShortName: "q",
+			Usage:     "query a saved parse result",
+			Flags: []cli.Flag{
+				cli.BoolFlag{
+					Name:  "json",
+					Usage: "print the results in JSON",
+				},
+			},
+			Action: func(c *cli.Context) {
+				setupLog(c)
+				cmd.Query(c)
+			},
+		},
+		{
+			Name:  "export",
+			Usage: "export saved parse results into a database",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "sqlite",
+					Usage: "path of the SQLite database",
+				},
+				cli.StringFlag{
+					Name:  "tag",
+					Usage: "tag of the export run",
+				},
+			},
+			Action: func(c *cli.Context) {
+				setupLog(c)
+				cmd.Export(c)
+			},
+		},
+		{
+			Name:      "graph",
+			ShortName: "g",
+			Usage:     "export the import, call or type graph of a saved parse result",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "kind",
+					Value: "imports",
+					Usage: "kind of graph: imports, calls or types",
+				},
+				cli.StringFlag{
+					Name:  "format",
+					Value: "dot",
+					Usage: "output format: dot, graphml or json",
+				},
+				cli.BoolFlag{
+					Name:  "collapse",
+					Usage: "collapse the nodes to the package level",
+				},
+				cli.StringFlag{
+					Name:  "prefix",
+					Usage: "only keep the nodes of the files whose path starts with this prefix",
+				},
+			},
+			Action: func(c *cli.Context) {
+				setupLog(c)
+				cmd.Graph(c)
+			},
+		},
+		{
+			Name:  "serve",
+			Usage: "serve a REST API to submit parse jobs",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "listen",
+					Value: "127.0.0.1:8080",
+					Usage: "address to listen on",
+				},
+				cli.StringFlag{
+					Name:  "root",
+					Usage: "directory under which the jobs may parse local paths, none by default",
+				},
+				cli.IntFlag{
+					Name:  "workers",
+					Value: 2,
+					Usage: "maximum number of jobs run at the same time",
+				},
+			},
+			Action: func(c *cli.Context) {
+				setupLog(c)
+				cmd.Serve(c)
+			},
+		},
+		{
+			Name:  "coordinator",
+			Usage: "distribute the parsing of a list of projects to workers",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "listen",
+					Value: "127.0.0.1:8090",
+					Usage: "address to listen on",
+				},
+				cli.StringFlag{
+					Name:  "o",
+					Usage: "directory where the results and the state of the tasks are written",
+				},
+				cli.StringFlag{
+					Name:  "lockfile",
+					Usage: "lockfile of the parsers to use (default: the installed parsers)",
+				},
+				cli.DurationFlag{
+					Name:  "lease",
+					Value: 5 * time.Minute,
+					Usage: "duration of the lease of a task, extended by the heartbeats of the worker",
+				},
+				cli.IntFlag{
+					Name:  "max-attempts",
+					Value: 3,
+					Usage: "maximum number of attempts to parse a project",
+				},
+			},
+			Action: func(c *cli.Context) {
+				setupLog(c)
+				cmd.Coordinator(c)
+			},
+		},
+		{
+			Name:  "worker",
+			Usage: "parse projects on behalf of a coordinator",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "coordinator",
+					Usage: "URL of the coordinator",
+				},
+				cli.StringFlag{
+					Name:  "name",
+					Usage: "name of the worker (default: hostname and process id)",
+				},
+				cli.StringFlag{
+					Name:  "on-conflict",
+					Value: "keep",
+					Usage: "what to do when parsers claim the same language or file: keep, error or prefer:<parser>[,<parser>...]",
+				},
+				cli.DurationFlag{
+					Name:  "poll",
+					Value: time.Second,
+					Usage: "how long to wait before asking again when no task is available",
+				},
+			},
+			Action: func(c *cli.Context) {
+				setupLog(c)
+				cmd.Worker(c)
+			},
+		},
 		{
 			Name:      "config",
 			ShortName: "c",
@@ -97,9 +425,13 @@ func main() {
 					Name:  "server-url",
 					Usage: "get/set the download server URL",
 				},
+				cli.BoolFlag{
+					Name:  "show-origin",
+					Usage: "show the value of each setting and where it comes from",
+				},
 			},
 			Action: func(c *cli.Context) {
-				log.SetDebugMode(c.GlobalBool("d"))
+				setupLog(c)
 				cmd.Config(c)
 			},
 		},
@@ -115,3 +447,33 @@ func main() {
 
 	app.Run(os.Args)
 }
+
+// setupLog configures the logging as requested by the global options. The
+// messages are tagged with the name of the command.
+func setupLog(c *cli.Context) {
+	lvl, err := log.ParseLevel(c.GlobalString("log-level"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	if c.GlobalBool("quiet") {
+		lvl = log.ErrorLevel
+	}
+	if c.GlobalBool("d") {
+		lvl = log.DebugLevel
+	}
+	log.SetLevel(lvl)
+
+	format, err := log.ParseFormat(c.GlobalString("log-format"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.SetFormat(format)
+	log.SetJSONMode(c.GlobalBool("json"))
+	log.SetFields(log.Fields{"command": c.Command.Name})
+
+	if c.GlobalBool("log-file") {
+		if err = cmd.OpenLogFile(c); err != nil {
+			log.Fatal("unable to open the log file: ", err)
+		}
+	}
+}